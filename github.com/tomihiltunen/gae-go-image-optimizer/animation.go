@@ -0,0 +1,74 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"image/draw"
+	"image/gif"
+)
+
+/*
+ * Resizes every frame of the animation.
+ *
+ *      - Frames only hold the changes to the previous ones so they are
+ *        drawn on a full canvas before resizing, honoring the disposal methods.
+ *      - The resized frames are full frames mapped back to their original palettes.
+ */
+func resizeAnimation(options *CompressionOptions, anim *gif.GIF, size_x, size_y int) *gif.GIF {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	resized := &gif.GIF{
+		Image:     make([]*image.Paletted, len(anim.Image)),
+		Delay:     anim.Delay,
+		LoopCount: anim.LoopCount,
+		Disposal:  make([]byte, len(anim.Image)),
+		Config: image.Config{
+			ColorModel: anim.Config.ColorModel,
+			Width:      size_x,
+			Height:     size_y,
+		},
+		BackgroundIndex: anim.BackgroundIndex,
+	}
+	for index, frame := range anim.Image {
+		disposal := byte(0)
+		if index < len(anim.Disposal) {
+			disposal = anim.Disposal[index]
+		}
+		// Remember the canvas if the frame is to be thrown away
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, image.Point{}, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		// Resize the full canvas and map it back to the palette of the frame
+		img := scaleImage(options, canvas, bounds, size_x, size_y)
+		paletted := image.NewPaletted(image.Rect(0, 0, size_x, size_y), frame.Palette)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, image.Point{})
+		resized.Image[index] = paletted
+		// Full frames replace each other completely
+		resized.Disposal[index] = gif.DisposalBackground
+		// Dispose the frame as told
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return resized
+}
@@ -0,0 +1,137 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"image/color"
+	"math"
+
+	// 3rd-party
+	"github.com/tomihiltunen/resize"
+)
+
+/*
+ * BlurHash components, more of them keep more of the layout in a longer hash.
+ *
+ *      blurHashX   Horizontal components, 1-9
+ *      blurHashY   Vertical components, 1-9
+ *      blurHashLen Largest dimension the image is scaled down to first, the hash needs no more detail
+ */
+const (
+	blurHashX   = 4
+	blurHashY   = 3
+	blurHashLen = 32
+)
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Appends the value as the given number of base 83 digits
+func appendBase83(hash []byte, value, digits int) []byte {
+	for i := digits - 1; i >= 0; i-- {
+		hash = append(hash, base83[value/int(math.Pow(83, float64(i)))%83])
+	}
+	return hash
+}
+
+/*
+ * Computes the BlurHash (https://blurha.sh) of the image, blurHashX x blurHashY components.
+ * The colors are taken without alpha, as the clients draw the hash opaque.
+ */
+func blurHash(img image.Image) string {
+	bounds := img.Bounds()
+	size_x, size_y := bounds.Dx(), bounds.Dy()
+	if size_x == 0 || size_y == 0 {
+		return ""
+	}
+	if size_x > blurHashLen || size_y > blurHashLen {
+		scale := float64(blurHashLen) / math.Max(float64(size_x), float64(size_y))
+		size_x = int(math.Max(1, math.Round(float64(size_x)*scale)))
+		size_y = int(math.Max(1, math.Round(float64(size_y)*scale)))
+		img = resize.Resize(img, bounds, size_x, size_y)
+		bounds = img.Bounds()
+	}
+	linearOnce.Do(buildLinearTables)
+	linear := make([][3]float64, 0, size_x*size_y)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			linear = append(linear, [3]float64{
+				float64(toLinearTable[c.R]) / 0xffff,
+				float64(toLinearTable[c.G]) / 0xffff,
+				float64(toLinearTable[c.B]) / 0xffff,
+			})
+		}
+	}
+	// Cosine transform of the pixels, the first factor is the average color
+	factors := make([][3]float64, 0, blurHashX*blurHashY)
+	for j := 0; j < blurHashY; j++ {
+		for i := 0; i < blurHashX; i++ {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+			var factor [3]float64
+			for y := 0; y < size_y; y++ {
+				for x := 0; x < size_x; x++ {
+					basis := normalization *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(size_x)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(size_y))
+					pixel := linear[y*size_x+x]
+					for c := range factor {
+						factor[c] += basis * pixel[c]
+					}
+				}
+			}
+			for c := range factor {
+				factor[c] /= float64(size_x * size_y)
+			}
+			factors = append(factors, factor)
+		}
+	}
+	hash := appendBase83(nil, (blurHashX-1)+(blurHashY-1)*9, 1)
+	maximum := 1.0
+	if len(factors) > 1 {
+		actual := 0.0
+		for _, factor := range factors[1:] {
+			for _, v := range factor {
+				actual = math.Max(actual, math.Abs(v))
+			}
+		}
+		quantized := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantized+1) / 166
+		hash = appendBase83(hash, quantized, 1)
+	} else {
+		hash = appendBase83(hash, 0, 1)
+	}
+	// The average color in sRGB
+	dc := 0
+	for _, v := range factors[0] {
+		dc = dc<<8 | int(fromLinearTable[uint16(math.Max(0, math.Min(1, v))*0xffff+0.5)])
+	}
+	hash = appendBase83(hash, dc, 4)
+	for _, factor := range factors[1:] {
+		ac := 0
+		for _, v := range factor {
+			// Square root of the magnitude keeps the small ones apart
+			v /= maximum
+			q := math.Copysign(math.Sqrt(math.Abs(v)), v)
+			ac = ac*19 + int(math.Max(0, math.Min(18, math.Floor(q*9+9.5))))
+		}
+		hash = appendBase83(hash, ac, 2)
+	}
+	return string(hash)
+}
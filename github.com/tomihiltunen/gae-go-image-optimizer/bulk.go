@@ -0,0 +1,262 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+/*
+ * Default values for the bulk jobs.
+ */
+const (
+	DefaultChunkSize = 50              // Blobs handled on each run
+	BulkProgressKind = "OptimgBulkJob" // Datastore kind of the progress entities
+)
+
+/*
+ * A job optimizing the blobs already in the blobstore, chunk by chunk.
+ * Call Run() from a task queue handler until the progress is Done.
+ *
+ *      ID          Name of the job, the progress is stored under it in the datastore
+ *      Keys        Blobs to go through, every blob in the blobstore if empty; must be the same on each run
+ *      Outdated    Go through the blobs optimized with an older Version of the options only, instead of Keys
+ *      ChunkSize   Blobs handled on each run, defaults to DefaultChunkSize
+ *      Options     Options for the optimization, defaults if nil; Request and Context are not used
+ *      OnReplace   Called with each optimized blob before the original is deleted, e.g. to update the references
+ */
+type BulkJob struct {
+	ID        string
+	Keys      []appengine.BlobKey
+	Outdated  bool
+	ChunkSize int
+	Options   *CompressionOptions
+	OnReplace func(c context.Context, result *BlobResult) error
+}
+
+/*
+ * Progress of a bulk job as stored in the datastore.
+ *
+ *      Cursor          Position in the __BlobInfo__ entities
+ *      Offset          Position in the Keys of the job
+ *      Processed       Number of blobs gone through
+ *      Optimized       Number of blobs replaced with optimized ones
+ *      Failed          Number of blobs that could not be optimized
+ *      OriginalSize    Total size of the processed blobs before optimization
+ *      Size            Total size of the processed blobs after optimization
+ *      LastError       Why the latest failed blob could not be optimized
+ *      Started         When the job was started, blobs created after this are skipped
+ *      Updated         When the progress was last saved
+ *      Done            All the blobs have been gone through
+ */
+type BulkProgress struct {
+	Cursor       string `datastore:",noindex"`
+	Offset       int
+	Processed    int
+	Optimized    int
+	Failed       int
+	OriginalSize int64
+	Size         int64
+	LastError    string `datastore:",noindex"`
+	Started      time.Time
+	Updated      time.Time
+	Done         bool
+}
+
+// A blob to handle and the position right after it
+type bulkItem struct {
+	key    appengine.BlobKey
+	cursor string
+	offset int
+}
+
+/*
+ * Handles the next chunk of blobs.
+ *
+ *      - Progress is saved after each blob so a retried task carries on where the previous one stopped.
+ *      - Blobs that fail are counted and skipped, only datastore errors are returned.
+ *      - Blobs written by the job itself are skipped.
+ *      - Returns the progress so far, once Done the job does nothing.
+ */
+func (j *BulkJob) Run(c context.Context) (progress *BulkProgress, err error) {
+	progress, err = j.Progress(c)
+	if err != nil || progress.Done {
+		return
+	}
+	if progress.Started.IsZero() {
+		progress.Started = time.Now()
+	}
+	items, err := j.nextChunk(c, progress)
+	if err != nil {
+		return
+	}
+	for _, item := range items {
+		// Leave the rest for the next run
+		if err = c.Err(); err != nil {
+			return
+		}
+		j.handleKey(c, progress, item.key)
+		progress.Cursor = item.cursor
+		progress.Offset = item.offset
+		if err = j.save(c, progress); err != nil {
+			return
+		}
+	}
+	// A short chunk is the last one
+	if len(items) < j.chunkSize() {
+		progress.Done = true
+		err = j.save(c, progress)
+	}
+	return
+}
+
+/*
+ * Gets the progress of the job, zero progress if the job has not been run yet.
+ */
+func (j *BulkJob) Progress(c context.Context) (progress *BulkProgress, err error) {
+	progress = &BulkProgress{}
+	err = datastore.Get(c, j.key(c), progress)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return
+}
+
+/*
+ * Removes the progress of the job so that it starts over on the next run.
+ */
+func (j *BulkJob) Reset(c context.Context) error {
+	return datastore.Delete(c, j.key(c))
+}
+
+// Lists the next chunk of blobs from the keys or the blobstore
+func (j *BulkJob) nextChunk(c context.Context, progress *BulkProgress) (items []bulkItem, err error) {
+	chunkSize := j.chunkSize()
+	if len(j.Keys) > 0 && !j.Outdated {
+		for offset := progress.Offset; offset < len(j.Keys) && len(items) < chunkSize; offset++ {
+			items = append(items, bulkItem{
+				key:    j.Keys[offset],
+				offset: offset + 1,
+			})
+		}
+		return
+	}
+	// The blobstore keeps a __BlobInfo__ entity for each blob, named by the blob key
+	// The markers are named by the blob key as well
+	query := datastore.NewQuery("__BlobInfo__").KeysOnly()
+	if j.Outdated {
+		query = outdatedQuery(j.options().Version)
+	}
+	query = query.Limit(chunkSize)
+	if progress.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(progress.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Start(cursor)
+	}
+	iterator := query.Run(c)
+	for {
+		key, err := iterator.Next(nil)
+		if err == datastore.Done {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		cursor, err := iterator.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, bulkItem{
+			key:    appengine.BlobKey(key.StringID()),
+			cursor: cursor.String(),
+		})
+	}
+}
+
+/*
+ * Optimizes a single blob and records the outcome in the progress.
+ * The original is deleted only after OnReplace has succeeded (and unless KeepOriginal).
+ */
+func (j *BulkJob) handleKey(c context.Context, progress *BulkProgress, key appengine.BlobKey) {
+	options := j.options()
+	options.Context = c
+	blob, err := options.storage().Stat(c, key)
+	if err != nil {
+		progress.fail(err)
+		return
+	}
+	// Written by this job or uploaded while it has been running
+	if blob.CreationTime.After(progress.Started) {
+		return
+	}
+	result, _ := replaceBlob(options, blob, j.OnReplace)
+	progress.Processed++
+	progress.OriginalSize += result.OriginalSize
+	progress.Size += result.Size
+	if result.Err != nil {
+		progress.fail(result.Err)
+		return
+	}
+	if result.Blob != result.Original {
+		progress.Optimized++
+	}
+}
+
+// Copy of the options of the job, the defaults if not set
+func (j *BulkJob) options() *CompressionOptions {
+	options := defaultOptions()
+	if j.Options != nil {
+		*options = *j.Options
+	}
+	// Outdated blobs are found by their markers
+	if j.Outdated {
+		options.SkipOptimized = true
+	}
+	return options
+}
+
+// Counts a failed blob
+func (p *BulkProgress) fail(err error) {
+	p.Failed++
+	p.LastError = err.Error()
+}
+
+// Stores the progress in the datastore
+func (j *BulkJob) save(c context.Context, progress *BulkProgress) error {
+	progress.Updated = time.Now()
+	_, err := datastore.Put(c, j.key(c), progress)
+	return err
+}
+
+// Key of the progress entity
+func (j *BulkJob) key(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, BulkProgressKind, j.ID, 0, nil)
+}
+
+// Blobs handled on each run
+func (j *BulkJob) chunkSize() int {
+	if j.ChunkSize > 0 {
+		return j.ChunkSize
+	}
+	return DefaultChunkSize
+}
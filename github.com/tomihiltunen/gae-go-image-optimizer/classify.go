@@ -0,0 +1,65 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+)
+
+const (
+	classifySamples = 1 << 18 // Pixels looked at at most, on a regular grid
+	graphicColors   = 256     // Images with no more colors are graphics
+	graphicFlat     = 0.5     // Share of pixels equal to the next one above which the image is a graphic
+	photoColors     = 8192    // Images with more colors are photos however flat, e.g. products on white
+)
+
+/*
+ * Tells whether the image is a graphic (screenshot, diagram, logo) rather than a photo.
+ *
+ *      - Graphics have few colors, or large areas of exactly the same color with sharp edges.
+ *      - Photos have noise, neighbouring pixels are hardly ever exactly the same.
+ *      - Huge images are sampled on a grid, pairs of neighbours at a time.
+ */
+func isGraphic(img image.Image) bool {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return false
+	}
+	step := 1
+	for (bounds.Dx()/step)*(bounds.Dy()/step) > classifySamples {
+		step *= 2
+	}
+	colors := make(map[[4]uint32]bool)
+	flat, pairs := 0, 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x+1 < bounds.Max.X; x += step {
+			r, g, b, a := img.At(x, y).RGBA()
+			c := [4]uint32{r, g, b, a}
+			if len(colors) <= photoColors {
+				colors[c] = true
+			}
+			r, g, b, a = img.At(x+1, y).RGBA()
+			if c == [4]uint32{r, g, b, a} {
+				flat++
+			}
+			pairs++
+		}
+	}
+	if len(colors) <= graphicColors {
+		return true
+	}
+	return len(colors) <= photoColors && pairs > 0 && float64(flat)/float64(pairs) >= graphicFlat
+}
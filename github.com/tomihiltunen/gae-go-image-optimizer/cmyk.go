@@ -0,0 +1,111 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"image"
+	"math"
+)
+
+/*
+ * Tells whether the JPEG holds CMYK or YCCK (4 components), and whether it has the Adobe APP14 marker
+ * telling how the components are stored.
+ */
+func jpegCMYK(data []byte) (cmyk, adobe bool) {
+	walkJPEG(data, func(marker byte, payload []byte) bool {
+		switch {
+		case marker == 0xee && bytes.HasPrefix(payload, []byte("Adobe")):
+			adobe = true
+		// Start of frame, baseline to lossless, not DHT (0xc4), JPG (0xc8) or DAC (0xcc)
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			cmyk = len(payload) >= 6 && payload[5] == 4
+		}
+		return true
+	})
+	return
+}
+
+/*
+ * Adds an Adobe APP14 marker of plain CMYK (transform 0) after the start of image.
+ * image/jpeg refuses 4-component JPEGs without one and reads the CMYK as Adobe does, inverted.
+ */
+func withAdobeMarker(data []byte) []byte {
+	marker := []byte{
+		0xff, 0xee, 0x00, 0x0e,
+		'A', 'd', 'o', 'b', 'e',
+		0x00, 0x64, // Version
+		0x00, 0x00, 0x00, 0x00, // Flags
+		0x00, // Transform: none, CMYK
+	}
+	patched := make([]byte, 0, len(data)+len(marker))
+	patched = append(patched, data[:2]...)
+	patched = append(patched, marker...)
+	return append(patched, data[2:]...)
+}
+
+/*
+ * Converts a CMYK image to sRGB.
+ *
+ *      - The inks are mapped with a polynomial fit of US Web Coated (SWOP), the profile most CMYK photos are made for,
+ *        the same fit pdf.js uses. The plain formula of color.CMYKModel gives washed-out colors.
+ *      - inverted tells that the image was decoded from a JPEG without the Adobe marker, stored the other way around.
+ */
+func cmykToRGBA(src *image.CMYK, inverted bool) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		in := src.Pix[src.PixOffset(bounds.Min.X, y):]
+		out := dst.Pix[dst.PixOffset(bounds.Min.X, y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			c, m, yellow, k := in[x*4], in[x*4+1], in[x*4+2], in[x*4+3]
+			if inverted {
+				c, m, yellow, k = 255-c, 255-m, 255-yellow, 255-k
+			}
+			r, g, b := swopToRGB(float64(c)/255, float64(m)/255, float64(yellow)/255, float64(k)/255)
+			out[x*4] = r
+			out[x*4+1] = g
+			out[x*4+2] = b
+			out[x*4+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// sRGB of the inks (0-1) printed on US Web Coated (SWOP)
+func swopToRGB(c, m, y, k float64) (r, g, b uint8) {
+	r = clampByte(255 +
+		c*(-4.387332384609988*c+54.48615194189176*m+18.82290502165302*y+212.25662451639585*k-285.2331026137004) +
+		m*(1.7149763477362134*m-5.6096736904047315*y-17.873870861415444*k-5.497006427196366) +
+		y*(-2.5217340131683033*y-21.248923337353073*k+17.5119270841813) +
+		k*(-21.86122147463605*k-189.48180835922747))
+	g = clampByte(255 +
+		c*(8.841041422036149*c+60.118027045597366*m+6.871425592049007*y+31.159100130055922*k-79.2970844816548) +
+		m*(-15.310361306967817*m+17.575251261109482*y+131.35250912493976*k-190.9453302588951) +
+		y*(4.444339102852739*y+9.8632861493405*k-24.86741582555878) +
+		k*(-20.737325471181034*k-187.80453709719578))
+	b = clampByte(255 +
+		c*(0.8842522430003296*c+8.078677503112928*m+30.89978309703729*y-0.23883238689178934*k-14.183576799673286) +
+		m*(10.49593273432072*m+63.02378494754052*y+50.606957656360734*k-112.23884253719248) +
+		y*(0.03296041114873217*y+115.60384449646641*k-193.58209356861505) +
+		k*(-22.33816807309886*k-180.12613974708367))
+	return
+}
+
+// Rounds to a byte, clamping to 0-255
+func clampByte(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Floor(v+0.5))))
+}
@@ -0,0 +1,75 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	// 3rd-party
+	"github.com/tomihiltunen/resize"
+)
+
+// Number of colors suggested for WithColors, enough for a theme
+const DefaultExtractColors = 5
+
+// Largest dimension the image is scaled down to before picking its colors, the averages change little
+const colorsLen = 64
+
+/*
+ * Picks the main colors of the image by median cut, as "#rrggbb" with the colors of the most pixels first.
+ * Pixels mostly transparent are left out, the others are taken as opaque.
+ */
+func extractColors(img image.Image, colors int) (palette []string) {
+	bounds := img.Bounds()
+	size_x, size_y := bounds.Dx(), bounds.Dy()
+	if size_x > colorsLen || size_y > colorsLen {
+		scale := float64(colorsLen) / math.Max(float64(size_x), float64(size_y))
+		size_x = int(math.Max(1, math.Round(float64(size_x)*scale)))
+		size_y = int(math.Max(1, math.Round(float64(size_y)*scale)))
+		img = resize.Resize(img, bounds, size_x, size_y)
+		bounds = img.Bounds()
+	}
+	counts := make(map[[4]uint8]int)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 0x80 {
+				continue
+			}
+			counts[[4]uint8{c.R, c.G, c.B, 0xff}]++
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	boxes := splitBoxes(counts, colors)
+	pixels := func(box []colorCount) (n int) {
+		for _, c := range box {
+			n += c.n
+		}
+		return
+	}
+	sort.SliceStable(boxes, func(i, j int) bool { return pixels(boxes[i]) > pixels(boxes[j]) })
+	for _, box := range boxes {
+		c := averageColor(box)
+		palette = append(palette, fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B))
+	}
+	return
+}
@@ -0,0 +1,333 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	// 3rd-party
+	// YAML for the configuration files, JSON files are read as well
+	"gopkg.in/yaml.v2"
+)
+
+// Prefix of the environment variables read by LoadOptionsFromEnv
+const EnvPrefix = "OPTIMG_"
+
+/*
+ * Options read from the app configuration, the fields left unset keep their values.
+ *
+ *      preset              OPTIMG_PRESET               Preset applied first, e.g. "web-display", see LookupPreset
+ *      quality             OPTIMG_QUALITY              JPEG and WebP quality, 1-100
+ *      jpeg_quality        OPTIMG_JPEG_QUALITY         JPEG quality in place of quality, 1-100
+ *      webp_quality        OPTIMG_WEBP_QUALITY         WebP quality in place of quality, 1-100
+ *      webp_lossless       OPTIMG_WEBP_LOSSLESS        Write lossless WebPs
+ *      auto_quality        OPTIMG_AUTO_QUALITY         Lowest SSIM for picking the quality, 0 = off
+ *      max_size            OPTIMG_MAX_SIZE             Maximum width and height
+ *      max_width           OPTIMG_MAX_WIDTH            Maximum width
+ *      max_height          OPTIMG_MAX_HEIGHT           Maximum height
+ *      max_bytes           OPTIMG_MAX_BYTES            Largest upload decoded
+ *      max_pixels          OPTIMG_MAX_PIXELS           Largest image decoded
+ *      max_output_bytes    OPTIMG_MAX_OUTPUT_BYTES     Largest optimized image
+ *      min_savings_percent OPTIMG_MIN_SAVINGS_PERCENT  Least saved for the original to be replaced, 0-100
+ *      format              OPTIMG_FORMAT               Output format, "jpeg", "png", "webp", "avif" or a mime-type
+ *      fit                 OPTIMG_FIT                  How images are fitted, "inside", "crop", "smart", "stretch" or "pad"
+ *      allowed_mime_types  OPTIMG_ALLOWED_MIME_TYPES   Mime-types to optimize, comma separated in the environment
+ *      progressive         OPTIMG_PROGRESSIVE          Write progressive JPEGs
+ *      variants            OPTIMG_VARIANTS             Extra sizes by name, "thumb=200,medium=800" in the environment
+ */
+type fileConfig struct {
+	Preset           string         `yaml:"preset" json:"preset"`
+	Quality          *int           `yaml:"quality" json:"quality"`
+	JPEGQuality      *int           `yaml:"jpeg_quality" json:"jpeg_quality"`
+	WebPQuality      *int           `yaml:"webp_quality" json:"webp_quality"`
+	WebPLossless     *bool          `yaml:"webp_lossless" json:"webp_lossless"`
+	AutoQuality      *float64       `yaml:"auto_quality" json:"auto_quality"`
+	MaxSize          *int           `yaml:"max_size" json:"max_size"`
+	MaxWidth         *int           `yaml:"max_width" json:"max_width"`
+	MaxHeight        *int           `yaml:"max_height" json:"max_height"`
+	MaxBytes         *int64         `yaml:"max_bytes" json:"max_bytes"`
+	MaxPixels        *int64         `yaml:"max_pixels" json:"max_pixels"`
+	MaxOutputBytes   *int64         `yaml:"max_output_bytes" json:"max_output_bytes"`
+	MinSavings       *int           `yaml:"min_savings_percent" json:"min_savings_percent"`
+	Format           string         `yaml:"format" json:"format"`
+	Fit              string         `yaml:"fit" json:"fit"`
+	AllowedMimeTypes []string       `yaml:"allowed_mime_types" json:"allowed_mime_types"`
+	Progressive      *bool          `yaml:"progressive" json:"progressive"`
+	Variants         map[string]int `yaml:"variants" json:"variants"`
+}
+
+/*
+ * Reads the options from the environment, e.g. env_variables in app.yaml.
+ * Pass the option to New() before the ones set in code, the later ones win.
+ *
+ *      env_variables:
+ *          OPTIMG_QUALITY: "80"
+ *          OPTIMG_MAX_SIZE: "1600"
+ *          OPTIMG_VARIANTS: "thumb=200,medium=800"
+ */
+func LoadOptionsFromEnv() (Option, error) {
+	config := &fileConfig{}
+	env := &envReader{}
+	config.Preset = os.Getenv(EnvPrefix + "PRESET")
+	config.Quality = env.int("QUALITY")
+	config.JPEGQuality = env.int("JPEG_QUALITY")
+	config.WebPQuality = env.int("WEBP_QUALITY")
+	config.WebPLossless = env.bool("WEBP_LOSSLESS")
+	config.AutoQuality = env.float("AUTO_QUALITY")
+	config.MaxSize = env.int("MAX_SIZE")
+	config.MaxWidth = env.int("MAX_WIDTH")
+	config.MaxHeight = env.int("MAX_HEIGHT")
+	config.MaxBytes = env.int64("MAX_BYTES")
+	config.MaxPixels = env.int64("MAX_PIXELS")
+	config.MaxOutputBytes = env.int64("MAX_OUTPUT_BYTES")
+	config.MinSavings = env.int("MIN_SAVINGS_PERCENT")
+	config.Format = os.Getenv(EnvPrefix + "FORMAT")
+	config.Fit = os.Getenv(EnvPrefix + "FIT")
+	config.AllowedMimeTypes = env.list("ALLOWED_MIME_TYPES")
+	config.Progressive = env.bool("PROGRESSIVE")
+	config.Variants = env.variants("VARIANTS")
+	if env.err != nil {
+		return nil, env.err
+	}
+	return config.option()
+}
+
+/*
+ * Reads the options from a YAML (or JSON) file deployed with the app, with the fields listed above.
+ * Pass the option to New() before the ones set in code, the later ones win.
+ *
+ *      quality: 80
+ *      max_size: 1600
+ *      format: webp
+ *      variants:
+ *          thumb: 200
+ *          medium: 800
+ */
+func LoadOptionsFromFile(path string) (Option, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &fileConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("optimg: reading %s: %v", path, err)
+	}
+	return config.option()
+}
+
+// Checks the configuration and turns it into an option
+func (c *fileConfig) option() (Option, error) {
+	preset, ok := LookupPreset(c.Preset)
+	if c.Preset != "" && !ok {
+		return nil, fmt.Errorf("optimg: unknown preset %q", c.Preset)
+	}
+	var format Format
+	if c.Format != "" {
+		var ok bool
+		if format, ok = formatNames[strings.ToLower(c.Format)]; !ok {
+			if !strings.Contains(c.Format, "/") {
+				return nil, fmt.Errorf("optimg: unknown format %q", c.Format)
+			}
+			format = Format(strings.ToLower(c.Format))
+		}
+	}
+	fit, ok := fitNames[strings.ToLower(c.Fit)]
+	if c.Fit != "" && !ok {
+		return nil, fmt.Errorf("optimg: unknown fit %q", c.Fit)
+	}
+	for name, quality := range map[string]*int{"quality": c.Quality, "jpeg_quality": c.JPEGQuality, "webp_quality": c.WebPQuality} {
+		if quality != nil && (*quality < 1 || *quality > 100) {
+			return nil, fmt.Errorf("optimg: %s %d is not within 1-100", name, *quality)
+		}
+	}
+	if c.MinSavings != nil && (*c.MinSavings < 0 || *c.MinSavings > 100) {
+		return nil, fmt.Errorf("optimg: min_savings_percent %d is not within 0-100", *c.MinSavings)
+	}
+	for name, size := range c.Variants {
+		if name == "" || size <= 0 {
+			return nil, fmt.Errorf("optimg: variant %q of size %d, the name must be given and the size positive", name, size)
+		}
+	}
+	return func(o *CompressionOptions) {
+		if preset != nil {
+			preset(o)
+		}
+		if c.Quality != nil {
+			o.Quality = *c.Quality
+		}
+		if c.JPEGQuality != nil {
+			o.JPEGQuality = *c.JPEGQuality
+		}
+		if c.WebPQuality != nil {
+			o.WebPQuality = *c.WebPQuality
+		}
+		if c.WebPLossless != nil {
+			o.WebPLossless = *c.WebPLossless
+		}
+		if c.AutoQuality != nil {
+			o.AutoQuality = *c.AutoQuality
+		}
+		if c.MaxSize != nil {
+			o.Size = *c.MaxSize
+		}
+		if c.MaxWidth != nil {
+			o.MaxWidth = *c.MaxWidth
+		}
+		if c.MaxHeight != nil {
+			o.MaxHeight = *c.MaxHeight
+		}
+		if c.MaxBytes != nil {
+			o.MaxBytes = *c.MaxBytes
+		}
+		if c.MaxPixels != nil {
+			o.MaxPixels = *c.MaxPixels
+		}
+		if c.MaxOutputBytes != nil {
+			o.MaxOutputBytes = *c.MaxOutputBytes
+		}
+		if c.MinSavings != nil {
+			o.MinSavingsPercent = *c.MinSavings
+		}
+		if format != "" {
+			o.OutputFormat = format
+		}
+		if c.Fit != "" {
+			o.Fit = fit
+		}
+		if c.AllowedMimeTypes != nil {
+			o.AllowedMimeTypes = c.AllowedMimeTypes
+		}
+		if c.Progressive != nil {
+			o.Progressive = *c.Progressive
+		}
+		if c.Variants != nil {
+			o.Variants = c.Variants
+		}
+	}, nil
+}
+
+// Reads the environment variables, keeping the first error
+type envReader struct {
+	err error
+}
+
+// Value of the variable, ok = false if unset
+func (e *envReader) lookup(name string) (string, bool) {
+	value, ok := os.LookupEnv(EnvPrefix + name)
+	return strings.TrimSpace(value), ok && strings.TrimSpace(value) != ""
+}
+
+// Records an invalid value
+func (e *envReader) fail(name, value string) {
+	if e.err == nil {
+		e.err = fmt.Errorf("optimg: invalid %s%s %q", EnvPrefix, name, value)
+	}
+}
+
+func (e *envReader) int(name string) *int {
+	value, ok := e.lookup(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.fail(name, value)
+		return nil
+	}
+	return &n
+}
+
+func (e *envReader) int64(name string) *int64 {
+	value, ok := e.lookup(name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		e.fail(name, value)
+		return nil
+	}
+	return &n
+}
+
+func (e *envReader) float(name string) *float64 {
+	value, ok := e.lookup(name)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.fail(name, value)
+		return nil
+	}
+	return &f
+}
+
+func (e *envReader) bool(name string) *bool {
+	value, ok := e.lookup(name)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.fail(name, value)
+		return nil
+	}
+	return &b
+}
+
+// Comma separated values
+func (e *envReader) list(name string) []string {
+	value, ok := e.lookup(name)
+	if !ok {
+		return nil
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Comma separated name=size pairs
+func (e *envReader) variants(name string) map[string]int {
+	value, ok := e.lookup(name)
+	if !ok {
+		return nil
+	}
+	variants := make(map[string]int)
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			e.fail(name, value)
+			return nil
+		}
+		// Checked with the rest of the configuration
+		size, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			e.fail(name, value)
+			return nil
+		}
+		variants[strings.TrimSpace(parts[0])] = size
+	}
+	return variants
+}
@@ -0,0 +1,52 @@
+package optimg
+
+import (
+	// Go packages
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOptionsVariants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for config, valid := range map[string]bool{
+		"variants:\n  thumb: 200\n  medium: 800\n": true,
+		"variants:\n  thumb: 0\n":                  false,
+		"variants:\n  thumb: -200\n":               false,
+		"variants:\n  \"\": 200\n":                 false,
+	} {
+		path := filepath.Join(dir, "optimg.yaml")
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadOptionsFromFile(path)
+		if valid && err != nil {
+			t.Errorf("%q: %v", config, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%q: no error", config)
+		}
+	}
+	for value, valid := range map[string]bool{
+		"thumb=200,medium=800": true,
+		"thumb=0":              false,
+		"thumb=-200":           false,
+		"=200":                 false,
+		"thumb":                false,
+	} {
+		os.Setenv(EnvPrefix+"VARIANTS", value)
+		_, err := LoadOptionsFromEnv()
+		if valid && err != nil {
+			t.Errorf("%q: %v", value, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%q: no error", value)
+		}
+	}
+	os.Unsetenv(EnvPrefix + "VARIANTS")
+}
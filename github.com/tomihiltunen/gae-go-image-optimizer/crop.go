@@ -0,0 +1,100 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"errors"
+	"image"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidCrop = errors.New("optimg: invalid crop rectangle")
+
+/*
+ * Parses a crop rectangle given as "x,y,w,h", e.g. by a JS cropper widget.
+ * Fractions are rounded to whole pixels.
+ */
+func ParseCrop(value string) (image.Rectangle, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, ErrInvalidCrop
+	}
+	var values [4]int
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return image.Rectangle{}, ErrInvalidCrop
+		}
+		values[i] = int(math.Floor(f + 0.5))
+	}
+	x, y, w, h := values[0], values[1], values[2], values[3]
+	if x < 0 || y < 0 || w <= 0 || h <= 0 {
+		return image.Rectangle{}, ErrInvalidCrop
+	}
+	return image.Rect(x, y, x+w, y+h), nil
+}
+
+/*
+ * Options for the index:th blob of a form field, with the crop rectangle read from CropField.
+ *
+ *      - Each uploaded file has its own value in the field, the last one is used for the rest.
+ *      - Without a value the blob is not cropped.
+ */
+func (o *CompressionOptions) forBlob(other url.Values, index int) (*CompressionOptions, error) {
+	if o.CropField == "" {
+		return o, nil
+	}
+	values := other[o.CropField]
+	if len(values) == 0 {
+		return o, nil
+	}
+	value := values[len(values)-1]
+	if index < len(values) {
+		value = values[index]
+	}
+	if value == "" {
+		return o, nil
+	}
+	crop, err := ParseCrop(value)
+	if err != nil {
+		return nil, err
+	}
+	copied := *o
+	copied.Crop = crop
+	return &copied, nil
+}
+
+/*
+ * Crops the upright image to the crop rectangle of the options.
+ * The rectangle is clipped to the image, one entirely outside of it is an error.
+ */
+func cropToOptions(options *CompressionOptions, img image.Image) (image.Image, error) {
+	if options.Crop.Empty() {
+		return img, nil
+	}
+	bounds := img.Bounds()
+	crop := options.Crop.Add(bounds.Min).Intersect(bounds)
+	if crop.Empty() {
+		return nil, ErrInvalidCrop
+	}
+	if crop == bounds {
+		return img, nil
+	}
+	return cropImage(img, crop), nil
+}
@@ -0,0 +1,203 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+)
+
+var (
+	ErrInvalidDataURI  = errors.New("optimg: invalid data URI")
+	ErrTooManyDataURIs = errors.New("optimg: too many data URIs")
+)
+
+const maxDataURIs = 50 // Images taken of a JSON body at most, the body is limited by it and MaxBytes
+
+/*
+ * Same as ParseBlobResults for JSON/AJAX uploads, the images sent as base64 data URIs in a JSON object.
+ *
+ *      - Fields with a data URI string, or an array of them, are the images by the field name.
+ *      - The body is refused if over maxDataURIs times MaxBytes in base64, before reading it all; so are more images than that.
+ *      - Other fields end up in other like form values, strings as they are and anything else as JSON.
+ *      - The images are optimized one by one and written to new blobs, Original is nil as there was no blob before.
+ *      - Images of fields with nil options are stored as they were sent.
+ *      - Images that failed carry the reason in Err, Blob is nil as nothing was stored.
+ *      - In strict mode a *BlobError is returned if any of the images failed.
+ */
+func ParseDataURIs(options *CompressionOptions) (results map[string][]*BlobResult, other url.Values, err error) {
+	// Options may have been put together by hand
+	if options.Context == nil {
+		options.Context = appengine.NewContext(options.Request)
+	}
+	body := options.Request.Body
+	if options.MaxBytes > 0 {
+		body = http.MaxBytesReader(nil, body, dataURIBodyLimit(options.MaxBytes))
+	}
+	var fields map[string]json.RawMessage
+	if err = json.NewDecoder(body).Decode(&fields); err != nil {
+		return
+	}
+	other = url.Values{}
+	images := make(map[string][]string)
+	count := 0
+	for name, raw := range fields {
+		var value interface{}
+		if err = json.Unmarshal(raw, &value); err != nil {
+			return
+		}
+		var uris []string
+		switch v := value.(type) {
+		case string:
+			if !isDataURI(v) {
+				other.Add(name, v)
+				continue
+			}
+			uris = append(uris, v)
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok && isDataURI(s) {
+					uris = append(uris, s)
+				} else if ok {
+					other.Add(name, s)
+				} else {
+					other.Add(name, fmt.Sprint(item))
+				}
+			}
+		default:
+			other.Add(name, string(raw))
+		}
+		images[name] = append(images[name], uris...)
+		count += len(uris)
+	}
+	// Refused before storing any
+	if count > maxDataURIs {
+		return nil, nil, ErrTooManyDataURIs
+	}
+	results = make(map[string][]*BlobResult)
+	for name, uris := range images {
+		fieldOptions := options.forField(name)
+		for _, uri := range uris {
+			results[name] = append(results[name], handleDataURI(options, fieldOptions, uri))
+		}
+	}
+	// Strict mode fails the whole request if any of the images failed
+	if options.Strict {
+		err = firstBlobError(results)
+	}
+	return
+}
+
+/*
+ * Decodes the base64 data URI, optimizes the image and writes it to the storage.
+ *
+ *      - The media type of the URI is not trusted, the format is told by the content.
+ *      - Anything but the images of AllowedMimeTypes is refused with ErrNotImage.
+ *      - Images over MaxBytes are refused before decoding them.
+ *      - The new BlobInfo is in result.Blob, Original is nil as there was no blob before.
+ *      - Nil options use the defaults.
+ */
+func OptimizeDataURI(ctx context.Context, uri string, options *CompressionOptions) (result *BlobResult, err error) {
+	if options == nil {
+		options = defaultOptions()
+	}
+	// Work on a copy as the context is for this image only
+	uriOptions := *options
+	uriOptions.Context = ctx
+	data, err := decodeDataURI(uri, uriOptions.MaxBytes)
+	if err != nil {
+		return
+	}
+	return storeImage(&uriOptions, data)
+}
+
+// Optimizes the image of a field, stored as it is (SVGs sanitized) if the field has nil options
+func handleDataURI(options, fieldOptions *CompressionOptions, uri string) (result *BlobResult) {
+	if fieldOptions != nil {
+		result, err := OptimizeDataURI(options.Context, uri, fieldOptions)
+		if result == nil {
+			result = &BlobResult{Err: err}
+		}
+		return result
+	}
+	data, err := decodeDataURI(uri, options.MaxBytes)
+	if err != nil {
+		return &BlobResult{Err: err}
+	}
+	format := Format(detectContentType(data))
+	// Nothing but images is stored, and no scripts in SVGs either
+	if !validateMimeType(options, string(format), "") {
+		return &BlobResult{Err: ErrNotImage}
+	}
+	if format == FormatSVG {
+		if data, err = sanitizeSVG(data); err != nil {
+			return &BlobResult{Err: err}
+		}
+	}
+	result = &BlobResult{
+		Report: Report{
+			OriginalSize:   int64(len(data)),
+			Size:           int64(len(data)),
+			OriginalFormat: format,
+			Format:         format,
+		},
+	}
+	result.Blob, _, _, result.Err = createBlob(options, format, writeData(data))
+	return
+}
+
+// Largest JSON body taken, room for maxDataURIs images of maxBytes in base64 and the other fields
+func dataURIBodyLimit(maxBytes int64) int64 {
+	return maxDataURIs*(maxBytes+2)/3*4 + 1<<20
+}
+
+// Tells whether the string is a data URI
+func isDataURI(s string) bool {
+	return strings.HasPrefix(s, "data:")
+}
+
+/*
+ * Decodes the data of a base64 data URI, e.g. "data:image/png;base64,iVBORw0KGgo...".
+ * Data over maxBytes is refused before decoding it, 0 = unlimited.
+ */
+func decodeDataURI(uri string, maxBytes int64) ([]byte, error) {
+	comma := strings.IndexByte(uri, ',')
+	if !isDataURI(uri) || comma < 0 || !strings.HasSuffix(uri[:comma], ";base64") {
+		return nil, ErrInvalidDataURI
+	}
+	payload := uri[comma+1:]
+	// Padding may take up to two bytes of the estimate
+	if maxBytes > 0 && int64(base64.StdEncoding.DecodedLen(len(payload))) > maxBytes+2 {
+		return nil, ErrTooManyBytes
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidDataURI
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return nil, ErrTooManyBytes
+	}
+	return data, nil
+}
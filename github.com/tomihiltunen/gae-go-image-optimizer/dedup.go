@@ -0,0 +1,172 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	BlobHashKind = "OptimgBlobHash" // Datastore kind of the content hashes, named by the SHA-256
+	BlobRefsKind = "OptimgBlobRefs" // Datastore kind of the reference counts of deduplicated blobs, named by the blob key
+)
+
+/*
+ * Optimized blob by the SHA-256 of its content.
+ */
+type blobHash struct {
+	BlobKey appengine.BlobKey `datastore:",noindex"`
+	Created time.Time         `datastore:",noindex"`
+}
+
+/*
+ * Number of uploads using a deduplicated blob, it is deleted when the last one lets go of it.
+ *
+ *      Hash    SHA-256 of the content, the name of its blobHash
+ *      Refs    Number of uploads using the blob
+ */
+type blobRefs struct {
+	Hash string `datastore:",noindex"`
+	Refs int    `datastore:",noindex"`
+}
+
+/*
+ * Writes the encoded image to a new blob unless there is one of the same content already.
+ *
+ *      - The blobs are looked up by the SHA-256 of the content.
+ *      - Each upload using a blob counts as a reference to it, see releaseBlob.
+ *      - A blob gone missing, or one being deleted, is replaced by the new one.
+ */
+func createUniqueBlob(options *CompressionOptions, format Format, encodeFn func(io.Writer) error) (newBlobInfo *blobstore.BlobInfo, size int64, reused bool, err error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err = encodeFn(buf); err != nil {
+		return
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	key := hashKey(options.Context, hex.EncodeToString(sum[:]))
+	// Already there?
+	var hash blobHash
+	if err = datastore.Get(options.Context, key, &hash); err == nil {
+		if newBlobInfo, err = options.storage().Stat(options.Context, hash.BlobKey); err == nil && addRef(options, hash.BlobKey) {
+			return newBlobInfo, newBlobInfo.Size, true, nil
+		}
+	}
+	newBlobInfo, err = writeNewBlob(options, format, writeData(buf.Bytes()))
+	if err != nil {
+		return
+	}
+	size = newBlobInfo.Size
+	// The blob is fine without, it just is not found the next time
+	hash = blobHash{
+		BlobKey: newBlobInfo.BlobKey,
+		Created: time.Now(),
+	}
+	refs := &blobRefs{
+		Hash: hex.EncodeToString(sum[:]),
+		Refs: 1,
+	}
+	// Without the count the blob is not shared, the hash would let others use it
+	if _, refsErr := datastore.Put(options.Context, refsKey(options.Context, newBlobInfo.BlobKey), refs); refsErr != nil {
+		options.logger().Errorf(options.Context, "optimg: references of blob %s: %v", newBlobInfo.BlobKey, refsErr)
+		return
+	}
+	if _, err := datastore.Put(options.Context, key, &hash); err != nil {
+		options.logger().Errorf(options.Context, "optimg: hash of blob %s: %v", newBlobInfo.BlobKey, err)
+	}
+	return
+}
+
+// Counts another upload using the blob, false if it is not counted (being deleted or written before counting)
+func addRef(options *CompressionOptions, key appengine.BlobKey) bool {
+	err := datastore.RunInTransaction(options.Context, func(tc context.Context) error {
+		var refs blobRefs
+		if err := datastore.Get(tc, refsKey(tc, key), &refs); err != nil {
+			return err
+		}
+		refs.Refs++
+		_, err := datastore.Put(tc, refsKey(tc, key), &refs)
+		return err
+	}, nil)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		options.logger().Errorf(options.Context, "optimg: references of blob %s: %v", key, err)
+	}
+	return err == nil
+}
+
+/*
+ * Lets go of a deduplicated blob about to be deleted, telling whether other uploads still use it.
+ * The last one to let go removes its hash so that no one picks it up anymore, and the blob can be deleted.
+ * Blobs that were not deduplicated are not shared.
+ */
+func releaseBlob(options *CompressionOptions, key appengine.BlobKey) (shared bool, err error) {
+	var refs blobRefs
+	err = datastore.RunInTransaction(options.Context, func(tc context.Context) error {
+		if err := datastore.Get(tc, refsKey(tc, key), &refs); err != nil {
+			return err
+		}
+		if refs.Refs--; refs.Refs > 0 {
+			_, err := datastore.Put(tc, refsKey(tc, key), &refs)
+			return err
+		}
+		return datastore.Delete(tc, refsKey(tc, key))
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil || refs.Refs > 0 {
+		return err == nil, err
+	}
+	// A hash left behind points to a deleted blob, which gets replaced then
+	if err := datastore.Delete(options.Context, hashKey(options.Context, refs.Hash)); err != nil && err != datastore.ErrNoSuchEntity {
+		options.logger().Errorf(options.Context, "optimg: hash of blob %s: %v", key, err)
+	}
+	return false, nil
+}
+
+// Deletes the count of the uploads using the blob and its hash, e.g. for a blob none of them uses
+func forgetBlob(options *CompressionOptions, key appengine.BlobKey) error {
+	var refs blobRefs
+	if err := datastore.Get(options.Context, refsKey(options.Context, key), &refs); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	if err := datastore.Delete(options.Context, hashKey(options.Context, refs.Hash)); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return datastore.Delete(options.Context, refsKey(options.Context, key))
+}
+
+// Key of the content hash entity
+func hashKey(c context.Context, sum string) *datastore.Key {
+	return datastore.NewKey(c, BlobHashKind, sum, 0, nil)
+}
+
+// Key of the reference count of a blob
+func refsKey(c context.Context, key appengine.BlobKey) *datastore.Key {
+	return datastore.NewKey(c, BlobRefsKind, string(key), 0, nil)
+}
@@ -0,0 +1,205 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"encoding/gob"
+	"image/color"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// The colors of the options travel to the task as interfaces
+func init() {
+	gob.Register(color.RGBA{})
+	gob.Register(color.RGBA64{})
+	gob.Register(color.NRGBA{})
+	gob.Register(color.NRGBA64{})
+	gob.Register(color.Alpha{})
+	gob.Register(color.Alpha16{})
+	gob.Register(color.Gray{})
+	gob.Register(color.Gray16{})
+}
+
+/*
+ * Optimizes the uploads in a task queue task instead of the upload request.
+ * Create with NewDeferred() at init time and hand to the options with WithDeferred().
+ * The options are passed to the task but for functions (e.g. Transform), Storage, FaceDetector, Moderator, HEICDecoder, SVGRasterizer, PDFRenderer, Logger and Metrics.
+ *
+ *      Queue           Name of the task queue, the default queue if empty
+ *      Storage         Where the images are read from and written to in the task, blobstore if nil
+ *      FaceDetector    Face detector used in the task, none if nil
+ *      Moderator       Moderator used in the task, none if nil
+ *      HEICDecoder     Decoder of HEICs in the task, they are left as they are if nil
+ *      SVGRasterizer   Rasterizer of SVGs in the task with RasterizeSVG
+ *      PDFRenderer     Renderer of the PDF previews in the task, PDFs are left as they are if nil
+ *      Logger          Logger of the task, App Engine logging if nil
+ *      Metrics         Metrics of the task, none if nil
+ *      OnReplace       Called with each optimized blob before the original is deleted, e.g. to update the references
+ */
+type Deferred struct {
+	Queue         string
+	Storage       Storage
+	FaceDetector  FaceDetector
+	Moderator     Moderator
+	HEICDecoder   HEICDecoder
+	SVGRasterizer SVGRasterizer
+	PDFRenderer   PDFRenderer
+	Logger        Logger
+	Metrics       Metrics
+	OnReplace     func(c context.Context, result *BlobResult) error
+
+	fn *delay.Function
+}
+
+/*
+ * Creates a new deferred optimization.
+ * Must be called at init time (e.g. in a package variable) with a name unique to the app.
+ */
+func NewDeferred(name string, onReplace func(c context.Context, result *BlobResult) error) *Deferred {
+	d := &Deferred{
+		OnReplace: onReplace,
+	}
+	d.fn = delay.Func("optimg-"+name, d.optimize)
+	return d
+}
+
+/*
+ * Queues the blob for optimization and returns it untouched.
+ * Blobs that are not images, or skipped by BeforeOptimize, are not queued.
+ */
+func (d *Deferred) enqueue(options *CompressionOptions, blob *blobstore.BlobInfo) (result *BlobResult) {
+	result = newBlobResult(blob)
+	if options.BeforeOptimize != nil && !options.BeforeOptimize(blob) {
+		return
+	}
+	ok, err := sniffBlob(options, blob)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	if !ok {
+		return
+	}
+	// The request, context and storage do not make it to the task, nor do functions like Transform
+	taskOptions := *options
+	taskOptions.Request = nil
+	taskOptions.Context = nil
+	taskOptions.Storage = nil
+	taskOptions.FaceDetector = nil
+	taskOptions.Moderator = nil
+	taskOptions.HEICDecoder = nil
+	taskOptions.SVGRasterizer = nil
+	taskOptions.PDFRenderer = nil
+	taskOptions.Logger = nil
+	taskOptions.Metrics = nil
+	taskOptions.Deferred = nil
+	taskOptions.Overflow = nil
+	taskOptions.TimeBudget = 0
+	var settings bytes.Buffer
+	if err := gob.NewEncoder(&settings).Encode(&taskOptions); err != nil {
+		result.Err = err
+		return
+	}
+	task, err := d.fn.Task(string(blob.BlobKey), settings.Bytes())
+	if err != nil {
+		result.Err = err
+		return
+	}
+	if _, err = taskqueue.Add(options.Context, task, d.Queue); err != nil {
+		result.Err = err
+		return
+	}
+	result.Deferred = true
+	return
+}
+
+/*
+ * The task optimizing a single blob.
+ *
+ *      - Blobs that cannot be optimized are logged and left as they are.
+ *      - A failing OnReplace is returned so that the task is retried.
+ */
+func (d *Deferred) optimize(c context.Context, key string, settings []byte) error {
+	options := &CompressionOptions{}
+	if err := gob.NewDecoder(bytes.NewReader(settings)).Decode(options); err != nil {
+		log.Errorf(c, "optimg: blob %s: %v", key, err)
+		return nil
+	}
+	options.Context = c
+	options.Storage = d.Storage
+	options.FaceDetector = d.FaceDetector
+	options.Moderator = d.Moderator
+	options.HEICDecoder = d.HEICDecoder
+	options.SVGRasterizer = d.SVGRasterizer
+	options.PDFRenderer = d.PDFRenderer
+	options.Logger = d.Logger
+	options.Metrics = d.Metrics
+	blob, err := options.storage().Stat(c, appengine.BlobKey(key))
+	if err != nil {
+		options.logger().Errorf(c, "optimg: blob %s: %v", key, err)
+		return nil
+	}
+	result, err := replaceBlob(options, blob, d.OnReplace)
+	if isRejected(result.Err) {
+		options.logger().Warningf(c, "optimg: blob %s: %v", key, result.Err)
+		return nil
+	}
+	if result.Err != nil {
+		options.logger().Errorf(c, "optimg: blob %s: %v", key, result.Err)
+	}
+	return err
+}
+
+/*
+ * Optimizes a blob and hands the result to onReplace before deleting the original.
+ *
+ *      - The original is deleted only after onReplace has succeeded (and unless KeepOriginal).
+ *      - If onReplace fails the optimized blob is deleted, the original kept and the error
+ *        returned as well as put in the result.
+ */
+func replaceBlob(options *CompressionOptions, blob *blobstore.BlobInfo, onReplace func(c context.Context, result *BlobResult) error) (result *BlobResult, err error) {
+	// The original is deleted here once the new blob is in use
+	blobOptions := *options
+	blobOptions.KeepOriginal = true
+	result = handleBlob(&blobOptions, blob)
+	if result.Err != nil || result.Blob == result.Original {
+		return
+	}
+	if onReplace != nil {
+		if err = onReplace(options.Context, result); err != nil {
+			// A deduplicated blob is in use elsewhere
+			if !result.Deduplicated {
+				_ = deleteBlob(options, result.Blob.BlobKey)
+			}
+			result.Blob = result.Original
+			result.Size = result.OriginalSize
+			result.Err = err
+			return
+		}
+	}
+	if !options.KeepOriginal {
+		result.DeleteErr = deleteBlob(options, result.Original.BlobKey)
+	}
+	return
+}
@@ -0,0 +1,199 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Paletted images using at most this many colors are kept as paletted PNG by default
+const DefaultPaletteColors = 64
+
+// How far (0-255) the channels of a pixel may differ for it to be gray, JPEG leaves some color noise in
+const grayTolerance = 4
+
+// 4x4 Bayer matrix for ordered dithering, deterministic and free of the worms of error diffusion
+var bayer4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+/*
+ * Picks the format for the processed image and gets its pixels ready for it.
+ *
+ *      - 16-bit images are reduced to 8 bits, with ordered dithering if Dither is set.
+ *        image/png would write them in 16 bits, twice the size.
+ *      - Paletted sources (PNG, single frame GIF) using at most PaletteColors colors are kept as paletted PNG
+ *        instead of JPEG, e.g. logos and diagrams. More colors are taken for a photo and go the JPEG way.
+ *      - Opaque images with no color are encoded in one channel if DetectGrayscale is set,
+ *        e.g. scanned documents and black and white photos.
+ *      - Other PNG output is mapped onto a palette of QuantizeColors colors if set, e.g. screenshots.
+ */
+func prepareOutput(src, img image.Image, options *CompressionOptions) (image.Image, Format) {
+	img = reduceDepth(img, options.Dither)
+	format := chooseFormat(img, options)
+	if format != FormatJPEG && format != FormatPNG {
+		return img, format
+	}
+	palette := imagePalette(src)
+	if palette == nil || options.PaletteColors <= 0 || usedColors(src.(*image.Paletted)) > options.PaletteColors {
+		if options.DetectGrayscale && isGrayscale(img) {
+			img = toGray(img)
+		} else if format == FormatPNG && options.QuantizeColors > 0 {
+			img = quantize(img, options.QuantizeColors, options.Dither)
+		}
+		return img, format
+	}
+	if format == FormatJPEG {
+		options.logger().Debugf(options.Context, "optimg: paletted image kept as PNG")
+	}
+	if img != src {
+		img = toPalette(img, palette, options.Dither)
+	}
+	return img, FormatPNG
+}
+
+// Palette of the image, nil if it is not paletted
+func imagePalette(img image.Image) color.Palette {
+	if paletted, ok := img.(*image.Paletted); ok {
+		return paletted.Palette
+	}
+	return nil
+}
+
+// Number of the colors of the palette used in the image
+func usedColors(img *image.Paletted) int {
+	var used [256]bool
+	count := 0
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(img.Rect.Min.X, y):][:img.Rect.Dx()]
+		for _, index := range row {
+			if !used[index] {
+				used[index] = true
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Maps the image onto the palette, e.g. after resizing a paletted image
+func toPalette(img image.Image, palette color.Palette, dither bool) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette)
+	var drawer draw.Drawer = draw.Src
+	if dither {
+		drawer = draw.FloydSteinberg
+	}
+	drawer.Draw(dst, dst.Rect, img, bounds.Min)
+	return dst
+}
+
+/*
+ * Reduces 16-bit images to 8 bits per channel, others are returned as they are.
+ * With dither the rounding follows an ordered pattern, keeping smooth gradients from banding.
+ */
+func reduceDepth(img image.Image, dither bool) image.Image {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		bounds := img.Bounds()
+		dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+				i := dst.PixOffset(x, y)
+				dst.Pix[i] = to8(c.R, x, y, dither)
+				dst.Pix[i+1] = to8(c.G, x, y, dither)
+				dst.Pix[i+2] = to8(c.B, x, y, dither)
+				dst.Pix[i+3] = to8(c.A, x, y, false)
+			}
+		}
+		return dst
+	case *image.Gray16:
+		gray := img.(*image.Gray16)
+		bounds := gray.Bounds()
+		dst := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				dst.Pix[dst.PixOffset(x, y)] = to8(gray.Gray16At(bounds.Min.X+x, bounds.Min.Y+y).Y, x, y, dither)
+			}
+		}
+		return dst
+	}
+	return img
+}
+
+// 16-bit value to 8 bits, the threshold by the position in the Bayer matrix if dithered
+func to8(v uint16, x, y int, dither bool) uint8 {
+	scaled := float64(v) / 0x101
+	if !dither {
+		return uint8(scaled + 0.5)
+	}
+	return clampByte(scaled + (bayer4[y%4][x%4]+0.5)/16 - 0.5)
+}
+
+/*
+ * Tells whether the image is opaque and has no color.
+ * YCbCr images (JPEGs) are told by their chroma alone.
+ */
+func isGrayscale(img image.Image) bool {
+	switch img := img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	case *image.YCbCr:
+		for _, planes := range [][]uint8{img.Cb, img.Cr} {
+			for _, v := range planes {
+				if v < 128-grayTolerance || v > 128+grayTolerance {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a != 0xffff || diff(r, g) > grayTolerance*0x101 || diff(g, b) > grayTolerance*0x101 || diff(r, b) > grayTolerance*0x101 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Absolute difference of two color values
+func diff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Converts the image to 8-bit gray
+func toGray(img image.Image) image.Image {
+	if _, ok := img.(*image.Gray); ok {
+		return img
+	}
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Rect, img, bounds.Min, draw.Src)
+	return gray
+}
@@ -0,0 +1,140 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"strings"
+
+	// 3rd-party
+	"golang.org/x/image/tiff"
+)
+
+// Documents are kept as they are, with a preview of their first page
+const FormatPDF Format = "application/pdf"
+
+var ErrNoPDFRenderer = errors.New("optimg: no PDFRenderer plugged in")
+
+/*
+ * Renderer for the first page of PDFs, used for their previews. Go has none of its own.
+ * Plug in one with WithPDFRenderer, e.g. wrapping pdfium or running a converter. It gets the box to fit the page in,
+ * keeping the aspect ratio; 0 for either side leaves that side to the size of the page.
+ * Without a renderer PDFs are left as they are.
+ */
+type PDFRenderer func(r io.Reader, width, height int) (image.Image, error)
+
+// Tells whether the PDF gets a preview, with a renderer plugged in and not left out by AllowedMimeTypes or SkipMimeTypes
+func validatePDF(options *CompressionOptions, declared string) bool {
+	return options.PDFRenderer != nil && listedMimeType(options, string(FormatPDF), strings.ToLower(declared), true)
+}
+
+// Tells whether the TIFF has more than one page, by the link to the next directory (IFD) after the first
+func isMultiPageTIFF(data []byte) bool {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return false
+	}
+	ifd := int64(order.Uint32(data[4:8]))
+	if ifd+2 > int64(len(data)) {
+		return false
+	}
+	next := ifd + 2 + 12*int64(order.Uint16(data[ifd:]))
+	if next+4 > int64(len(data)) {
+		return false
+	}
+	return order.Uint32(data[next:]) != 0
+}
+
+// Tells whether the data is a PDF
+func isPDF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("%PDF-"))
+}
+
+// Decodes the first page of the document, PDFs are rendered to fit in the maximum size
+func decodeFirstPage(data []byte, options *CompressionOptions) (image.Image, error) {
+	if !isPDF(data) {
+		// The decoder reads the first directory only
+		return tiff.Decode(bytes.NewReader(data))
+	}
+	if options.PDFRenderer == nil {
+		return nil, ErrNoPDFRenderer
+	}
+	return options.PDFRenderer(bytes.NewReader(data), options.maxWidth(), options.maxHeight())
+}
+
+/*
+ * Writes a preview of the first page of the document, a multi-page TIFF or a PDF.
+ *
+ *      - The document is kept as it is, flattening it to an image would lose the rest of the pages.
+ *      - The preview is written as a new blob next to it, optimized as any image with the options.
+ *      - Nothing is written unless DocumentPreviews is set.
+ */
+func handleDocument(options *CompressionOptions, result *BlobResult, data []byte) {
+	blob := result.Original
+	format := Format(detectContentType(data))
+	result.OriginalFormat, result.Format = format, format
+	if !options.DocumentPreviews {
+		options.logger().Debugf(options.Context, "optimg: blob %s: %s document left as it is", blob.BlobKey, format)
+		return
+	}
+	img, err := decodeFirstPage(data, options)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	preview := &BlobResult{
+		Report: Report{
+			OriginalSize:   result.OriginalSize,
+			OriginalFormat: format,
+			OriginalWidth:  img.Bounds().Dx(),
+			OriginalHeight: img.Bounds().Dy(),
+		},
+		Original: blob,
+	}
+	result.Preview = preview
+	// Written even if larger than the document
+	out, err := processImage(&decodedImage{img: img, changed: true}, options)
+	if err != nil {
+		preview.Err = err
+		return
+	}
+	if err := checkDeadline(options); err != nil {
+		preview.Err = err
+		return
+	}
+	encodeFn, _, err := out.encoder(options, result.OriginalSize)
+	if err != nil {
+		preview.Err = err
+		return
+	}
+	preview.Blob, preview.Size, preview.Deduplicated, preview.Err = createBlob(options, out.format, encodeFn)
+	preview.encoded(out)
+	if preview.Err == nil && preview.Blob != nil {
+		options.logger().Infof(options.Context, "optimg: blob %s: preview of the %s document, %s %dx%d", blob.BlobKey, format, preview.Format, preview.Width, preview.Height)
+		markOptimized(options, blob.BlobKey)
+		markOptimized(options, preview.Blob.BlobKey)
+		setServingURL(options, preview)
+	}
+}
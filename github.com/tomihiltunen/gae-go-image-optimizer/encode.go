@@ -0,0 +1,155 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"errors"
+	"image"
+	"io"
+)
+
+/*
+ * Output formats, named by their mime-type.
+ * AVIF needs an encoder to be registered for it, see RegisterEncoder().
+ */
+type Format string
+
+const (
+	FormatJPEG Format = "image/jpeg"
+	FormatPNG  Format = "image/png"
+	FormatGIF  Format = "image/gif"
+	FormatWebP Format = "image/webp"
+	FormatAVIF Format = "image/avif"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("optimg: unsupported output format")
+)
+
+/*
+ * Chroma subsampling of JPEGs.
+ *
+ *      Subsampling420  Half the color resolution both ways, best compression for photos (default)
+ *      Subsampling422  Half the color resolution horizontally
+ *      Subsampling444  Full color resolution, for screenshots and red text
+ */
+type Subsampling int
+
+const (
+	Subsampling420 Subsampling = iota
+	Subsampling422
+	Subsampling444
+)
+
+/*
+ * Encoder for the JPEGs needing more than image/jpeg offers,
+ * which writes baseline 4:2:0 JPEGs only.
+ * Plug in one e.g. wrapping a libjpeg binding, it gets the options for the quality and the rest.
+ * Used for progressive JPEGs and other subsamplings, the rest are written without it.
+ */
+var JPEGEncoder func(w io.Writer, img image.Image, options *CompressionOptions) error
+
+// Output format of the options, JPEG unless told otherwise
+func (o *CompressionOptions) outputFormat() Format {
+	if o.OutputFormat == "" {
+		return FormatJPEG
+	}
+	return o.OutputFormat
+}
+
+// The options with the quality of the format, if set, in place of Quality
+func (o *CompressionOptions) forFormat(format Format) *CompressionOptions {
+	quality := 0
+	switch format {
+	case FormatJPEG:
+		quality = o.JPEGQuality
+	case FormatWebP:
+		quality = o.WebPQuality
+	}
+	if quality <= 0 {
+		return o
+	}
+	copied := *o
+	copied.Quality = quality
+	return &copied
+}
+
+/*
+ * Picks the format for the image.
+ *
+ *      - Uses the output format of the options.
+ *      - Transparent images are kept as PNG if the output format has no alpha channel
+ *        and PreserveTransparency is set.
+ *      - Graphics (screenshots, diagrams) are kept as PNG instead of JPEG with AutoFormat.
+ */
+func chooseFormat(img image.Image, options *CompressionOptions) Format {
+	format := options.outputFormat()
+	if format == FormatJPEG && options.PreserveTransparency && hasTransparency(img) {
+		options.logger().Debugf(options.Context, "optimg: transparent image kept as PNG")
+		return FormatPNG
+	}
+	if format == FormatJPEG && options.AutoFormat && isGraphic(img) {
+		options.logger().Debugf(options.Context, "optimg: graphic kept as PNG")
+		return FormatPNG
+	}
+	if format == FormatJPEG && (options.Progressive || options.Subsampling != Subsampling420) && JPEGEncoder == nil {
+		options.logger().Debugf(options.Context, "optimg: no JPEGEncoder plugged in, writing baseline 4:2:0 JPEG")
+	}
+	return format
+}
+
+/*
+ * Returns a function encoding the image in the given format.
+ * The metadata segment is placed in JPEGs.
+ */
+func imageEncoder(options *CompressionOptions, img image.Image, format Format, metadata []byte) func(io.Writer) error {
+	return func(w io.Writer) error {
+		if format == FormatJPEG && metadata != nil {
+			w = &segmentWriter{w: w, segment: metadata}
+		}
+		return encode(w, img, format, options)
+	}
+}
+
+/*
+ * Encodes the image in the given format with the encoder registered for it.
+ */
+func encode(w io.Writer, img image.Image, format Format, options *CompressionOptions) error {
+	encoder := lookupEncoder(format)
+	if encoder == nil {
+		return ErrUnsupportedFormat
+	}
+	return encoder.Encode(w, img, options)
+}
+
+// Tells whether any of the pixels of the image is not fully opaque
+func hasTransparency(img image.Image) bool {
+	// Most of the image types know this already
+	if o, ok := img.(interface {
+		Opaque() bool
+	}); ok {
+		return !o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
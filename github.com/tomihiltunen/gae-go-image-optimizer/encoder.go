@@ -0,0 +1,125 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sync"
+
+	// 3rd-party
+	// WebP encoder, libwebp compiled to WASM so no cgo is needed
+	"github.com/gen2brain/webp"
+)
+
+/*
+ * Encoder for an output format.
+ * Register with RegisterEncoder() to make the format available as OutputFormat.
+ *
+ *      Encode          Encodes the image, the options tell the quality and the rest
+ *      ContentType     Mime-type of the format, e.g. "image/avif"
+ */
+type Encoder interface {
+	Encode(w io.Writer, img image.Image, options *CompressionOptions) error
+	ContentType() string
+}
+
+// The encoders by their formats
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[Format]Encoder{
+		FormatJPEG: jpegEncoder{},
+		FormatPNG:  pngEncoder{},
+		FormatGIF:  gifEncoder{},
+		FormatWebP: webpEncoder{},
+	}
+)
+
+/*
+ * Registers the encoder for its content type, replacing the one there was.
+ * Usually called from init().
+ */
+func RegisterEncoder(encoder Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[Format(encoder.ContentType())] = encoder
+}
+
+// The encoder of the format, nil if none
+func lookupEncoder(format Format) Encoder {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	return encoders[format]
+}
+
+// JPEG by image/jpeg, or JPEGEncoder for what image/jpeg cannot do
+type jpegEncoder struct{}
+
+func (jpegEncoder) Encode(w io.Writer, img image.Image, options *CompressionOptions) error {
+	if (options.Progressive || options.Subsampling != Subsampling420) && JPEGEncoder != nil {
+		return JPEGEncoder(w, img, options)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{
+		Quality: options.Quality,
+	})
+}
+
+func (jpegEncoder) ContentType() string {
+	return string(FormatJPEG)
+}
+
+// PNG by image/png
+type pngEncoder struct{}
+
+func (pngEncoder) Encode(w io.Writer, img image.Image, options *CompressionOptions) error {
+	encoder := png.Encoder{CompressionLevel: options.PNGCompression}
+	return encoder.Encode(w, img)
+}
+
+func (pngEncoder) ContentType() string {
+	return string(FormatPNG)
+}
+
+// Single frame GIF by image/gif, animations are encoded as they are
+type gifEncoder struct{}
+
+func (gifEncoder) Encode(w io.Writer, img image.Image, options *CompressionOptions) error {
+	if options.GIFColors > 0 {
+		return gif.Encode(w, img, &gif.Options{NumColors: options.GIFColors})
+	}
+	return gif.Encode(w, img, nil)
+}
+
+func (gifEncoder) ContentType() string {
+	return string(FormatGIF)
+}
+
+// WebP by gen2brain/webp
+type webpEncoder struct{}
+
+func (webpEncoder) Encode(w io.Writer, img image.Image, options *CompressionOptions) error {
+	return webp.Encode(w, img, webp.Options{
+		Quality:  options.Quality,
+		Lossless: options.WebPLossless,
+	})
+}
+
+func (webpEncoder) ContentType() string {
+	return string(FormatWebP)
+}
@@ -0,0 +1,212 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+/*
+ * EXIF tags in use.
+ */
+const (
+	exifTagOrientation = 0x0112
+)
+
+var (
+	errExifInvalid = errors.New("optimg: invalid EXIF data")
+)
+
+/*
+ * EXIF data of a JPEG.
+ *
+ *      order   Byte order of the TIFF structure
+ *      tiff    The TIFF structure following the "Exif\0\0" header
+ */
+type exifData struct {
+	order binary.ByteOrder
+	tiff  []byte
+}
+
+/*
+ * A single entry of an IFD.
+ *
+ *      tag     EXIF tag
+ *      typ     Type of the value (BYTE, ASCII, SHORT, ...)
+ *      count   Number of values
+ *      value   The raw value bytes
+ */
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// Sizes of the EXIF value types in bytes
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+/*
+ * Reads the EXIF data out of a JPEG stream.
+ * Returns nil if the JPEG has no EXIF data.
+ */
+func readExif(r io.Reader) (*exifData, error) {
+	br := bufio.NewReader(r)
+	// Start of image
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, errExifInvalid
+	}
+	for {
+		// Find the next marker, skipping any fill bytes
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xff {
+			return nil, errExifInvalid
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xff {
+			marker, err = br.ReadByte()
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Markers without a segment
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			continue
+		}
+		// Image data starts, no EXIF in this one
+		if marker == 0xda || marker == 0xd9 {
+			return nil, nil
+		}
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, errExifInvalid
+		}
+		// Skip everything else but APP1
+		if marker != 0xe1 {
+			if _, err := io.CopyN(ioutil.Discard, br, int64(length-2)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, err
+		}
+		// APP1 is used by XMP too
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseExif(segment[6:])
+		}
+	}
+}
+
+/*
+ * Parses the TIFF header of the EXIF data.
+ */
+func parseExif(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, errExifInvalid
+	}
+	e := &exifData{tiff: tiff}
+	switch string(tiff[:2]) {
+	case "II":
+		e.order = binary.LittleEndian
+	case "MM":
+		e.order = binary.BigEndian
+	default:
+		return nil, errExifInvalid
+	}
+	if e.order.Uint16(tiff[2:]) != 42 {
+		return nil, errExifInvalid
+	}
+	return e, nil
+}
+
+// Entries of the first IFD
+func (e *exifData) ifd0() []exifEntry {
+	return e.entries(e.order.Uint32(e.tiff[4:]))
+}
+
+/*
+ * Reads the entries of the IFD at the given offset.
+ * Broken entries are left out.
+ */
+func (e *exifData) entries(offset uint32) (entries []exifEntry) {
+	if uint64(offset)+2 > uint64(len(e.tiff)) {
+		return
+	}
+	count := int(e.order.Uint16(e.tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(e.tiff)) {
+			return
+		}
+		raw := e.tiff[start : start+12]
+		entry := exifEntry{
+			tag:   e.order.Uint16(raw[0:]),
+			typ:   e.order.Uint16(raw[2:]),
+			count: e.order.Uint32(raw[4:]),
+		}
+		typeSize, ok := exifTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		size := uint64(typeSize) * uint64(entry.count)
+		// Small values are stored in place of the offset
+		if size <= 4 {
+			entry.value = raw[8 : 8+size]
+		} else {
+			valueOffset := uint64(e.order.Uint32(raw[8:]))
+			if valueOffset+size > uint64(len(e.tiff)) {
+				continue
+			}
+			entry.value = e.tiff[valueOffset : valueOffset+size]
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+/*
+ * Tells the orientation of the image (1-8).
+ * Defaults to 1 which is the normal orientation.
+ */
+func (e *exifData) orientation() int {
+	for _, entry := range e.ifd0() {
+		if entry.tag == exifTagOrientation && entry.typ == 3 && len(entry.value) >= 2 {
+			if o := int(e.order.Uint16(entry.value)); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
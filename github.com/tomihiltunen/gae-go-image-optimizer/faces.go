@@ -0,0 +1,149 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+
+	// Google Cloud packages
+	vision "cloud.google.com/go/vision/v2/apiv1"
+	"cloud.google.com/go/vision/v2/apiv1/visionpb"
+)
+
+const visionImageSize = 1024 // Larger dimension of the image sent to Cloud Vision
+
+/*
+ * Finds the faces in an image, used by CropSmart to keep them in frame.
+ * Returns the areas of the faces in the coordinates of the image.
+ */
+type FaceDetector interface {
+	DetectFaces(c context.Context, img image.Image) ([]image.Rectangle, error)
+}
+
+/*
+ * Face detector backed by Google Cloud Vision.
+ *
+ *      Client      Cloud Vision client, created for each image if left nil
+ *      MaxFaces    Most faces looked for, 0 = 10
+ */
+type VisionFaceDetector struct {
+	Client   *vision.ImageAnnotatorClient
+	MaxFaces int
+}
+
+func (d *VisionFaceDetector) DetectFaces(c context.Context, img image.Image) (faces []image.Rectangle, err error) {
+	client := d.Client
+	if client == nil {
+		if client, err = vision.NewImageAnnotatorClient(c); err != nil {
+			return
+		}
+		defer client.Close()
+	}
+	// A smaller copy is enough to find the faces
+	visionImage, scale, err := newVisionImage(img)
+	if err != nil {
+		return
+	}
+	bounds := img.Bounds()
+	maxFaces := d.MaxFaces
+	if maxFaces <= 0 {
+		maxFaces = 10
+	}
+	response, err := annotateImage(c, client, visionImage, &visionpb.Feature{
+		Type:       visionpb.Feature_FACE_DETECTION,
+		MaxResults: int32(maxFaces),
+	})
+	if err != nil {
+		return
+	}
+	// Back to the coordinates of the image
+	for _, annotation := range response.GetFaceAnnotations() {
+		var face image.Rectangle
+		for i, vertex := range annotation.GetBoundingPoly().GetVertices() {
+			point := image.Pt(bounds.Min.X+int(float64(vertex.GetX())/scale), bounds.Min.Y+int(float64(vertex.GetY())/scale))
+			if i == 0 {
+				face = image.Rectangle{Min: point, Max: point}
+			}
+			face = face.Union(image.Rectangle{Min: point, Max: point.Add(image.Pt(1, 1))})
+		}
+		if !face.Empty() {
+			faces = append(faces, face.Intersect(bounds))
+		}
+	}
+	return
+}
+
+/*
+ * Smaller copy of the image to send to Cloud Vision.
+ * Returns the image and the scale it was shrunk by.
+ */
+func newVisionImage(img image.Image) (*visionpb.Image, float64, error) {
+	bounds := img.Bounds()
+	scale := math.Min(1, float64(visionImageSize)/math.Max(float64(bounds.Dx()), float64(bounds.Dy())))
+	small := img
+	if scale < 1 {
+		small = scaleImage(&CompressionOptions{Filter: FilterBilinear}, img, bounds, int(float64(bounds.Dx())*scale), int(float64(bounds.Dy())*scale))
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := jpeg.Encode(buf, small, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, 0, err
+	}
+	// The buffer goes back to the pool
+	return &visionpb.Image{Content: append([]byte(nil), buf.Bytes()...)}, scale, nil
+}
+
+// Annotates the image with the feature, the error of the image included
+func annotateImage(c context.Context, client *vision.ImageAnnotatorClient, visionImage *visionpb.Image, feature *visionpb.Feature) (response *visionpb.AnnotateImageResponse, err error) {
+	batch, err := client.BatchAnnotateImages(c, &visionpb.BatchAnnotateImagesRequest{
+		Requests: []*visionpb.AnnotateImageRequest{{Image: visionImage, Features: []*visionpb.Feature{feature}}},
+	})
+	if err != nil {
+		return
+	}
+	if len(batch.GetResponses()) == 0 {
+		return nil, errors.New("optimg: no response from Cloud Vision")
+	}
+	response = batch.GetResponses()[0]
+	if status := response.GetError(); status != nil {
+		return nil, fmt.Errorf("optimg: Cloud Vision: %s", status.GetMessage())
+	}
+	return
+}
+
+/*
+ * Copy of the options with the faces of the image, when CropSmart needs them.
+ * Detection is done once per image, the variants use the same faces.
+ * A failing detector is logged and the image cropped by its detail only.
+ */
+func (o *CompressionOptions) detectFaces(c context.Context, img image.Image) *CompressionOptions {
+	if o.FaceDetector == nil || o.Fit != CropSmart {
+		return o
+	}
+	faces, err := o.FaceDetector.DetectFaces(c, img)
+	if err != nil {
+		o.logger().Warningf(c, "optimg: detecting faces: %v", err)
+		return o
+	}
+	copied := *o
+	copied.faces = faces
+	return &copied
+}
@@ -0,0 +1,102 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	// App Engine packages
+	"google.golang.org/appengine/urlfetch"
+)
+
+var ErrNotImage = errors.New("optimg: not an image of an allowed type")
+
+/*
+ * Fetches the image at the URL, optimizes it and writes it to the storage, e.g. for images pasted by URL.
+ *
+ *      - The image is fetched with urlfetch within FetchTimeout, images over MaxBytes are refused.
+ *      - Anything but the images of AllowedMimeTypes is refused with ErrNotImage, e.g. HTML served from the app's origin.
+ *      - Images the pipeline leaves as it is are stored as they were fetched.
+ *      - The new BlobInfo is in result.Blob, Original is nil as there was no blob before.
+ *      - Images rejected by the Moderator are not stored, the error is a *RejectedError.
+ *      - Nil options use the defaults.
+ */
+func OptimizeURL(ctx context.Context, url string, options *CompressionOptions) (result *BlobResult, err error) {
+	if options == nil {
+		options = defaultOptions()
+	}
+	// Work on a copy as the context is for this image only
+	urlOptions := *options
+	urlOptions.Context = ctx
+	fetchCtx, cancel := context.WithTimeout(ctx, urlOptions.fetchTimeout())
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := urlfetch.Client(fetchCtx).Do(req.WithContext(fetchCtx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("optimg: fetching %s: %s", url, resp.Status)
+	}
+	// No need to read what is refused anyway
+	if urlOptions.MaxBytes > 0 && resp.ContentLength > urlOptions.MaxBytes {
+		return nil, ErrTooManyBytes
+	}
+	data, err := readImage(resp.Body, &urlOptions)
+	if err != nil {
+		return
+	}
+	// The timeout is for fetching only
+	return storeImage(&urlOptions, data)
+}
+
+/*
+ * Optimizes an image not in the storage yet and writes it to a new blob.
+ * Images the pipeline leaves as it is are stored as they are, anything else is refused with ErrNotImage.
+ */
+func storeImage(options *CompressionOptions, data []byte) (result *BlobResult, err error) {
+	if !validateMimeType(options, detectContentType(data), "") {
+		return nil, ErrNotImage
+	}
+	var buf bytes.Buffer
+	report, err := Optimize(options.Context, bytes.NewReader(data), &buf, options)
+	if err != nil {
+		return
+	}
+	result = &BlobResult{Report: report}
+	blob, size, reused, err := createBlob(options, report.Format, writeData(buf.Bytes()))
+	if err != nil {
+		result.Err = err
+		return result, err
+	}
+	result.Size = size
+	result.Blob = blob
+	result.Deduplicated = reused
+	if blob != nil {
+		markOptimized(options, blob.BlobKey)
+		indexSimilar(options, result)
+		setServingURL(options, result)
+	}
+	return
+}
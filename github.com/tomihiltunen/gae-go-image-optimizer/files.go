@@ -0,0 +1,161 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+)
+
+/*
+ * Storage keeping the blobs as files in a directory, e.g. for testing or running outside App Engine.
+ * Each blob is a file named by its key, with the BlobInfo next to it in <key>.json.
+ * Missing blobs give datastore.ErrNoSuchEntity like blobstore does.
+ *
+ *      Dir     The directory, it must exist
+ */
+type FileStorage struct {
+	Dir string
+}
+
+/*
+ * Stores the data as a blob, e.g. an upload to be optimized.
+ */
+func (s *FileStorage) Put(contentType, filename string, data []byte) (*blobstore.BlobInfo, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	info := &blobstore.BlobInfo{
+		BlobKey:      appengine.BlobKey(hex.EncodeToString(random)),
+		ContentType:  contentType,
+		CreationTime: time.Now(),
+		Filename:     filename,
+		Size:         int64(len(data)),
+		MD5:          hex.EncodeToString(sum[:]),
+	}
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(s.path(info.BlobKey), data, 0644); err != nil {
+		return nil, err
+	}
+	// Written last, the blob does not exist without it
+	if err := ioutil.WriteFile(s.path(info.BlobKey)+".json", meta, 0644); err != nil {
+		_ = os.Remove(s.path(info.BlobKey))
+		return nil, err
+	}
+	return info, nil
+}
+
+func (s *FileStorage) Open(c context.Context, key appengine.BlobKey) (BlobReader, error) {
+	if _, err := s.Stat(c, key); err != nil {
+		return nil, err
+	}
+	// Read at once, BlobReader has no Close for a file
+	data, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (s *FileStorage) Create(c context.Context, contentType string) (BlobWriter, error) {
+	return &fileWriter{
+		storage:     s,
+		contentType: contentType,
+	}, nil
+}
+
+func (s *FileStorage) Delete(c context.Context, key appengine.BlobKey) error {
+	err := os.Remove(s.path(key) + ".json")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStorage) Stat(c context.Context, key appengine.BlobKey) (*blobstore.BlobInfo, error) {
+	meta, err := ioutil.ReadFile(s.path(key) + ".json")
+	if os.IsNotExist(err) {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := &blobstore.BlobInfo{}
+	if err := json.Unmarshal(meta, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Path of the file of the blob, only the last element of the key is used so it stays in the directory
+func (s *FileStorage) path(key appengine.BlobKey) string {
+	return filepath.Join(s.Dir, filepath.Base(string(key)))
+}
+
+/*
+ * Writer for a new blob in a file, stored once closed.
+ */
+type fileWriter struct {
+	storage     *FileStorage
+	contentType string
+	buf         bytes.Buffer
+	key         appengine.BlobKey
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	if w.key != "" {
+		return nil
+	}
+	info, err := w.storage.Put(w.contentType, "", w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	w.key = info.BlobKey
+	return nil
+}
+
+func (w *fileWriter) Key() (appengine.BlobKey, error) {
+	if w.key == "" {
+		return "", ErrNotClosed
+	}
+	return w.key, nil
+}
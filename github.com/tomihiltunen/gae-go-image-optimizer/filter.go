@@ -0,0 +1,89 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"math"
+
+	// 3rd-party
+	// By "Go Authors"
+	"github.com/tomihiltunen/resize"
+	xdraw "golang.org/x/image/draw"
+)
+
+/*
+ * The interpolation used for resizing.
+ *
+ *      FilterLanczos3  Sharpest, slowest (default)
+ *      FilterBicubic   Catmull-Rom, nearly as sharp
+ *      FilterBilinear  Fast, a bit soft
+ *      FilterNearest   Fastest, blocky; for pixel art
+ *      FilterBox       The averaging of the resize package used before, soft and aliased
+ */
+type Filter int
+
+const (
+	FilterLanczos3 Filter = iota
+	FilterBicubic
+	FilterBilinear
+	FilterNearest
+	FilterBox
+)
+
+// Lanczos kernel with 3 lobes
+var lanczos3 = &xdraw.Kernel{
+	Support: 3,
+	At: func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		t *= math.Pi
+		return 3 * math.Sin(t) * math.Sin(t/3) / (t * t)
+	},
+}
+
+// The scaler of x/image/draw for the filter
+func (f Filter) scaler() xdraw.Scaler {
+	switch f {
+	case FilterBicubic:
+		return xdraw.CatmullRom
+	case FilterBilinear:
+		return xdraw.BiLinear
+	case FilterNearest:
+		return xdraw.NearestNeighbor
+	}
+	return lanczos3
+}
+
+/*
+ * Resizes the part r of the image to size_x x size_y with the filter of the options.
+ * With LinearLight the pixels are blended in linear light instead of sRGB, not with FilterBox.
+ */
+func scaleImage(options *CompressionOptions, img image.Image, r image.Rectangle, size_x, size_y int) image.Image {
+	if options.Filter == FilterBox {
+		return resize.Resize(img, r, size_x, size_y)
+	}
+	if options.LinearLight {
+		linear := toLinear(img, r)
+		scaled := image.NewRGBA64(image.Rect(0, 0, size_x, size_y))
+		options.Filter.scaler().Scale(scaled, scaled.Bounds(), linear, linear.Bounds(), xdraw.Src, nil)
+		return fromLinear(scaled)
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, size_x, size_y))
+	options.Filter.scaler().Scale(scaled, scaled.Bounds(), img, r, xdraw.Src, nil)
+	return scaled
+}
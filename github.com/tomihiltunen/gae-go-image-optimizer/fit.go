@@ -0,0 +1,120 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+/*
+ * How the images are fitted in MaxWidth x MaxHeight (or Size x Size).
+ *
+ *      FitInside   Shrink to fit inside, keeping aspect ratio (default)
+ *      CropCenter  Fill the exact dimensions and crop the overflow evenly from both sides
+ *      Stretch     Scale to the exact dimensions ignoring aspect ratio
+ *      Pad         Fit inside and pad to the exact dimensions with the Background color
+ *      CropSmart   Fill the exact dimensions and crop the overflow keeping the part with the most detail
+ */
+type FitMode int
+
+const (
+	FitInside FitMode = iota
+	CropCenter
+	Stretch
+	Pad
+	CropSmart
+)
+
+/*
+ * Produces an image of exactly the given dimensions with the fit mode of the options.
+ */
+func fitExact(options *CompressionOptions, img image.Image, size_x, size_y int) image.Image {
+	bounds := img.Bounds()
+	switch options.Fit {
+	case CropCenter, CropSmart:
+		// Largest area of the target aspect ratio in the middle of the image
+		scale := math.Max(float64(size_x)/float64(bounds.Dx()), float64(size_y)/float64(bounds.Dy()))
+		crop_x := int(math.Min(float64(bounds.Dx()), math.Floor(float64(size_x)/scale+0.5)))
+		crop_y := int(math.Min(float64(bounds.Dy()), math.Floor(float64(size_y)/scale+0.5)))
+		corner := image.Pt(bounds.Min.X+(bounds.Dx()-crop_x)/2, bounds.Min.Y+(bounds.Dy()-crop_y)/2)
+		// Or wherever the detail is
+		if options.Fit == CropSmart {
+			corner = smartCorner(img, crop_x, crop_y, options.faces)
+		}
+		cropped := cropImage(img, image.Rect(corner.X, corner.Y, corner.X+crop_x, corner.Y+crop_y))
+		return scaleImage(options, cropped, cropped.Bounds(), size_x, size_y)
+	case Stretch:
+		return scaleImage(options, img, bounds, size_x, size_y)
+	case Pad:
+		fitted := img
+		if fit_x, fit_y, ok := fitSize(options, bounds.Dx(), bounds.Dy()); ok {
+			fitted = scaleImage(options, img, bounds, fit_x, fit_y)
+		}
+		canvas := image.NewRGBA(image.Rect(0, 0, size_x, size_y))
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(options.background()), image.Point{}, draw.Src)
+		offset := image.Pt((size_x-fitted.Bounds().Dx())/2, (size_y-fitted.Bounds().Dy())/2)
+		draw.Draw(canvas, fitted.Bounds().Sub(fitted.Bounds().Min).Add(offset), fitted, fitted.Bounds().Min, draw.Over)
+		return canvas
+	}
+	return img
+}
+
+/*
+ * Color of the padding.
+ *
+ *      - Transparent for PNG and WebP output, white for others, unless set in the options.
+ *      - A transparent color is replaced with white if the output has no alpha channel to keep it in.
+ */
+func (o *CompressionOptions) background() color.Color {
+	format := o.outputFormat()
+	alpha := format == FormatPNG || format == FormatWebP
+	if o.Background == nil {
+		if alpha {
+			return color.Transparent
+		}
+		return color.White
+	}
+	if _, _, _, a := o.Background.RGBA(); a != 0xffff && !alpha && !o.PreserveTransparency {
+		return color.White
+	}
+	return o.Background
+}
+
+/*
+ * Tells whether an image of the given dimensions gets scaled up by the options.
+ */
+func upscaled(options *CompressionOptions, size_x, size_y int) bool {
+	if options.Fit == CropCenter || options.Fit == CropSmart || options.Fit == Stretch {
+		if max_x, max_y := options.maxWidth(), options.maxHeight(); max_x > 0 && max_y > 0 {
+			return max_x > size_x || max_y > size_y
+		}
+	}
+	fit_x, fit_y, ok := fitSize(options, size_x, size_y)
+	return ok && (fit_x > size_x || fit_y > size_y)
+}
+
+/*
+ * Copies the given area of the image to a new image starting from 0, 0.
+ */
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	r = r.Intersect(img.Bounds())
+	cropped := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, r.Min, draw.Src)
+	return cropped
+}
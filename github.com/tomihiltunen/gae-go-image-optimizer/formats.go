@@ -0,0 +1,48 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"net/http"
+
+	// 3rd-party
+	// Decoders for the input formats the standard library lacks
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
+
+/*
+ * Sniffs the mime-type of the content, like http.DetectContentType.
+ * Knows TIFF, HEIC and SVG too, which http.DetectContentType does not tell.
+ */
+func detectContentType(data []byte) string {
+	if heif := heifContentType(data); heif != "" {
+		return heif
+	}
+	if isSVG(data) {
+		return string(FormatSVG)
+	}
+	if bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")) {
+		return "image/tiff"
+	}
+	return http.DetectContentType(data)
+}
+
+// Tells whether the WebP is animated, by the animation flag of its extended header (VP8X)
+func isAnimatedWebP(data []byte) bool {
+	return len(data) > 20 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:16]) == "WEBPVP8X" && data[20]&0x02 != 0
+}
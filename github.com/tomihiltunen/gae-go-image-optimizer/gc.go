@@ -0,0 +1,222 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"net/http"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const DefaultGCAge = 24 * time.Hour // Blobs younger than this are left for the requests still handling them
+
+/*
+ * Removes the blobs left behind by failed requests, e.g. from a cron job.
+ *
+ *      - Only the blobs in the ledger are looked at, the ones the optimizer wrote; Ledger must be set in the options.
+ *      - Those Referenced tells are not in use are deleted, pending or not. A blob in use stays pending if writing its ledger entry failed.
+ *      - The blobs are deleted as the optimizer deletes them, along with their ledger entries, markers,
+ *        deduplication hashes and similarity index entries. A deduplicated blob other uploads share is kept.
+ *      - Every other blob in the blobstore is left alone unless AllBlobs is set.
+ *      - Nothing is removed without Referenced.
+ *      - Returns when the context is done, the next run carries on with what is left.
+ *
+ *      MinAge      Blobs younger than this are left alone, defaults to DefaultGCAge
+ *      Referenced  Tells whether the app uses a blob, nil = nothing is removed
+ *      Storage     Where the optimized blobs are, blobstore if nil
+ *      AllBlobs    Checks every blob in the blobstore too, removing abandoned uploads; any blob Referenced misses is lost
+ *      DryRun      Only counts the blobs that would be removed
+ */
+type GarbageCollector struct {
+	MinAge     time.Duration
+	Referenced func(c context.Context, key appengine.BlobKey) (bool, error)
+	Storage    Storage
+	AllBlobs   bool
+	DryRun     bool
+}
+
+/*
+ * Outcome of a garbage collection run.
+ *
+ *      Checked     Number of blobs looked at
+ *      Deleted     Number of blobs removed (or to be removed in dry-run)
+ *      Size        Total size of the removed blobs in bytes
+ */
+type GCStats struct {
+	Checked int
+	Deleted int
+	Size    int64
+}
+
+/*
+ * Runs the garbage collection.
+ */
+func (g *GarbageCollector) Run(c context.Context) (stats GCStats, err error) {
+	// Only the app knows which blobs are in use
+	if g.Referenced == nil {
+		return
+	}
+	cutoff := time.Now().Add(-g.minAge())
+	if err = g.collectLedger(c, cutoff, &stats); err != nil || !g.AllBlobs {
+		return
+	}
+	err = g.collectUnreferenced(c, cutoff, &stats)
+	return
+}
+
+/*
+ * Runs the garbage collection for a cron job request.
+ */
+func (g *GarbageCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	stats, err := g.Run(c)
+	if err != nil && err != c.Err() {
+		log.Errorf(c, "optimg: garbage collection: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof(c, "optimg: garbage collection checked %d blobs, removed %d (%d bytes)", stats.Checked, stats.Deleted, stats.Size)
+}
+
+// Removes the optimized blobs not in use, never put in use or no longer
+func (g *GarbageCollector) collectLedger(c context.Context, cutoff time.Time, stats *GCStats) error {
+	// Filtered by the time here, no composite index needed
+	iterator := datastore.NewQuery(LedgerKind).Run(c)
+	for {
+		if err := c.Err(); err != nil {
+			return err
+		}
+		var entry LedgerEntry
+		key, err := iterator.Next(&entry)
+		if err == datastore.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Created.After(cutoff) {
+			continue
+		}
+		stats.Checked++
+		// The request may have got as far as putting it in use
+		used, err := g.Referenced(c, entry.NewKey)
+		if err != nil {
+			return err
+		}
+		if used {
+			if entry.Pending && !g.DryRun {
+				entry.Pending = false
+				if _, err := datastore.Put(c, key, &entry); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := g.remove(c, entry.NewKey, stats); err != nil {
+			return err
+		}
+	}
+}
+
+// Removes the blobs the app does not use
+func (g *GarbageCollector) collectUnreferenced(c context.Context, cutoff time.Time, stats *GCStats) error {
+	// The blobstore keeps a __BlobInfo__ entity for each blob, named by the blob key
+	iterator := datastore.NewQuery("__BlobInfo__").Filter("creation <", cutoff).KeysOnly().Run(c)
+	for {
+		if err := c.Err(); err != nil {
+			return err
+		}
+		key, err := iterator.Next(nil)
+		if err == datastore.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stats.Checked++
+		blobKey := appengine.BlobKey(key.StringID())
+		used, err := g.Referenced(c, blobKey)
+		if err != nil {
+			return err
+		}
+		if !used {
+			if err := g.remove(c, blobKey, stats); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/*
+ * Deletes a blob the way deleteBlob does and counts it, with its ledger entry.
+ * The deduplication entities go whatever the count of the uploads, none of them uses the blob.
+ * The entities of a blob already gone are deleted, the blob is not counted.
+ */
+func (g *GarbageCollector) remove(c context.Context, key appengine.BlobKey, stats *GCStats) error {
+	blob, statErr := g.storage().Stat(c, key)
+	if !g.DryRun {
+		options := g.options(c)
+		if err := forgetBlob(options, key); err != nil {
+			return err
+		}
+		if statErr != nil {
+			unmarkOptimized(options, key)
+			unindexSimilar(options, key)
+		} else if err := deleteBlob(options, key); err != nil {
+			return err
+		}
+		if err := datastore.Delete(c, ledgerKey(c, key)); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	if statErr != nil {
+		return nil
+	}
+	stats.Deleted++
+	stats.Size += blob.Size
+	return nil
+}
+
+// Options cleaning up after every feature that may have left entities of a blob
+func (g *GarbageCollector) options(c context.Context) *CompressionOptions {
+	options := defaultOptions()
+	options.Context = c
+	options.Storage = g.Storage
+	options.SkipOptimized = true
+	options.PerceptualHash = true
+	return options
+}
+
+// Age of the blobs to collect, DefaultGCAge unless set
+func (g *GarbageCollector) minAge() time.Duration {
+	if g.MinAge <= 0 {
+		return DefaultGCAge
+	}
+	return g.MinAge
+}
+
+// Storage of the optimized blobs, blobstore unless set
+func (g *GarbageCollector) storage() Storage {
+	if g.Storage == nil {
+		return Blobstore
+	}
+	return g.Storage
+}
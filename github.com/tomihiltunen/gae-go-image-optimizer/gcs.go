@@ -0,0 +1,266 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	// Google Cloud packages
+	"cloud.google.com/go/storage"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/file"
+)
+
+const GCSObjectKind = "OptimgGCSObject" // Datastore kind of the objects written, named by their blob keys
+
+/*
+ * Storage writing the optimized images to a Google Cloud Storage bucket.
+ * The uploads are still read from (and deleted from) blobstore.
+ * Use a new one for each request, it remembers the objects it has written.
+ * The objects are also recorded in the datastore, blobstore cannot Stat them, so any request finds them.
+ *
+ *      Bucket          Name of the bucket, the app's default bucket if empty
+ *      ObjectName      Names the new objects by their content type, random names by default
+ *      PredefinedACL   ACL of the new objects, e.g. "publicRead"
+ *      CacheControl    Cache-Control header of the new objects
+ *      Client          Cloud Storage client, created for each request if left nil
+ */
+type GCSStorage struct {
+	Bucket        string
+	ObjectName    func(contentType string) string
+	PredefinedACL string
+	CacheControl  string
+	Client        *storage.Client
+
+	mu      sync.Mutex
+	objects map[appengine.BlobKey]*storage.ObjectAttrs
+}
+
+func (s *GCSStorage) Open(c context.Context, key appengine.BlobKey) (BlobReader, error) {
+	return blobstore.NewReader(c, key), nil
+}
+
+func (s *GCSStorage) Create(c context.Context, contentType string) (BlobWriter, error) {
+	bucket := s.Bucket
+	if bucket == "" {
+		var err error
+		if bucket, err = file.DefaultBucketName(c); err != nil {
+			return nil, err
+		}
+	}
+	client, err := s.client(c)
+	if err != nil {
+		return nil, err
+	}
+	name := s.objectName(contentType)
+	writer := client.Bucket(bucket).Object(name).NewWriter(c)
+	writer.ContentType = contentType
+	writer.CacheControl = s.CacheControl
+	writer.PredefinedACL = s.PredefinedACL
+	return &gcsWriter{
+		storage: s,
+		c:       c,
+		writer:  writer,
+		client:  client,
+		name:    name,
+	}, nil
+}
+
+func (s *GCSStorage) Delete(c context.Context, key appengine.BlobKey) error {
+	attrs, err := s.lookup(c, key)
+	if err != nil {
+		return err
+	}
+	if attrs == nil {
+		return blobstore.Delete(c, key)
+	}
+	client, err := s.client(c)
+	if err != nil {
+		return err
+	}
+	if s.Client == nil {
+		defer client.Close()
+	}
+	if err := client.Bucket(attrs.Bucket).Object(attrs.Name).Delete(c); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.mu.Unlock()
+	return datastore.Delete(c, gcsObjectKey(c, key))
+}
+
+func (s *GCSStorage) Stat(c context.Context, key appengine.BlobKey) (*blobstore.BlobInfo, error) {
+	attrs, err := s.lookup(c, key)
+	if err != nil {
+		return nil, err
+	}
+	if attrs == nil {
+		return blobstore.Stat(c, key)
+	}
+	return &blobstore.BlobInfo{
+		BlobKey:      key,
+		ContentType:  attrs.ContentType,
+		CreationTime: attrs.Created,
+		Filename:     attrs.Name,
+		Size:         attrs.Size,
+		MD5:          hex.EncodeToString(attrs.MD5),
+		ObjectName:   gcsFilename(attrs.Bucket, attrs.Name),
+	}, nil
+}
+
+// Client given in the options or a new one
+func (s *GCSStorage) client(c context.Context) (*storage.Client, error) {
+	if s.Client != nil {
+		return s.Client, nil
+	}
+	return storage.NewClient(c)
+}
+
+// Name for a new object
+func (s *GCSStorage) objectName(contentType string) string {
+	if s.ObjectName != nil {
+		return s.ObjectName(contentType)
+	}
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	return hex.EncodeToString(random) + "." + strings.TrimPrefix(contentType, "image/")
+}
+
+// Attributes of an object written by this or an earlier storage, nil for other blobs
+func (s *GCSStorage) lookup(c context.Context, key appengine.BlobKey) (*storage.ObjectAttrs, error) {
+	s.mu.Lock()
+	attrs := s.objects[key]
+	s.mu.Unlock()
+	if attrs != nil {
+		return attrs, nil
+	}
+	var object gcsObject
+	err := datastore.Get(c, gcsObjectKey(c, key), &object)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &storage.ObjectAttrs{
+		Bucket:      object.Bucket,
+		Name:        object.Name,
+		ContentType: object.ContentType,
+		Size:        object.Size,
+		MD5:         object.MD5,
+		Created:     object.Created,
+	}, nil
+}
+
+// Remembers the object for Stat and Delete
+func (s *GCSStorage) remember(key appengine.BlobKey, attrs *storage.ObjectAttrs) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects == nil {
+		s.objects = make(map[appengine.BlobKey]*storage.ObjectAttrs)
+	}
+	s.objects[key] = attrs
+}
+
+/*
+ * Writer for a new object.
+ * The object gets a blob key once it is closed, so it can be served through blobstore.
+ */
+type gcsWriter struct {
+	storage *GCSStorage
+	c       context.Context
+	writer  *storage.Writer
+	client  *storage.Client
+	name    string
+	key     appengine.BlobKey
+	err     error
+}
+
+func (w *gcsWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+func (w *gcsWriter) Close() error {
+	// Client made for this object only
+	if w.storage.Client == nil {
+		defer w.client.Close()
+	}
+	if err := w.writer.Close(); err != nil {
+		w.err = err
+		return err
+	}
+	attrs := w.writer.Attrs()
+	w.key, w.err = blobstore.BlobKeyForFile(w.c, gcsFilename(attrs.Bucket, attrs.Name))
+	if w.err != nil {
+		return w.err
+	}
+	// An object no request can Stat is of no use
+	object := &gcsObject{
+		Bucket:      attrs.Bucket,
+		Name:        attrs.Name,
+		ContentType: attrs.ContentType,
+		Size:        attrs.Size,
+		MD5:         attrs.MD5,
+		Created:     attrs.Created,
+	}
+	if _, w.err = datastore.Put(w.c, gcsObjectKey(w.c, w.key), object); w.err != nil {
+		_ = w.client.Bucket(attrs.Bucket).Object(attrs.Name).Delete(w.c)
+		w.key = ""
+		return w.err
+	}
+	w.storage.remember(w.key, attrs)
+	return nil
+}
+
+func (w *gcsWriter) Key() (appengine.BlobKey, error) {
+	if w.key == "" && w.err == nil {
+		return "", fmt.Errorf("optimg: object %q is not closed", w.name)
+	}
+	return w.key, w.err
+}
+
+/*
+ * Object written through GCSStorage, named by its blob key.
+ */
+type gcsObject struct {
+	Bucket      string    `datastore:",noindex"`
+	Name        string    `datastore:",noindex"`
+	ContentType string    `datastore:",noindex"`
+	Size        int64     `datastore:",noindex"`
+	MD5         []byte    `datastore:",noindex"`
+	Created     time.Time `datastore:",noindex"`
+}
+
+// Key of the record of an object
+func gcsObjectKey(c context.Context, key appengine.BlobKey) *datastore.Key {
+	return datastore.NewKey(c, GCSObjectKind, string(key), 0, nil)
+}
+
+// Blobstore filename of an object
+func gcsFilename(bucket, name string) string {
+	return "/gs/" + bucket + "/" + name
+}
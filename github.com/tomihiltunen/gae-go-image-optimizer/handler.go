@@ -0,0 +1,76 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"net/http"
+	"net/url"
+
+	// App Engine packages
+	"google.golang.org/appengine/blobstore"
+)
+
+/*
+ * The optimized uploads of a request, stashed in its context by Handler.
+ *
+ *      Blobs       The blobs to use by form field, as returned by ParseBlobs
+ *      Results     The results of the blobs by form field, as returned by ParseBlobResults
+ *      Other       The other form values, the request body has been read already
+ *      Err         Why the upload could not be parsed, or the first failed blob in strict mode
+ */
+type Uploads struct {
+	Blobs   map[string][]*blobstore.BlobInfo
+	Results map[string][]*BlobResult
+	Other   url.Values
+	Err     error
+}
+
+type uploadsKey struct{}
+
+/*
+ * Wraps a blobstore upload callback handler.
+ *
+ *      - Optimizes the uploads with the options, built for each request.
+ *      - Stashes them in the request context for next, see UploadsFrom().
+ *      - Failures are passed on in Uploads.Err, next decides what to answer.
+ */
+func Handler(next http.Handler, opts ...Option) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		options := New(r, opts...)
+		uploads := &Uploads{}
+		uploads.Results, uploads.Other, uploads.Err = ParseBlobResults(options)
+		uploads.Blobs = blobsOf(uploads.Results)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uploadsKey{}, uploads)))
+	})
+}
+
+/*
+ * Same as Handler for routers taking middleware, e.g. router.Use(optimg.Middleware()) with Gorilla mux.
+ */
+func Middleware(opts ...Option) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return Handler(next, opts...)
+	}
+}
+
+/*
+ * Gets the uploads stashed by Handler, nil if the request did not go through it.
+ */
+func UploadsFrom(r *http.Request) *Uploads {
+	uploads, _ := r.Context().Value(uploadsKey{}).(*Uploads)
+	return uploads
+}
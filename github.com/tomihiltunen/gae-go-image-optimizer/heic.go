@@ -0,0 +1,95 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os/exec"
+)
+
+var ErrNoHEICDecoder = errors.New("optimg: no HEICDecoder plugged in")
+
+/*
+ * Decoder for HEIC and HEIF, which iPhones upload by default and Go has no decoder for.
+ * Plug in one with WithHEICDecoder, e.g. wrapping a libheif binding, or CommandDecoder() running a converter.
+ * The image is expected upright, as libheif gives it. Without a decoder HEICs are left as they are.
+ */
+type HEICDecoder func(r io.Reader) (image.Image, error)
+
+// The major brands of HEIF files by their mime-types, AVIF is HEIF too but not these
+var heifBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic-sequence",
+	"hevx": "image/heic-sequence",
+	"hevm": "image/heic-sequence",
+	"hevs": "image/heic-sequence",
+	"mif1": "image/heif",
+	"msf1": "image/heif-sequence",
+}
+
+// Mime-type of the HEIC or HEIF by the major brand of its ftyp box, "" for other data
+func heifContentType(data []byte) string {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return ""
+	}
+	return heifBrands[string(data[8:12])]
+}
+
+// Tells whether the mime-type is of HEIC or HEIF
+func isHEIFType(mimeType string) bool {
+	for _, heif := range heifBrands {
+		if mimeType == heif {
+			return true
+		}
+	}
+	return false
+}
+
+// Decodes the HEIC with the HEICDecoder of the options
+func decodeHEIC(data []byte, options *CompressionOptions) (image.Image, error) {
+	if options.HEICDecoder == nil {
+		return nil, ErrNoHEICDecoder
+	}
+	return options.HEICDecoder(bytes.NewReader(data))
+}
+
+/*
+ * Returns a decoder running an external converter, e.g. for HEICDecoder.
+ * The converter gets the image in stdin and writes it in stdout in a format Go decodes, e.g. PNG.
+ *
+ *      optimg.WithHEICDecoder(optimg.CommandDecoder("magick", "heic:-", "png:-"))
+ */
+func CommandDecoder(name string, args ...string) HEICDecoder {
+	return func(r io.Reader) (image.Image, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = r
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("optimg: %s: %v: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		img, _, err := image.Decode(&stdout)
+		return img, err
+	}
+}
@@ -0,0 +1,413 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+var errICCUnsupported = errors.New("optimg: unsupported ICC profile")
+
+// XYZ (D50) to linear sRGB, Bradford-adapted
+var xyzToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+/*
+ * RGB color profile of the matrix/TRC kind, e.g. AdobeRGB, ProPhoto or Display P3.
+ *
+ *      trc         Linear light of each 8-bit value, by channel
+ *      matrix      Linear device RGB to linear sRGB
+ */
+type iccProfile struct {
+	trc    [3][256]float64
+	matrix [3][3]float64
+}
+
+/*
+ * Reads the ICC profile embedded in a JPEG (APP2 chunks) or PNG (iCCP chunk).
+ * Returns nil if there is none.
+ */
+func readICC(data []byte) []byte {
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		// Large profiles are split in chunks numbered from 1
+		var chunks [][]byte
+		walkJPEG(data, func(marker byte, payload []byte) bool {
+			if marker == 0xe2 && len(payload) > 14 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")) {
+				seq, count := int(payload[12]), int(payload[13])
+				if chunks == nil {
+					chunks = make([][]byte, count)
+				}
+				if seq >= 1 && seq <= len(chunks) {
+					chunks[seq-1] = payload[14:]
+				}
+			}
+			return true
+		})
+		var profile []byte
+		for _, chunk := range chunks {
+			if chunk == nil {
+				return nil
+			}
+			profile = append(profile, chunk...)
+		}
+		return profile
+	}
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		for pos := 8; pos+8 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[pos:]))
+			kind := string(data[pos+4 : pos+8])
+			if length < 0 || pos+12+length > len(data) || kind == "IDAT" {
+				return nil
+			}
+			if kind == "iCCP" {
+				chunk := data[pos+8 : pos+8+length]
+				// Profile name, compression method, zlib stream
+				name := bytes.IndexByte(chunk, 0)
+				if name < 0 || name+2 > len(chunk) {
+					return nil
+				}
+				r, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+				if err != nil {
+					return nil
+				}
+				profile, err := ioutil.ReadAll(r)
+				if err != nil {
+					return nil
+				}
+				return profile
+			}
+			pos += 12 + length
+		}
+	}
+	return nil
+}
+
+/*
+ * Parses an RGB matrix/TRC profile.
+ * Profiles of other kinds (CMYK, gray, lookup tables only) give errICCUnsupported, the pixels are left as they are.
+ */
+func parseICC(profile []byte) (*iccProfile, error) {
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, errICCUnsupported
+	}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count && 132+12*i+12 <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		offset, size := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+		if uint64(offset)+uint64(size) > uint64(len(profile)) {
+			return nil, errICCUnsupported
+		}
+		tags[string(entry[:4])] = profile[offset : offset+size]
+	}
+	p := &iccProfile{}
+	var device [3][3]float64
+	for c, name := range []string{"r", "g", "b"} {
+		xyz, ok := parseXYZ(tags[name+"XYZ"])
+		if !ok {
+			return nil, errICCUnsupported
+		}
+		for row := 0; row < 3; row++ {
+			device[row][c] = xyz[row]
+		}
+		curve, ok := parseCurve(tags[name+"TRC"])
+		if !ok {
+			return nil, errICCUnsupported
+		}
+		for v := range p.trc[c] {
+			p.trc[c][v] = curve(float64(v) / 255)
+		}
+	}
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				p.matrix[row][col] += xyzToSRGB[row][k] * device[k][col]
+			}
+		}
+	}
+	return p, nil
+}
+
+// Signed 15.16 fixed point number
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 0x10000
+}
+
+// Parses an XYZType tag
+func parseXYZ(tag []byte) (xyz [3]float64, ok bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return
+	}
+	for i := range xyz {
+		xyz[i] = s15Fixed16(tag[8+4*i:])
+	}
+	return xyz, true
+}
+
+// Parses a curveType or parametricCurveType tag into the function giving linear light
+func parseCurve(tag []byte) (curve func(float64) float64, ok bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*count {
+			return nil, false
+		}
+		switch count {
+		case 0:
+			return func(x float64) float64 { return x }, true
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 0x100
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 0xffff
+		}
+		return func(x float64) float64 {
+			pos := x * float64(count-1)
+			i := int(pos)
+			if i >= count-1 {
+				return table[count-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, true
+	case "para":
+		params := []int{1, 3, 4, 5, 7}
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		if kind >= len(params) || len(tag) < 12+4*params[kind] {
+			return nil, false
+		}
+		// g, a, b, c, d, e, f
+		p := [7]float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < params[kind]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch kind {
+		case 1, 2:
+			// Below -b/a the curve is flat at c (0 for type 1)
+			d = -b / a
+		case 0:
+			d = math.Inf(-1)
+		}
+		return func(x float64) float64 {
+			if x < d {
+				if kind == 3 || kind == 4 {
+					return c*x + f
+				}
+				return c
+			}
+			base := a*x + b
+			if base < 0 {
+				base = 0
+			}
+			if kind == 2 {
+				return math.Pow(base, g) + c
+			}
+			return math.Pow(base, g) + e
+		}, true
+	}
+	return nil, false
+}
+
+/*
+ * Tells whether the profile is sRGB already, or close enough that converting would change nothing.
+ * Most photos are tagged sRGB, they are left as they are.
+ */
+func (p *iccProfile) isSRGB() bool {
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			identity := 0.0
+			if row == col {
+				identity = 1
+			}
+			if math.Abs(p.matrix[row][col]-identity) > 0.02 {
+				return false
+			}
+		}
+	}
+	for c := range p.trc {
+		for _, v := range []int{32, 64, 128, 192, 224} {
+			if math.Abs(p.trc[c][v]-srgbToLinear(float64(v)/255)) > 0.01 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Linear light of an sRGB value, 0-1
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+/*
+ * Converts the image from the profile to sRGB.
+ * Alpha is kept, the colors are converted without it premultiplied in.
+ */
+func (p *iccProfile) convert(img image.Image) *image.RGBA {
+	linearOnce.Do(buildLinearTables)
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		a := uint32(dst.Pix[i+3])
+		if a == 0 {
+			continue
+		}
+		var device [3]float64
+		for c := 0; c < 3; c++ {
+			device[c] = p.trc[c][uint32(dst.Pix[i+c])*0xff/a]
+		}
+		for c := 0; c < 3; c++ {
+			l := p.matrix[c][0]*device[0] + p.matrix[c][1]*device[1] + p.matrix[c][2]*device[2]
+			// Colors outside sRGB are clipped
+			l = math.Max(0, math.Min(1, l))
+			dst.Pix[i+c] = uint8(uint32(fromLinearTable[int(l*0xffff+0.5)]) * a / 0xff)
+		}
+	}
+	return dst
+}
+
+/*
+ * Converts the image to sRGB by the ICC profile embedded in the data, if any.
+ * Returns the image as it is if it has no profile, is sRGB already or the profile is not supported.
+ */
+func convertToSRGB(data []byte, img image.Image) image.Image {
+	profile := readICC(data)
+	if profile == nil {
+		return img
+	}
+	p, err := parseICC(profile)
+	if err != nil || p.isSRGB() {
+		return img
+	}
+	return p.convert(img)
+}
+
+// The sRGB profile, built on first use
+var (
+	srgbOnce    sync.Once
+	srgbSegment []byte
+)
+
+/*
+ * APP2 segment holding a compact sRGB profile (ICC v2, matrix/TRC), e.g. for browsers assuming wide gamut otherwise.
+ */
+func srgbICCSegment() []byte {
+	srgbOnce.Do(func() {
+		profile := buildSRGBProfile()
+		segment := &bytes.Buffer{}
+		length := 2 + 14 + len(profile)
+		segment.Write([]byte{0xff, 0xe2, byte(length >> 8), byte(length)})
+		segment.WriteString("ICC_PROFILE\x00")
+		segment.Write([]byte{1, 1})
+		segment.Write(profile)
+		srgbSegment = segment.Bytes()
+	})
+	return srgbSegment
+}
+
+// Builds the sRGB profile, with no dates in it so the output stays the same
+func buildSRGBProfile() []byte {
+	fixed := func(v float64) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(int32(math.Floor(v*0x10000+0.5))))
+		return b
+	}
+	xyz := func(x, y, z float64) []byte {
+		tag := append([]byte("XYZ \x00\x00\x00\x00"), fixed(x)...)
+		tag = append(tag, fixed(y)...)
+		return append(tag, fixed(z)...)
+	}
+	text := func(s string) []byte {
+		return append([]byte("text\x00\x00\x00\x00"+s), 0)
+	}
+	desc := func(s string) []byte {
+		tag := &bytes.Buffer{}
+		tag.WriteString("desc\x00\x00\x00\x00")
+		binary.Write(tag, binary.BigEndian, uint32(len(s)+1))
+		tag.WriteString(s)
+		tag.WriteByte(0)
+		// No Unicode or ScriptCode descriptions
+		tag.Write(make([]byte, 4+4+2+1+67))
+		return tag.Bytes()
+	}
+	curve := &bytes.Buffer{}
+	curve.WriteString("curv\x00\x00\x00\x00")
+	binary.Write(curve, binary.BigEndian, uint32(1024))
+	for i := 0; i < 1024; i++ {
+		binary.Write(curve, binary.BigEndian, uint16(math.Floor(srgbToLinear(float64(i)/1023)*0xffff+0.5)))
+	}
+	tags := []struct {
+		name string
+		data []byte
+	}{
+		{"desc", desc("sRGB")},
+		{"cprt", text("No copyright, use freely")},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(0.4360747, 0.2225045, 0.0139322)},
+		{"gXYZ", xyz(0.3850649, 0.7168786, 0.0971045)},
+		{"bXYZ", xyz(0.1430804, 0.0606169, 0.7141733)},
+		{"rTRC", curve.Bytes()},
+		{"gTRC", nil}, // Share the curve of red
+		{"bTRC", nil},
+	}
+	table := &bytes.Buffer{}
+	body := &bytes.Buffer{}
+	binary.Write(table, binary.BigEndian, uint32(len(tags)))
+	start := uint32(128 + 4 + 12*len(tags))
+	var offset, size uint32
+	for _, tag := range tags {
+		if tag.data != nil {
+			// Tags start on 4-byte boundaries
+			for body.Len()%4 != 0 {
+				body.WriteByte(0)
+			}
+			offset, size = start+uint32(body.Len()), uint32(len(tag.data))
+			body.Write(tag.data)
+		}
+		table.WriteString(tag.name)
+		binary.Write(table, binary.BigEndian, offset)
+		binary.Write(table, binary.BigEndian, size)
+	}
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], start+uint32(body.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	copy(header[68:], xyz(0.9642, 1, 0.8249)[8:])
+	return append(append(header, table.Bytes()...), body.Bytes()...)
+}
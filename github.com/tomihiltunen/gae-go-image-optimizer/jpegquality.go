@@ -0,0 +1,98 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"math"
+)
+
+// Luminance quantization table of the JPEG standard (Annex K), quality 50 in libjpeg terms
+var standardLuminance = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// Positions of the zigzag order the tables are stored in
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+/*
+ * Estimates the quality (1-100) the JPEG was written at, by its luminance quantization table.
+ * The table is compared to the standard one scaled the way libjpeg and most encoders do.
+ * Returns 0 if the data is not a JPEG or has no luminance table.
+ */
+func estimateJPEGQuality(data []byte) (quality int) {
+	walkJPEG(data, func(marker byte, payload []byte) bool {
+		if marker != 0xdb {
+			return true
+		}
+		// A segment may hold several tables, 8 or 16-bit
+		for len(payload) > 0 {
+			precision, id := payload[0]>>4, payload[0]&0x0f
+			size := 64
+			if precision == 1 {
+				size = 128
+			}
+			if len(payload) < 1+size {
+				return false
+			}
+			if id == 0 {
+				quality = tableQuality(payload[1 : 1+size])
+				return false
+			}
+			payload = payload[1+size:]
+		}
+		return true
+	})
+	return
+}
+
+// Quality of the luminance table in zigzag order
+func tableQuality(table []byte) int {
+	wide := len(table) == 128
+	sum, standard := 0, 0
+	for i, pos := range zigzag {
+		v := int(table[i])
+		if wide {
+			v = int(table[2*i])<<8 | int(table[2*i+1])
+		}
+		sum += v
+		standard += standardLuminance[pos]
+	}
+	// Percent the standard table was scaled by
+	scale := 100 * float64(sum) / float64(standard)
+	var quality float64
+	if scale <= 100 {
+		quality = (200 - scale) / 2
+	} else {
+		quality = 5000 / scale
+	}
+	return int(math.Max(1, math.Min(100, math.Round(quality))))
+}
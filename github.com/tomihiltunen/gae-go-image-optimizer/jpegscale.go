@@ -0,0 +1,58 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"io"
+)
+
+/*
+ * Decoder for JPEGs at a reduced DCT scale, which image/jpeg cannot do.
+ * Plug in one e.g. wrapping a libjpeg binding, it gets the denominator of the scale: 2, 4 or 8.
+ * Huge JPEGs to be made much smaller are decoded at 1/2, 1/4 or 1/8 of their size,
+ * taking a fraction of the memory and time; the rest are decoded with image/jpeg.
+ */
+var JPEGDecoder func(r io.Reader, denominator int) (image.Image, error)
+
+/*
+ * Picks the largest DCT scale the JPEG can be decoded at and still be resized down, not up, to its final size.
+ * Returns the denominator of the scale, 1 for decoding at full size.
+ *
+ *      - Only with JPEGDecoder plugged in.
+ *      - Not when more of the image may be needed: Variants, Crop, Trim, Transform and AllowUpscale.
+ *      - The dimensions are of the upright image, after AutoRotate and Rotate.
+ */
+func jpegScale(options *CompressionOptions, size_x, size_y int) int {
+	if JPEGDecoder == nil || len(options.Variants) > 0 || !options.Crop.Empty() ||
+		options.Trim || options.Transform != nil || options.AllowUpscale {
+		return 1
+	}
+	need_x, need_y, ok := fitSize(options, size_x, size_y)
+	// Cropping and stretching fill the whole box
+	if max_x, max_y := options.maxWidth(), options.maxHeight(); options.Fit != FitInside && max_x > 0 && max_y > 0 {
+		need_x, need_y, ok = max_x, max_y, true
+	}
+	if !ok {
+		return 1
+	}
+	for _, denominator := range []int{8, 4, 2} {
+		if (size_x+denominator-1)/denominator >= need_x && (size_y+denominator-1)/denominator >= need_y {
+			return denominator
+		}
+	}
+	return 1
+}
@@ -0,0 +1,281 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const LedgerKind = "OptimgLedger" // Datastore kind of the ledger entries
+
+/*
+ * Record of an optimized blob in the datastore, named by the new blob key.
+ * Written for each optimized blob when Ledger is set in the options.
+ *
+ *      OldKey          The original blob, deleted unless KeepOriginal
+ *      NewKey          The optimized blob
+ *      OriginalSize    Size of the original in bytes
+ *      Size            Size of the optimized blob in bytes
+ *      OriginalFormat  Format of the original
+ *      Format          Format of the optimized blob
+ *      OptionsHash     Hash of the options affecting the output, tells apart the settings used
+ *      Version         Version of the options the blob was optimized with
+ *      Elapsed         Time taken by the optimization
+ *      Created         When the blob was optimized
+ *      Pending         The blob has been written but not put in use yet, left behind if the request failed
+ */
+type LedgerEntry struct {
+	OldKey         appengine.BlobKey
+	NewKey         appengine.BlobKey
+	OriginalSize   int64  `datastore:",noindex"`
+	Size           int64  `datastore:",noindex"`
+	OriginalFormat string `datastore:",noindex"`
+	Format         string `datastore:",noindex"`
+	OptionsHash    string
+	Version        int
+	Elapsed        time.Duration `datastore:",noindex"`
+	Created        time.Time
+	Pending        bool
+}
+
+// Bytes saved by the optimization
+func (e *LedgerEntry) Saved() int64 {
+	return e.OriginalSize - e.Size
+}
+
+/*
+ * Gets the ledger entry of an optimized blob, e.g. to roll back to the original if it was kept.
+ * Returns datastore.ErrNoSuchEntity if the blob is not in the ledger.
+ */
+func LedgerEntryFor(c context.Context, newKey appengine.BlobKey) (entry *LedgerEntry, err error) {
+	entry = &LedgerEntry{}
+	if err = datastore.Get(c, ledgerKey(c, newKey), entry); err != nil {
+		entry = nil
+	}
+	return
+}
+
+/*
+ * Lists the ledger entries created since the given time, newest first.
+ * 0 limit = all of them. Pending entries are left out, their blobs may never be used.
+ */
+func LedgerEntries(c context.Context, since time.Time, limit int) (entries []*LedgerEntry, err error) {
+	// Skipped here, no composite index needed
+	iterator := datastore.NewQuery(LedgerKind).Filter("Created >=", since).Order("-Created").Run(c)
+	for limit <= 0 || len(entries) < limit {
+		entry := &LedgerEntry{}
+		_, err = iterator.Next(entry)
+		if err == datastore.Done {
+			return entries, nil
+		}
+		if err != nil {
+			return
+		}
+		if !entry.Pending {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+/*
+ * Sums up the ledger entries created since the given time, but for the pending ones.
+ */
+func LedgerSavings(c context.Context, since time.Time) (count int, originalSize, size int64, err error) {
+	iterator := datastore.NewQuery(LedgerKind).Filter("Created >=", since).Run(c)
+	for {
+		var entry LedgerEntry
+		_, err = iterator.Next(&entry)
+		if err == datastore.Done {
+			return count, originalSize, size, nil
+		}
+		if err != nil {
+			return
+		}
+		if entry.Pending {
+			continue
+		}
+		count++
+		originalSize += entry.OriginalSize
+		size += entry.Size
+	}
+}
+
+/*
+ * Marks the new blob pending in the ledger until it is in use.
+ * The garbage collector removes the ones never put in use.
+ */
+func recordPending(options *CompressionOptions, result *BlobResult, newKey appengine.BlobKey) {
+	entry := &LedgerEntry{
+		OldKey:  result.Original.BlobKey,
+		NewKey:  newKey,
+		Created: time.Now(),
+		Pending: true,
+	}
+	if _, err := datastore.Put(options.Context, ledgerKey(options.Context, newKey), entry); err != nil {
+		options.logger().Errorf(options.Context, "optimg: ledger of blob %s: %v", newKey, err)
+	}
+}
+
+// Removes the ledger entry of a blob not put in use
+func removePending(options *CompressionOptions, newKey appengine.BlobKey) {
+	_ = datastore.Delete(options.Context, ledgerKey(options.Context, newKey))
+}
+
+/*
+ * Writes the optimized blob to the ledger.
+ * A failing write is logged, the blob is optimized anyway.
+ */
+func recordLedger(options *CompressionOptions, result *BlobResult) {
+	entry := &LedgerEntry{
+		OldKey:         result.Original.BlobKey,
+		NewKey:         result.Blob.BlobKey,
+		OriginalSize:   result.OriginalSize,
+		Size:           result.Size,
+		OriginalFormat: string(result.OriginalFormat),
+		Format:         string(result.Format),
+		OptionsHash:    options.hash(),
+		Version:        options.Version,
+		Elapsed:        result.Elapsed,
+		Created:        time.Now(),
+	}
+	if _, err := datastore.Put(options.Context, ledgerKey(options.Context, entry.NewKey), entry); err != nil {
+		options.logger().Errorf(options.Context, "optimg: ledger of blob %s: %v", entry.NewKey, err)
+	}
+}
+
+// Key of the ledger entry of an optimized blob
+func ledgerKey(c context.Context, newKey appengine.BlobKey) *datastore.Key {
+	return datastore.NewKey(c, LedgerKind, string(newKey), 0, nil)
+}
+
+/*
+ * Hash of the options affecting the output.
+ * Two blobs with the same hash were optimized the same way.
+ */
+func (o *CompressionOptions) hash() string {
+	settings := struct {
+		Quality              int
+		AutoQuality          float64
+		JPEGQuality          int
+		WebPQuality          int
+		WebPLossless         bool
+		PNGCompression       int
+		GIFColors            int
+		MaxWidth, MaxHeight  int
+		AllowUpscale         bool
+		MinSize              int
+		Rotate               int
+		Flip                 Flip
+		Crop                 image.Rectangle
+		Trim                 bool
+		TrimTolerance        int
+		Fit                  FitMode
+		FaceDetector         bool
+		Background           color.Color
+		Filter               Filter
+		LinearLight          bool
+		Sharpen              UnsharpMask
+		Watermark            bool
+		Transform            bool
+		MaxOutputBytes       int64
+		MinSavingsPercent    int
+		SkipLowQuality       bool
+		SkipLarger           bool
+		OutputFormat         Format
+		Progressive          bool
+		Subsampling          Subsampling
+		PreserveTransparency bool
+		AutoFormat           bool
+		PaletteColors        int
+		QuantizeColors       int
+		DetectGrayscale      bool
+		Dither               bool
+		OptimizeAnimations   bool
+		DocumentPreviews     bool
+		RasterizeSVG         bool
+		AutoRotate           bool
+		ConvertToSRGB        bool
+		EmbedSRGB            bool
+		KeepMetadata         []MetadataField
+		Lossless             bool
+		LosslessResize       bool
+		Deterministic        bool
+		Variants             map[string]int
+	}{
+		Quality:              o.Quality,
+		AutoQuality:          o.AutoQuality,
+		JPEGQuality:          o.JPEGQuality,
+		WebPQuality:          o.WebPQuality,
+		WebPLossless:         o.WebPLossless,
+		PNGCompression:       int(o.PNGCompression),
+		GIFColors:            o.GIFColors,
+		MaxWidth:             o.maxWidth(),
+		MaxHeight:            o.maxHeight(),
+		AllowUpscale:         o.AllowUpscale,
+		MinSize:              o.MinSize,
+		Rotate:               o.Rotate,
+		Flip:                 o.Flip,
+		Crop:                 o.Crop,
+		Trim:                 o.Trim,
+		TrimTolerance:        o.TrimTolerance,
+		Fit:                  o.Fit,
+		FaceDetector:         o.FaceDetector != nil,
+		Background:           o.background(),
+		Filter:               o.Filter,
+		LinearLight:          o.LinearLight,
+		Sharpen:              o.Sharpen,
+		Watermark:            o.Watermark != nil,
+		Transform:            o.Transform != nil,
+		MaxOutputBytes:       o.MaxOutputBytes,
+		MinSavingsPercent:    o.MinSavingsPercent,
+		SkipLowQuality:       o.SkipLowQuality,
+		SkipLarger:           o.SkipLarger,
+		OutputFormat:         o.outputFormat(),
+		Progressive:          o.Progressive,
+		Subsampling:          o.Subsampling,
+		PreserveTransparency: o.PreserveTransparency,
+		AutoFormat:           o.AutoFormat,
+		PaletteColors:        o.PaletteColors,
+		QuantizeColors:       o.QuantizeColors,
+		DetectGrayscale:      o.DetectGrayscale,
+		Dither:               o.Dither,
+		OptimizeAnimations:   o.OptimizeAnimations,
+		DocumentPreviews:     o.DocumentPreviews,
+		RasterizeSVG:         o.RasterizeSVG,
+		AutoRotate:           o.AutoRotate,
+		ConvertToSRGB:        o.ConvertToSRGB,
+		EmbedSRGB:            o.EmbedSRGB,
+		KeepMetadata:         o.KeepMetadata,
+		Lossless:             o.Lossless,
+		LosslessResize:       o.LosslessResize,
+		Deterministic:        o.Deterministic,
+		Variants:             o.Variants,
+	}
+	data, _ := json.Marshal(settings)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,29 @@
+package optimg
+
+import (
+	// Go packages
+	"testing"
+)
+
+func TestOptionsHash(t *testing.T) {
+	base := defaultOptions().hash()
+	for name, option := range map[string]Option{
+		"MinSavingsPercent": func(o *CompressionOptions) { o.MinSavingsPercent = 10 },
+		"SkipLowQuality":    WithSkipLowQuality(false),
+		"SkipLarger":        WithSkipLarger(false),
+		"Quality":           WithQuality(60),
+		"Variants":          func(o *CompressionOptions) { o.Variants = map[string]int{"thumb": 200} },
+	} {
+		options := defaultOptions()
+		option(options)
+		if options.hash() == base {
+			t.Errorf("%s does not change the hash", name)
+		}
+	}
+	// Options not affecting the output do not
+	options := defaultOptions()
+	options.Concurrency = 4
+	if options.hash() != base {
+		t.Error("Concurrency changes the hash")
+	}
+}
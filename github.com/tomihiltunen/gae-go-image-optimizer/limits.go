@@ -0,0 +1,76 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"errors"
+	"fmt"
+
+	// App Engine packages
+	"google.golang.org/appengine/blobstore"
+)
+
+var ErrTooLarge = errors.New("optimg: upload too large")
+
+/*
+ * Error of an upload over MaxUploadBytes, the upload has been deleted.
+ * Matches ErrTooLarge with errors.Is, e.g. to answer 413 Request Entity Too Large.
+ *
+ *      Field       The form field of the upload
+ *      Filename    Name of the uploaded file
+ *      Size        Size of the upload in bytes
+ *      Limit       MaxUploadBytes of the field
+ */
+type TooLargeError struct {
+	Field    string
+	Filename string
+	Size     int64
+	Limit    int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("optimg: %s %q is %d bytes, over the limit of %d", e.Field, e.Filename, e.Size, e.Limit)
+}
+
+func (e *TooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+/*
+ * Refuses an upload over MaxUploadBytes by its size in the blobstore, before reading any of it.
+ * The upload is deleted, unless in dry-run mode, and the result carries a *TooLargeError.
+ * Returns nil for uploads within the limit.
+ */
+func refuseTooLarge(options *CompressionOptions, field string, blob *blobstore.BlobInfo) (result *BlobResult) {
+	if options.MaxUploadBytes <= 0 || blob.Size <= options.MaxUploadBytes {
+		return nil
+	}
+	result = newBlobResult(blob)
+	result.Err = &TooLargeError{
+		Field:    field,
+		Filename: blob.Filename,
+		Size:     blob.Size,
+		Limit:    options.MaxUploadBytes,
+	}
+	options.logger().Warningf(options.Context, "optimg: blob %s: %v", blob.BlobKey, result.Err)
+	if !options.DryRun {
+		if err := deleteBlob(options, blob.BlobKey); err != nil {
+			return
+		}
+		result.Blob = nil
+	}
+	return
+}
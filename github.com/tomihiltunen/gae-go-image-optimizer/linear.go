@@ -0,0 +1,104 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"math"
+	"sync"
+)
+
+// Conversion tables between 16-bit sRGB and linear light, built on first use
+var (
+	linearOnce      sync.Once
+	toLinearTable   []uint16
+	fromLinearTable []uint8
+)
+
+func buildLinearTables() {
+	toLinearTable = make([]uint16, 0x10000)
+	fromLinearTable = make([]uint8, 0x10000)
+	for i := range toLinearTable {
+		v := float64(i) / 0xffff
+		// sRGB to linear
+		var l float64
+		if v <= 0.04045 {
+			l = v / 12.92
+		} else {
+			l = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		toLinearTable[i] = uint16(l*0xffff + 0.5)
+		// Linear to sRGB
+		var s float64
+		if v <= 0.0031308 {
+			s = v * 12.92
+		} else {
+			s = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		fromLinearTable[i] = uint8(s*0xff + 0.5)
+	}
+}
+
+/*
+ * Copies the part r of the image to a new 16-bit image in linear light.
+ * The colors are linearized without the alpha premultiplied in.
+ */
+func toLinear(img image.Image, r image.Rectangle) *image.RGBA64 {
+	linearOnce.Do(buildLinearTables)
+	linear := image.NewRGBA64(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			cr, cg, cb, ca := img.At(x, y).RGBA()
+			if ca == 0 {
+				continue
+			}
+			i := linear.PixOffset(x-r.Min.X, y-r.Min.Y)
+			for c, v := range [3]uint32{cr, cg, cb} {
+				l := uint32(toLinearTable[v*0xffff/ca]) * ca / 0xffff
+				linear.Pix[i+2*c] = uint8(l >> 8)
+				linear.Pix[i+2*c+1] = uint8(l)
+			}
+			linear.Pix[i+6] = uint8(ca >> 8)
+			linear.Pix[i+7] = uint8(ca)
+		}
+	}
+	return linear
+}
+
+/*
+ * Converts an image in linear light back to 8-bit sRGB.
+ */
+func fromLinear(linear *image.RGBA64) *image.RGBA {
+	linearOnce.Do(buildLinearTables)
+	img := image.NewRGBA(linear.Bounds())
+	for i := 0; i < len(linear.Pix); i += 8 {
+		ca := uint32(linear.Pix[i+6])<<8 | uint32(linear.Pix[i+7])
+		if ca == 0 {
+			continue
+		}
+		j := i / 2
+		for c := 0; c < 3; c++ {
+			l := uint32(linear.Pix[i+2*c])<<8 | uint32(linear.Pix[i+2*c+1])
+			v := l * 0xffff / ca
+			if v > 0xffff {
+				v = 0xffff
+			}
+			img.Pix[j+c] = uint8(uint32(fromLinearTable[v]) * ca / 0xffff)
+		}
+		img.Pix[j+3] = uint8(ca >> 8)
+	}
+	return img
+}
@@ -0,0 +1,78 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+
+	// App Engine packages
+	"google.golang.org/appengine/log"
+)
+
+/*
+ * Where the package tells what it did with each blob and why, e.g. "why wasn't this image resized?".
+ *
+ *      Debugf      Blobs left as they are and why, fallbacks taken
+ *      Infof       Savings of the optimized blobs
+ *      Warningf    Blobs that could not be optimized, the originals are kept
+ *      Errorf      Failures leaving things behind, e.g. a blob that could not be deleted
+ */
+type Logger interface {
+	Debugf(c context.Context, format string, args ...interface{})
+	Infof(c context.Context, format string, args ...interface{})
+	Warningf(c context.Context, format string, args ...interface{})
+	Errorf(c context.Context, format string, args ...interface{})
+}
+
+/*
+ * Logger writing to the App Engine log of the request, the default.
+ * Nothing is logged without a context.
+ */
+var AppEngineLogger Logger = appengineLogger{}
+
+type appengineLogger struct{}
+
+func (appengineLogger) Debugf(c context.Context, format string, args ...interface{}) {
+	if c != nil {
+		log.Debugf(c, format, args...)
+	}
+}
+
+func (appengineLogger) Infof(c context.Context, format string, args ...interface{}) {
+	if c != nil {
+		log.Infof(c, format, args...)
+	}
+}
+
+func (appengineLogger) Warningf(c context.Context, format string, args ...interface{}) {
+	if c != nil {
+		log.Warningf(c, format, args...)
+	}
+}
+
+func (appengineLogger) Errorf(c context.Context, format string, args ...interface{}) {
+	if c != nil {
+		log.Errorf(c, format, args...)
+	}
+}
+
+// Logger of the options, App Engine logging unless told otherwise
+func (o *CompressionOptions) logger() Logger {
+	if o.Logger == nil {
+		return AppEngineLogger
+	}
+	return o.Logger
+}
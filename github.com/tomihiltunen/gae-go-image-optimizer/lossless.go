@@ -0,0 +1,232 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"io"
+)
+
+/*
+ * Lossless optimizer for JPEGs, used in Lossless mode. Go cannot rewrite the Huffman coding on its own.
+ * Plug in one e.g. running jpegtran -optimize -copy all, the metadata is stripped after it as asked.
+ * Without one JPEGs are only stripped of their metadata in Lossless mode.
+ */
+var JPEGOptimizer func(r io.Reader, w io.Writer) error
+
+/*
+ * Tells the upright dimensions of the image and whether it is to be resized in Lossless mode,
+ * which it is only with LosslessResize and when over the maximum size.
+ */
+func losslessSize(data []byte, options *CompressionOptions) (size_x, size_y int, resize bool, err error) {
+	if size_x, size_y, err = uprightSize(data); err != nil {
+		return
+	}
+	if !options.LosslessResize {
+		return
+	}
+	_, _, resize = fitSize(options, size_x, size_y)
+	if max_x, max_y := options.maxWidth(), options.maxHeight(); options.Fit != FitInside && max_x > 0 && max_y > 0 {
+		resize = size_x != max_x || size_y != max_y
+	}
+	return
+}
+
+/*
+ * Optimizes the image without touching the pixels.
+ *
+ *      - JPEGs are run through JPEGOptimizer if plugged in, then stripped of their metadata.
+ *        The EXIF orientation, ICC profile and the EXIF fields of KeepMetadata are kept.
+ *      - PNGs are compressed again at png.BestCompression, or PNGCompression if set, the metadata chunks are dropped.
+ *      - Animated PNGs and other formats are returned as they are.
+ */
+func optimizeLossless(data []byte, options *CompressionOptions) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		if JPEGOptimizer != nil {
+			var buf bytes.Buffer
+			if err := JPEGOptimizer(bytes.NewReader(data), &buf); err != nil {
+				return nil, err
+			}
+			data = buf.Bytes()
+		}
+		return stripJPEG(data, options), nil
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) && !isAPNG(data):
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		encoder := png.Encoder{CompressionLevel: options.PNGCompression}
+		if encoder.CompressionLevel == png.DefaultCompression {
+			encoder.CompressionLevel = png.BestCompression
+		}
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+// Tells whether the PNG is animated, image/png decodes the first frame only
+func isAPNG(data []byte) bool {
+	idat := bytes.Index(data, []byte("IDAT"))
+	actl := bytes.Index(data, []byte("acTL"))
+	return actl >= 0 && (idat < 0 || actl < idat)
+}
+
+/*
+ * Drops the metadata segments of the JPEG, the image data is copied as it is.
+ * Kept are JFIF, the ICC profile, the Adobe marker telling the color transform,
+ * and an EXIF segment with the orientation and the fields of KeepMetadata.
+ */
+func stripJPEG(data []byte, options *CompressionOptions) []byte {
+	segments, rest := splitJPEG(data)
+	if rest == nil {
+		return data
+	}
+	var exif []byte
+	if parsed, err := readExif(bytes.NewReader(data)); err == nil && parsed != nil {
+		exif = parsed.filter(append([]MetadataField{MetadataOrientation}, options.keepMetadata()...), false)
+	}
+	var out bytes.Buffer
+	out.Write([]byte{0xff, 0xd8})
+	for _, segment := range segments {
+		switch {
+		case segment.marker == 0xe1:
+			if exif != nil && bytes.HasPrefix(segment.payload, []byte("Exif\x00\x00")) {
+				out.Write(exif)
+				exif = nil
+			}
+		case segment.marker == 0xe2:
+			if bytes.HasPrefix(segment.payload, []byte("ICC_PROFILE\x00")) {
+				writeSegment(&out, segment)
+			}
+		case segment.marker == 0xe0 || segment.marker == 0xee:
+			writeSegment(&out, segment)
+		case segment.marker > 0xe0 && segment.marker <= 0xef, segment.marker == 0xfe:
+			// Other application segments and comments
+		default:
+			writeSegment(&out, segment)
+		}
+	}
+	out.Write(rest)
+	return out.Bytes()
+}
+
+// PNG chunks of metadata, dropped by stripPNG
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+/*
+ * Drops the text, EXIF and time chunks of the PNG, the other chunks are copied as they are.
+ * Returns the PNG as it is if it is not a valid one.
+ */
+func stripPNG(data []byte) []byte {
+	signature := []byte("\x89PNG\r\n\x1a\n")
+	if !bytes.HasPrefix(data, signature) {
+		return data
+	}
+	var out bytes.Buffer
+	out.Write(signature)
+	for rest := data[len(signature):]; len(rest) > 0; {
+		if len(rest) < 12 {
+			return data
+		}
+		length := int64(binary.BigEndian.Uint32(rest))
+		if length > int64(len(rest))-12 {
+			return data
+		}
+		chunk := rest[:12+length]
+		rest = rest[12+length:]
+		if !pngMetadataChunks[string(chunk[4:8])] {
+			out.Write(chunk)
+		}
+	}
+	return out.Bytes()
+}
+
+/*
+ * Strips the metadata of a JPEG or PNG losslessly, see stripJPEG and stripPNG.
+ * Returns nil if there is nothing to strip, e.g. to tell whether an image can be kept as it is.
+ */
+func stripMetadata(data []byte, options *CompressionOptions) []byte {
+	stripped := data
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		stripped = stripJPEG(data, options)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		stripped = stripPNG(data)
+	}
+	if len(stripped) >= len(data) {
+		return nil
+	}
+	return stripped
+}
+
+// Writes the segment with its marker and length
+func writeSegment(w *bytes.Buffer, segment jpegSegment) {
+	length := len(segment.payload) + 2
+	w.Write([]byte{0xff, segment.marker, byte(length >> 8), byte(length)})
+	w.Write(segment.payload)
+}
+
+/*
+ * Optimizes the blob in Lossless mode, replacing it unless it did not get any smaller.
+ * An original with metadata to strip is replaced by the stripped one even then.
+ */
+func handleLossless(options *CompressionOptions, result *BlobResult, data []byte, size_x, size_y int) {
+	blob := result.Original
+	format := Format(detectContentType(data))
+	result.OriginalFormat, result.Format = format, format
+	result.OriginalWidth, result.OriginalHeight = size_x, size_y
+	result.Width, result.Height = size_x, size_y
+	out, err := optimizeLossless(data, options)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	// The metadata goes anyway
+	if !savesEnough(options, int64(len(data)), int64(len(out))) {
+		size := len(out)
+		if out = stripMetadata(data, options); out == nil {
+			options.logger().Infof(options.Context, "optimg: blob %s: %d bytes losslessly, too little saved, the original is kept", blob.BlobKey, size)
+			result.NoSavings = true
+			markOptimized(options, blob.BlobKey)
+			setServingURL(options, result)
+			afterOptimize(options, result)
+			return
+		}
+	}
+	writeBlob(options, result, format, writeData(out))
+	if result.Err == nil {
+		options.logger().Infof(options.Context, "optimg: blob %s: %d bytes to %d losslessly, %s %dx%d", blob.BlobKey, result.OriginalSize, result.Size, result.Format, result.Width, result.Height)
+		markOptimized(options, result.Blob.BlobKey)
+		if options.Ledger && !options.DryRun {
+			recordLedger(options, result)
+		}
+		setServingURL(options, result)
+		afterOptimize(options, result)
+	}
+}
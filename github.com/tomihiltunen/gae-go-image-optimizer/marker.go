@@ -0,0 +1,122 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const OptimizedKind = "OptimgOptimized" // Datastore kind of the markers of optimized blobs
+
+/*
+ * Marker of a blob written or already gone through by the optimizer, named by the blob key.
+ * Written when SkipOptimized is set in the options.
+ *
+ *      Version     Version of the options the blob was optimized with
+ *      Created     When the blob was optimized
+ */
+type optimizedMarker struct {
+	Version int
+	Created time.Time `datastore:",noindex"`
+}
+
+/*
+ * Tells whether the blob has been through the optimizer, e.g. before serving it to a re-run of a bulk job.
+ * Only blobs optimized with SkipOptimized set are known.
+ */
+func IsOptimized(c context.Context, key appengine.BlobKey) (bool, error) {
+	var marker optimizedMarker
+	err := datastore.Get(c, optimizedKey(c, key), &marker)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/*
+ * Lists the blobs optimized with an older Version of the options than the given one.
+ * 0 limit = all of them.
+ */
+func OutdatedBlobs(c context.Context, version int, limit int) (keys []appengine.BlobKey, err error) {
+	query := outdatedQuery(version)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	markerKeys, err := query.GetAll(c, nil)
+	for _, key := range markerKeys {
+		keys = append(keys, appengine.BlobKey(key.StringID()))
+	}
+	return
+}
+
+// Markers of the blobs optimized with an older version
+func outdatedQuery(version int) *datastore.Query {
+	return datastore.NewQuery(OptimizedKind).Filter("Version <", version).KeysOnly()
+}
+
+/*
+ * Tells whether to leave the blob alone as already optimized by the current Version.
+ * A failing lookup is logged and the blob optimized anyway.
+ */
+func alreadyOptimized(options *CompressionOptions, key appengine.BlobKey) bool {
+	if !options.SkipOptimized {
+		return false
+	}
+	var marker optimizedMarker
+	err := datastore.Get(options.Context, optimizedKey(options.Context, key), &marker)
+	if err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			options.logger().Errorf(options.Context, "optimg: marker of blob %s: %v", key, err)
+		}
+		return false
+	}
+	return marker.Version >= options.Version
+}
+
+/*
+ * Marks the blob optimized so that it is not compressed again.
+ * A failing write is logged, the blob is just optimized again the next time.
+ */
+func markOptimized(options *CompressionOptions, key appengine.BlobKey) {
+	if !options.SkipOptimized || options.DryRun {
+		return
+	}
+	marker := &optimizedMarker{
+		Version: options.Version,
+		Created: time.Now(),
+	}
+	if _, err := datastore.Put(options.Context, optimizedKey(options.Context, key), marker); err != nil {
+		options.logger().Errorf(options.Context, "optimg: marker of blob %s: %v", key, err)
+	}
+}
+
+// Removes the marker of a deleted blob
+func unmarkOptimized(options *CompressionOptions, key appengine.BlobKey) {
+	if !options.SkipOptimized || options.DryRun {
+		return
+	}
+	_ = datastore.Delete(options.Context, optimizedKey(options.Context, key))
+}
+
+// Key of the marker of a blob
+func optimizedKey(c context.Context, key appengine.BlobKey) *datastore.Key {
+	return datastore.NewKey(c, OptimizedKind, string(key), 0, nil)
+}
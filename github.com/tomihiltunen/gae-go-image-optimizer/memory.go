@@ -0,0 +1,166 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+)
+
+var ErrNotClosed = errors.New("optimg: blob writer not closed")
+
+/*
+ * Storage keeping the blobs in memory, e.g. for testing the pipeline without blobstore.
+ * Missing blobs give datastore.ErrNoSuchEntity like blobstore does. Safe for concurrent use.
+ * The zero value is ready to use.
+ */
+type MemoryStorage struct {
+	mu    sync.Mutex
+	blobs map[appengine.BlobKey]*memoryBlob
+	order []appengine.BlobKey
+}
+
+// A blob in memory
+type memoryBlob struct {
+	info blobstore.BlobInfo
+	data []byte
+}
+
+/*
+ * Stores the data as a blob, e.g. an upload to be optimized.
+ */
+func (s *MemoryStorage) Put(contentType, filename string, data []byte) *blobstore.BlobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobs == nil {
+		s.blobs = make(map[appengine.BlobKey]*memoryBlob)
+	}
+	sum := md5.Sum(data)
+	blob := &memoryBlob{
+		info: blobstore.BlobInfo{
+			BlobKey:      appengine.BlobKey(fmt.Sprintf("memory-%d", len(s.order)+1)),
+			ContentType:  contentType,
+			CreationTime: time.Now(),
+			Filename:     filename,
+			Size:         int64(len(data)),
+			MD5:          hex.EncodeToString(sum[:]),
+		},
+		data: append([]byte(nil), data...),
+	}
+	s.blobs[blob.info.BlobKey] = blob
+	s.order = append(s.order, blob.info.BlobKey)
+	info := blob.info
+	return &info
+}
+
+/*
+ * Gives the data of the blob, nil if there is no such blob.
+ */
+func (s *MemoryStorage) Get(key appengine.BlobKey) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if blob, ok := s.blobs[key]; ok {
+		return blob.data
+	}
+	return nil
+}
+
+/*
+ * Gives the keys of the blobs stored, in the order they were stored.
+ */
+func (s *MemoryStorage) Keys() []appengine.BlobKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]appengine.BlobKey, 0, len(s.blobs))
+	for _, key := range s.order {
+		if _, ok := s.blobs[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *MemoryStorage) Open(c context.Context, key appengine.BlobKey) (BlobReader, error) {
+	data := s.Get(key)
+	if data == nil {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (s *MemoryStorage) Create(c context.Context, contentType string) (BlobWriter, error) {
+	return &memoryWriter{
+		storage:     s,
+		contentType: contentType,
+	}, nil
+}
+
+func (s *MemoryStorage) Delete(c context.Context, key appengine.BlobKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *MemoryStorage) Stat(c context.Context, key appengine.BlobKey) (*blobstore.BlobInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	info := blob.info
+	return &info, nil
+}
+
+/*
+ * Writer for a new blob in memory, stored once closed.
+ */
+type memoryWriter struct {
+	storage     *MemoryStorage
+	contentType string
+	buf         bytes.Buffer
+	key         appengine.BlobKey
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	if w.key == "" {
+		w.key = w.storage.Put(w.contentType, "", w.buf.Bytes()).BlobKey
+	}
+	return nil
+}
+
+func (w *memoryWriter) Key() (appengine.BlobKey, error) {
+	if w.key == "" {
+		return "", ErrNotClosed
+	}
+	return w.key, nil
+}
@@ -0,0 +1,203 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+/*
+ * EXIF fields that can be kept in the optimized JPEGs.
+ * Everything else (EXIF, IPTC, XMP) is stripped.
+ */
+type MetadataField uint16
+
+const (
+	MetadataImageDescription MetadataField = 0x010e
+	MetadataMake             MetadataField = 0x010f
+	MetadataModel            MetadataField = 0x0110
+	MetadataOrientation      MetadataField = 0x0112 // Dropped when AutoRotate is on
+	MetadataSoftware         MetadataField = 0x0131
+	MetadataDateTime         MetadataField = 0x0132
+	MetadataArtist           MetadataField = 0x013b
+	MetadataCopyright        MetadataField = 0x8298
+	MetadataDateTimeOriginal MetadataField = 0x9003 // Lives in the EXIF sub-IFD
+)
+
+const (
+	// Pointer to the EXIF sub-IFD
+	exifTagExifIFD = 0x8769
+	// LONG value type
+	exifTypeLong = 4
+)
+
+// Fields that differ between runs or builds, left out in Deterministic mode
+var volatileMetadata = map[MetadataField]bool{
+	MetadataSoftware:         true,
+	MetadataDateTime:         true,
+	MetadataDateTimeOriginal: true,
+}
+
+// The EXIF fields to keep
+func (o *CompressionOptions) keepMetadata() []MetadataField {
+	if !o.Deterministic {
+		return o.KeepMetadata
+	}
+	var keep []MetadataField
+	for _, field := range o.KeepMetadata {
+		if !volatileMetadata[field] {
+			keep = append(keep, field)
+		}
+	}
+	return keep
+}
+
+/*
+ * Builds an APP1 segment holding only the given fields.
+ * Returns nil if none of the fields are present.
+ *
+ *      upright     The pixels have been turned already so the orientation is left out
+ */
+func (e *exifData) filter(keep []MetadataField, upright bool) []byte {
+	wanted := make(map[uint16]bool, len(keep))
+	for _, field := range keep {
+		wanted[uint16(field)] = true
+	}
+	if upright {
+		delete(wanted, exifTagOrientation)
+	}
+	var ifd0, exifIFD []exifEntry
+	for _, entry := range e.ifd0() {
+		if entry.tag == exifTagExifIFD && entry.typ == exifTypeLong && len(entry.value) == 4 {
+			for _, subEntry := range e.entries(e.order.Uint32(entry.value)) {
+				if wanted[subEntry.tag] {
+					exifIFD = append(exifIFD, subEntry)
+				}
+			}
+			continue
+		}
+		if wanted[entry.tag] {
+			ifd0 = append(ifd0, entry)
+		}
+	}
+	if len(ifd0) == 0 && len(exifIFD) == 0 {
+		return nil
+	}
+	// The sub-IFD needs a pointer in the first IFD
+	if len(exifIFD) > 0 {
+		ifd0 = append(ifd0, exifEntry{tag: exifTagExifIFD, typ: exifTypeLong, count: 1, value: make([]byte, 4)})
+	}
+	sort.Sort(exifEntries(ifd0))
+	sort.Sort(exifEntries(exifIFD))
+	// Lay out: header, first IFD, sub-IFD, values
+	ifd0Size := uint32(2 + 12*len(ifd0) + 4)
+	exifIFDSize := uint32(0)
+	if len(exifIFD) > 0 {
+		exifIFDSize = uint32(2 + 12*len(exifIFD) + 4)
+	}
+	for index := range ifd0 {
+		if ifd0[index].tag == exifTagExifIFD {
+			e.order.PutUint32(ifd0[index].value, 8+ifd0Size)
+		}
+	}
+	tiff := &bytes.Buffer{}
+	values := &bytes.Buffer{}
+	valueOffset := 8 + ifd0Size + exifIFDSize
+	if e.order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(tiff, e.order, uint16(42))
+	binary.Write(tiff, e.order, uint32(8))
+	for _, entries := range [][]exifEntry{ifd0, exifIFD} {
+		if len(entries) == 0 {
+			continue
+		}
+		binary.Write(tiff, e.order, uint16(len(entries)))
+		for _, entry := range entries {
+			binary.Write(tiff, e.order, entry.tag)
+			binary.Write(tiff, e.order, entry.typ)
+			binary.Write(tiff, e.order, entry.count)
+			if len(entry.value) <= 4 {
+				// Small values go in place of the offset
+				inline := make([]byte, 4)
+				copy(inline, entry.value)
+				tiff.Write(inline)
+				continue
+			}
+			binary.Write(tiff, e.order, valueOffset+uint32(values.Len()))
+			values.Write(entry.value)
+			// Values start on word boundaries
+			if values.Len()%2 == 1 {
+				values.WriteByte(0)
+			}
+		}
+		// No next IFD
+		binary.Write(tiff, e.order, uint32(0))
+	}
+	tiff.Write(values.Bytes())
+	// APP1 segment with the EXIF header
+	length := 2 + 6 + tiff.Len()
+	if length > 0xffff {
+		return nil
+	}
+	segment := &bytes.Buffer{}
+	segment.Write([]byte{0xff, 0xe1, byte(length >> 8), byte(length)})
+	segment.WriteString("Exif\x00\x00")
+	segment.Write(tiff.Bytes())
+	return segment.Bytes()
+}
+
+// Sorts EXIF entries by their tags as required by the spec
+type exifEntries []exifEntry
+
+func (s exifEntries) Len() int           { return len(s) }
+func (s exifEntries) Less(i, j int) bool { return s[i].tag < s[j].tag }
+func (s exifEntries) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+/*
+ * Writes a JPEG and places an extra segment right after the start of image marker.
+ */
+type segmentWriter struct {
+	w       io.Writer
+	segment []byte
+	written int
+}
+
+func (s *segmentWriter) Write(p []byte) (n int, err error) {
+	// Start of image is the first two bytes
+	if s.written < 2 && s.written+len(p) >= 2 {
+		head := 2 - s.written
+		if _, err = s.w.Write(p[:head]); err != nil {
+			return
+		}
+		if _, err = s.w.Write(s.segment); err != nil {
+			return
+		}
+		if _, err = s.w.Write(p[head:]); err != nil {
+			return
+		}
+		s.written += len(p)
+		return len(p), nil
+	}
+	n, err = s.w.Write(p)
+	s.written += n
+	return
+}
@@ -0,0 +1,80 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"time"
+
+	// OpenTelemetry packages
+	"go.opentelemetry.io/otel/attribute"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+)
+
+/*
+ * The phases of optimizing a blob.
+ *
+ *      PhaseDecode     Reading and decoding the image, bytes read
+ *      PhaseResize     Resizing, cropping and watermarking the decoded image
+ *      PhaseEncode     Encoding the image in memory, bytes encoded; streamed images are encoded in PhaseWrite
+ *      PhaseWrite      Writing the new blob to the storage, bytes written
+ *      PhaseDelete     Deleting a blob from the storage
+ */
+type Phase string
+
+const (
+	PhaseDecode Phase = "decode"
+	PhaseResize Phase = "resize"
+	PhaseEncode Phase = "encode"
+	PhaseWrite  Phase = "write"
+	PhaseDelete Phase = "delete"
+)
+
+/*
+ * Receives the time taken and the bytes handled by each phase of each blob, e.g. for exporting them to monitoring.
+ * The key is empty for images not in the storage, e.g. in Optimize().
+ * Called from the goroutines optimizing the blobs, must be safe for concurrent use.
+ */
+type Metrics interface {
+	Observe(c context.Context, key appengine.BlobKey, phase Phase, elapsed time.Duration, bytes int64)
+}
+
+/*
+ * Function as Metrics.
+ */
+type MetricsFunc func(c context.Context, key appengine.BlobKey, phase Phase, elapsed time.Duration, bytes int64)
+
+func (f MetricsFunc) Observe(c context.Context, key appengine.BlobKey, phase Phase, elapsed time.Duration, bytes int64) {
+	f(c, key, phase, elapsed, bytes)
+}
+
+/*
+ * Starts a phase of the blob, in a span of its own.
+ * The returned function ends it with the bytes handled, the Metrics are told of the phases that went fine.
+ */
+func (o *CompressionOptions) startPhase(c context.Context, key appengine.BlobKey, phase Phase) func(bytes int64, err error) {
+	start := time.Now()
+	_, span := startSpan(c, "optimg."+string(phase))
+	return func(bytes int64, err error) {
+		span.SetAttributes(attribute.Int64("optimg.bytes", bytes))
+		endSpan(span, err)
+		if o.Metrics != nil && err == nil {
+			o.Metrics.Observe(c, key, phase, time.Since(start), bytes)
+		}
+	}
+}
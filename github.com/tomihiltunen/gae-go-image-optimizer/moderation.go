@@ -0,0 +1,106 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"fmt"
+	"image"
+
+	// Google Cloud packages
+	vision "cloud.google.com/go/vision/v2/apiv1"
+	"cloud.google.com/go/vision/v2/apiv1/visionpb"
+)
+
+/*
+ * Checks the uploaded images before they are stored.
+ * Return a *RejectedError to reject the image, the upload is then deleted.
+ * Any other error leaves the upload as it is, unoptimized.
+ */
+type Moderator interface {
+	Moderate(c context.Context, img image.Image) error
+}
+
+/*
+ * Error of an image rejected by the Moderator.
+ *
+ *      Reason  Why the image was rejected, e.g. "adult"
+ */
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "optimg: image rejected: " + e.Reason
+}
+
+/*
+ * Moderator backed by Google Cloud Vision SafeSearch.
+ *
+ *      Client      Cloud Vision client, created for each image if left nil
+ *      Threshold   Likelihood of adult, violent or racy content rejected, visionpb.Likelihood_LIKELY if not set
+ */
+type VisionModerator struct {
+	Client    *vision.ImageAnnotatorClient
+	Threshold visionpb.Likelihood
+}
+
+func (m *VisionModerator) Moderate(c context.Context, img image.Image) (err error) {
+	client := m.Client
+	if client == nil {
+		if client, err = vision.NewImageAnnotatorClient(c); err != nil {
+			return
+		}
+		defer client.Close()
+	}
+	visionImage, _, err := newVisionImage(img)
+	if err != nil {
+		return
+	}
+	response, err := annotateImage(c, client, visionImage, &visionpb.Feature{Type: visionpb.Feature_SAFE_SEARCH_DETECTION})
+	if err != nil {
+		return
+	}
+	annotation := response.GetSafeSearchAnnotation()
+	threshold := m.Threshold
+	if threshold == visionpb.Likelihood_UNKNOWN {
+		threshold = visionpb.Likelihood_LIKELY
+	}
+	categories := []struct {
+		reason     string
+		likelihood visionpb.Likelihood
+	}{
+		{"adult", annotation.GetAdult()},
+		{"violence", annotation.GetViolence()},
+		{"racy", annotation.GetRacy()},
+	}
+	for _, category := range categories {
+		if category.likelihood >= threshold {
+			return &RejectedError{
+				Reason: fmt.Sprintf("%s content %s", category.reason, category.likelihood),
+			}
+		}
+	}
+	return nil
+}
+
+// Runs the image by the moderator of the options, if any
+func moderate(c context.Context, options *CompressionOptions, img image.Image) error {
+	if options.Moderator == nil {
+		return nil
+	}
+	return options.Moderator.Moderate(c, img)
+}
@@ -23,153 +23,608 @@ package optimg
 
 import (
 	// Go packages
+	"context"
+	"errors"
 	"image"
 	_ "image/gif"
-	"image/jpeg"
+	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"math"
-	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
-	// 3rd-party
-	// By "Go Authors"
-	"github.com/tomihiltunen/resize"
+	// OpenTelemetry packages
+	"go.opentelemetry.io/otel/attribute"
 
 	// App Engine packages
-	"appengine"
-	"appengine/blobstore"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
 )
 
+var ErrBlobMismatch = errors.New("optimg: written blob does not match the encoded image")
+
+const sniffLen = 512 // Bytes looked at by http.DetectContentType
+
 /*
- *  Allowed mime-types.
+ *  Allowed mime-types unless given in the options.
  *  These should be the ones supported by Go image package.
+ *  The mime-type is sniffed from the content, the uploaded Content-Type is not trusted.
  */
 var (
 	allowedMimeTypes = map[string]bool{
-		"image/jpeg": true,
-		"image/jpg":  true,
-		"image/png":  true,
-		"image/gif":  true,
+		"image/jpeg":    true,
+		"image/jpg":     true,
+		"image/png":     true,
+		"image/gif":     true,
+		"image/bmp":     true, // Windows screenshots and paint programs
+		"image/tiff":    true, // Scanners
+		"image/webp":    true, // Phones and browsers
+		"image/heic":    true, // iPhones, with HEICDecoder plugged in
+		"image/heif":    true,
+		"image/svg+xml": true, // Sanitized, or rasterized with RasterizeSVG
 	}
 )
 
 /*
- * The options for image optimization.
+ * This one does the magic.
  *
- *      Quality     The quality of the JPEG output (0-100)
- *      Size        Maximum dimension (width/height) for the photo
- *      Request     The pointer for the HTTP request
- *      Context     App Engine context    
+ *      - Gets the uploaded blobs by calling blobstore.ParseUpload()
+ *      - Maintains all other values that come from blobstore.
+ *      - Applies the overrides signed by SignOverrides, with OverrideSecret set.
+ *      - Leaves out the uploads rejected by the Moderator, those are deleted.
+ *      - Gives the images of unpacked ZIP archives in place of the archives.
+ *      - Hands out the results for further processing.
+ *      - In strict mode the blobs come with the error, the originals of the optimized ones are gone already.
  */
-type compressionOptions struct {
-	Quality int
-	Size    int
-	Request *http.Request
-	Context appengine.Context
+func ParseBlobs(options *CompressionOptions) (blobs map[string][]*blobstore.BlobInfo, other url.Values, err error) {
+	results, other, err := ParseBlobResults(options)
+	if results != nil {
+		blobs = blobsOf(results)
+	}
+	return
+}
+
+// The blobs to use out of the results
+func blobsOf(results map[string][]*BlobResult) (blobs map[string][]*blobstore.BlobInfo) {
+	blobs = make(map[string][]*blobstore.BlobInfo, len(results))
+	for keyName, resultSlice := range results {
+		blobSlice := make([]*blobstore.BlobInfo, 0, len(resultSlice))
+		for _, result := range resultSlice {
+			// Rejected by the moderator and deleted
+			if result.Blob != nil {
+				blobSlice = append(blobSlice, result.Blob)
+			}
+			// The images of an archive in its place
+			for _, unpacked := range result.Unpacked {
+				if unpacked.Blob != nil {
+					blobSlice = append(blobSlice, unpacked.Blob)
+				}
+			}
+		}
+		blobs[keyName] = blobSlice
+	}
+	return
 }
 
 /*
- * Create new set of options.
+ * Same as ParseBlobs but returns a result for every blob.
  *
- *      - Sets Quality to 75 as default. 75 is highly compressed but not visually noticable.
- *      - Sets Size to 0 which means that no changes to images dimensions will be made.
- *      - Creates new App Engine context.
+ *      - The results tell the sizes of the blobs before and after optimization.
+ *      - In dry-run mode the blobs are the unchanged originals and the sizes are projections.
+ *      - Blobs that failed to optimize are kept as-is and carry the reason in Err.
+ *      - Blobs rejected by the Moderator are deleted, Blob is nil and Err a *RejectedError.
+ *      - So are blobs over MaxUploadBytes, Err is a *TooLargeError.
+ *      - So are images under the minimum dimensions or outside the aspect ratio range, Err is an *InvalidImageError.
+ *      - In strict mode a *BlobError is returned if any of the blobs failed, with the results of all of them.
  */
-func NewCompressionOptions(r *http.Request) *compressionOptions {
-	return &compressionOptions{
-		Quality: 75, // Same as JPEG default quality
-		Size:    0,  // 0 = do not resize, otherwise this is the maximum dimension
-		Request: r,
-		Context: appengine.NewContext(r),
+func ParseBlobResults(options *CompressionOptions) (results map[string][]*BlobResult, other url.Values, err error) {
+	// Options may have been put together by hand
+	if options.Context == nil {
+		options.Context = appengine.NewContext(options.Request)
+	}
+	blobs, other, err := blobstore.ParseUpload(options.Request)
+	if err != nil {
+		return
+	}
+	options = options.withOverrides(other)
+	results = handleBlobs(options, blobs, other)
+	// Strict mode fails the whole request if any of the blobs failed
+	if options.Strict {
+		err = firstBlobError(results)
 	}
+	return
 }
 
 /*
- * This one does the magic.
+ * Optimizes a blob already in the storage, e.g. one uploaded before using this package.
  *
- *      - Gets the uploaded blobs by calling blobstore.ParseUpload()
- *      - Maintains all other values that come from blobstore.
- *      - Hands out the results for further processing.
+ *      - The new BlobInfo is in result.Blob, the old blob is deleted unless KeepOriginal.
+ *      - Blobs that are not images are left untouched.
+ *      - Nil options use the defaults.
  */
-func ParseBlobs(options *compressionOptions) (blobs map[string][]*blobstore.BlobInfo, other url.Values, err error) {
-	blobs, other, err = blobstore.ParseUpload(options.Request)
+func OptimizeExisting(ctx context.Context, key appengine.BlobKey, options *CompressionOptions) (result *BlobResult, err error) {
+	if options == nil {
+		options = defaultOptions()
+	}
+	// Work on a copy as the context is for this blob only
+	blobOptions := *options
+	blobOptions.Context = ctx
+	blob, err := blobOptions.storage().Stat(ctx, key)
 	if err != nil {
 		return
 	}
-	// Loop through all the blob names
-	for keyName, blobSlice := range blobs {
-		blobs[keyName] = handleBlobSlice(options, blobSlice)
-	}
+	result = handleBlob(&blobOptions, blob)
+	err = result.Err
 	return
 }
 
 /*
- * Handles blob slices and returns the replaced set of blobs.
+ * Handles the blobs of all the fields and returns the results in the same order.
+ *
+ *      - Up to options.Concurrency blobs are handled at a time, one by one by default.
+ *      - The blobs of each field are handled with the options of the field, if any.
+ *      - Uploads over MaxUploadBytes are deleted before anything else, also of the fields left untouched.
+ *      - The uploads opted out by the form in OptOutField are left untouched.
+ *      - The crop rectangles of the blobs are read from the other form values.
+ *      - Once the request is cancelled or its deadline exceeded
+ *        the remaining blobs are returned untouched with the error attached.
+ *      - Once less than TimeBudget is left of the deadline the remaining blobs
+ *        are queued to Overflow, or returned untouched and Skipped.
+ *      - In deferred mode the blobs are queued and returned untouched.
  */
-func handleBlobSlice(options *compressionOptions, blobSliceOriginal []*blobstore.BlobInfo) (blobSlice []*blobstore.BlobInfo) {
-	blobSlice = blobSliceOriginal
-	// Loop through all the blobs in the slice
-	for index, blobInfo := range blobSlice {
-		blobSlice[index] = handleBlob(options, blobInfo)
+func handleBlobs(options *CompressionOptions, blobs map[string][]*blobstore.BlobInfo, other url.Values) (results map[string][]*BlobResult) {
+	results = make(map[string][]*BlobResult, len(blobs))
+	workers := make(chan struct{}, options.concurrency())
+	var wg sync.WaitGroup
+	// Loop through all the blob names
+	for keyName, blobSlice := range blobs {
+		resultSlice := make([]*BlobResult, len(blobSlice))
+		results[keyName] = resultSlice
+		fieldOptions := options.forField(keyName)
+		// Loop through all the blobs in the slice
+		for index, blobInfo := range blobSlice {
+			// Not worth keeping at all
+			sizeOptions := fieldOptions
+			if sizeOptions == nil {
+				sizeOptions = options
+			}
+			if result := refuseTooLarge(sizeOptions, keyName, blobInfo); result != nil {
+				resultSlice[index] = result
+				continue
+			}
+			// Field left untouched
+			if fieldOptions == nil {
+				resultSlice[index] = newBlobResult(blobInfo)
+				continue
+			}
+			// Opted out by the form
+			if options.optedOut(other, keyName) {
+				options.logger().Debugf(options.Context, "optimg: blob %s: opted out in %s, left as it is", blobInfo.BlobKey, options.OptOutField)
+				resultSlice[index] = newBlobResult(blobInfo)
+				describeBlob(options, resultSlice[index])
+				continue
+			}
+			blobOptions, err := fieldOptions.forBlob(other, index)
+			if err != nil {
+				resultSlice[index] = newBlobResult(blobInfo)
+				resultSlice[index].Err = err
+				continue
+			}
+			workers <- struct{}{}
+			wg.Add(1)
+			go func(index int, blobInfo *blobstore.BlobInfo) {
+				defer wg.Done()
+				resultSlice[index] = handleUpload(blobOptions, blobInfo)
+				<-workers
+			}(index, blobInfo)
+		}
 	}
+	wg.Wait()
 	return
 }
 
+// Handles a single uploaded blob
+func handleUpload(options *CompressionOptions, blob *blobstore.BlobInfo) (result *BlobResult) {
+	if options.Deferred != nil {
+		return options.Deferred.enqueue(options, blob)
+	}
+	if err := checkDeadline(options); err != nil {
+		result = newBlobResult(blob)
+		result.Err = err
+		return
+	}
+	// Better left for later than cut off mid-encode
+	if shortOfTime(options) {
+		if options.Overflow != nil {
+			options.logger().Infof(options.Context, "optimg: blob %s: short of time, queued", blob.BlobKey)
+			return options.Overflow.enqueue(options, blob)
+		}
+		options.logger().Warningf(options.Context, "optimg: blob %s: short of time, left as it is", blob.BlobKey)
+		result = newBlobResult(blob)
+		result.Skipped = true
+		return
+	}
+	return handleBlob(options, blob)
+}
+
 /*
  * Handles individual blobs.
  *
  *      - Only supported image types will be processed. Others will be returned as-is.
- *      - Resizes the image if necessary.
- *      - Writes the new compressed JPEG to blobstore.
- *      - Deletes the old blob and substitutes the old BlobInfo with the new one.
+ *      - The type is told by the content, e.g. a JPEG uploaded as application/octet-stream is processed.
+ *      - Unpacks ZIP archives if asked to, each image in them is stored as a blob of its own.
+ *      - Runs the image through the same pipeline as Optimize().
+ *      - Writes the variants of the image.
+ *      - Gives up before encoding if the request has been cancelled.
+ *      - Writes the new compressed image to the storage in the output format.
+ *      - Keeps the original if the new image would not be smaller, unless resized, transformed or watermarked (SkipLarger).
+ *      - Makes the new image fit in MaxOutputBytes.
+ *      - Any failure leaves the original in place and is reported in the result.
+ *      - BeforeOptimize can skip the blob, AfterOptimize is called once it has been optimized.
+ *      - Blobs optimized before are left alone with SkipOptimized, unless by an older Version.
+ *      - The optimized blob is recorded in the ledger if asked to.
+ *      - Gets the serving URL of the blob if asked to.
  */
-func handleBlob(options *compressionOptions, blobOriginal *blobstore.BlobInfo) (blob *blobstore.BlobInfo) {
-	blob = blobOriginal
+func handleBlob(options *CompressionOptions, blob *blobstore.BlobInfo) (result *BlobResult) {
+	result = newBlobResult(blob)
+	start := time.Now()
+	// The phases and storage calls of the blob are traced under its span
+	ctx, span := startSpan(options.Context, "optimg.Blob", attribute.String("optimg.blob_key", string(blob.BlobKey)))
+	blobOptions := *options
+	blobOptions.Context = ctx
+	options = &blobOptions
+	defer func() {
+		result.Elapsed = time.Since(start)
+		if result.Err != nil {
+			options.logger().Warningf(options.Context, "optimg: blob %s: %v", blob.BlobKey, result.Err)
+		}
+		endReportSpan(span, result.Report, result.Err)
+	}()
+	// The app may want to leave it alone
+	if options.BeforeOptimize != nil && !options.BeforeOptimize(blob) {
+		options.logger().Debugf(options.Context, "optimg: blob %s: skipped by BeforeOptimize", blob.BlobKey)
+		describeBlob(options, result)
+		return
+	}
+	// Compressing it again would only lose quality
+	if alreadyOptimized(options, blob.BlobKey) {
+		options.logger().Debugf(options.Context, "optimg: blob %s: optimized before, left as it is", blob.BlobKey)
+		result.Optimized = true
+		describeBlob(options, result)
+		return
+	}
 	// Check that the blob is of supported mime-type
-	if !validateMimeType(blob) {
+	head, err := readHead(options, blob)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	// Archives are unpacked into blobs of their own
+	if options.UnpackZip && isZip(head) {
+		unpackZip(options, result)
+		return
+	}
+	// PDFs are not images, but get a preview with a renderer plugged in
+	if isPDF(head) && validatePDF(options, blob.ContentType) {
+		data, err := readBlob(options, blob)
+		if err != nil {
+			result.Err = err
+			return
+		}
+		handleDocument(options, result, data)
+		return
+	}
+	if sniffed := detectContentType(head); !validateMimeType(options, sniffed, blob.ContentType) {
+		options.logger().Debugf(options.Context, "optimg: blob %s: %s is not optimized, left as it is", blob.BlobKey, sniffed)
+		return
+	} else if sniffed == string(FormatSVG) && !options.RasterizeSVG {
+		handleSVG(options, result)
+		return
+	}
+	// Read the blob
+	endDecode := options.startPhase(ctx, blob.BlobKey, PhaseDecode)
+	data, err := readBlob(options, blob)
+	// Documents are kept as they are
+	if err == nil && isMultiPageTIFF(data) {
+		endDecode(int64(len(data)), nil)
+		handleDocument(options, result, data)
 		return
 	}
-	// Instantiate blobstore reader
-	reader := blobstore.NewReader(options.Context, blob.BlobKey)
-	// Instantiate the image object
-	img, _, err := image.Decode(reader)
+	// The pixels are left alone unless to be resized
+	if err == nil && options.Lossless {
+		if size_x, size_y, resize, err := losslessSize(data, options); err == nil && !resize {
+			endDecode(int64(len(data)), nil)
+			handleLossless(options, result, data, size_x, size_y)
+			return
+		}
+	}
+	var dec *decodedImage
+	if err == nil {
+		// Instantiate the image object
+		dec, err = decodeImage(data, options)
+	}
+	endDecode(int64(len(data)), err)
 	if err != nil {
+		result.Err = err
+		// Nothing gets stored of an image not meeting the requirements
+		if isRejected(err) && !options.DryRun {
+			result.DeleteErr = deleteBlob(options, blob.BlobKey)
+			result.Blob = nil
+		}
+		return
+	}
+	result.decoded(Format(detectContentType(data)), dec)
+	// Nothing gets stored of a rejected image
+	if err := moderate(options.Context, options, dec.img); err != nil {
+		result.Err = err
+		if isRejected(err) && !options.DryRun {
+			result.DeleteErr = deleteBlob(options, blob.BlobKey)
+			result.Blob = nil
+		}
 		return
 	}
+	options = options.detectFaces(options.Context, dec.img)
+	// Variants are made out of the upright image
+	if len(options.Variants) > 0 && !dec.animated() {
+		handleVariants(options, result, dec.img, dec.metadata)
+	}
 	// Resize if necessary
-	// Maintain aspect ratio!
-	if options.Size > 0 && (img.Bounds().Max.X > options.Size || img.Bounds().Max.Y > options.Size) {
-		size_x := img.Bounds().Max.X
-		size_y := img.Bounds().Max.Y
-		if size_x > options.Size {
-			size_x_before := size_x
-			size_x = options.Size
-			size_y = int(math.Floor(float64(size_y) * float64(float64(size_x)/float64(size_x_before))))
-		}
-		if size_y > options.Size {
-			size_y_before := size_y
-			size_y = options.Size
-			size_x = int(math.Floor(float64(size_x) * float64(float64(size_y)/float64(size_y_before))))
-		}
-		img = resize.Resize(img, img.Bounds(), size_x, size_y)
-	}
-	// JPEG options
-	o := &jpeg.Options{
-		Quality: options.Quality,
+	endResize := options.startPhase(ctx, blob.BlobKey, PhaseResize)
+	out, err := processImage(dec, options)
+	endResize(0, err)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	if out == nil {
+		result.summarize(options, dec.img)
+		options.logger().Debugf(options.Context, "optimg: blob %s: animation left as it is", blob.BlobKey)
+		return
+	}
+	result.summarize(options, out.img)
+	// Do not start encoding for a request that is already gone
+	if err := checkDeadline(options); err != nil {
+		result.Err = err
+		return
+	}
+	endEncode := options.startPhase(ctx, blob.BlobKey, PhaseEncode)
+	encodeFn, size, err := out.encoder(options, result.OriginalSize)
+	endEncode(size, err)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	// Keep the original if re-encoding does not pay off
+	if encodeFn == nil {
+		if size > 0 {
+			options.logger().Infof(options.Context, "optimg: blob %s: re-encoded to %d bytes, too little saved, the original is kept", blob.BlobKey, size)
+		} else {
+			options.logger().Infof(options.Context, "optimg: blob %s: JPEG of quality %d already, the original is kept", blob.BlobKey, result.InputQuality)
+		}
+		result.NoSavings = true
+		markOptimized(options, blob.BlobKey)
+		indexSimilar(options, result)
+		setServingURL(options, result)
+		afterOptimize(options, result)
+		return
+	}
+	writeBlob(options, result, out.format, encodeFn)
+	if result.Err == nil {
+		result.encoded(out)
+		options.logger().Infof(options.Context, "optimg: blob %s: %d bytes to %d, %s %dx%d", blob.BlobKey, result.OriginalSize, result.Size, result.Format, result.Width, result.Height)
+		markOptimized(options, result.Blob.BlobKey)
+		indexSimilar(options, result)
+		if options.Ledger && !options.DryRun {
+			recordLedger(options, result)
+		}
+		setServingURL(options, result)
+		afterOptimize(options, result)
+	}
+	return
+}
+
+// Tells the app about the optimized blob
+func afterOptimize(options *CompressionOptions, result *BlobResult) {
+	if options.AfterOptimize != nil {
+		options.AfterOptimize(result.Original, result.Blob, result.Report)
+	}
+}
+
+// Reads the whole blob from the storage, refusing blobs over the maximum number of bytes
+func readBlob(options *CompressionOptions, blob *blobstore.BlobInfo) ([]byte, error) {
+	if options.MaxBytes > 0 && blob.Size > options.MaxBytes {
+		return nil, ErrTooManyBytes
+	}
+	reader, err := options.storage().Open(options.Context, blob.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	return readImage(reader, options)
+}
+
+/*
+ * Resizes the image to fit in the maximum size.
+ * Images within the limits are returned as-is unless an exact fit mode is used.
+ * Resized images are sharpened if asked to.
+ */
+func resizeImage(options *CompressionOptions, img image.Image) image.Image {
+	if options.Fit != FitInside {
+		if size_x, size_y := options.maxWidth(), options.maxHeight(); size_x > 0 && size_y > 0 {
+			return sharpenImage(options.Sharpen, fitExact(options, img, size_x, size_y))
+		}
+	}
+	size_x, size_y, ok := fitSize(options, img.Bounds().Dx(), img.Bounds().Dy())
+	if !ok {
+		return img
+	}
+	return sharpenImage(options.Sharpen, scaleImage(options, img, img.Bounds(), size_x, size_y))
+}
+
+/*
+ * Calculates the dimensions that fit in the maximum size.
+ * Maintains aspect ratio! Returns false if no resizing is needed.
+ * Smaller images are scaled up with AllowUpscale.
+ */
+func fitSize(options *CompressionOptions, size_x, size_y int) (int, int, bool) {
+	if up_x, up_y, ok := upscaleSize(options, size_x, size_y); ok {
+		return up_x, up_y, true
+	}
+	max_x, max_y := options.maxWidth(), options.maxHeight()
+	if (max_x <= 0 || size_x <= max_x) && (max_y <= 0 || size_y <= max_y) {
+		return size_x, size_y, false
+	}
+	if max_x > 0 && size_x > max_x {
+		size_x_before := size_x
+		size_x = max_x
+		size_y = int(math.Floor(float64(size_y) * float64(float64(size_x)/float64(size_x_before))))
+	}
+	if max_y > 0 && size_y > max_y {
+		size_y_before := size_y
+		size_y = max_y
+		size_x = int(math.Floor(float64(size_x) * float64(float64(size_y)/float64(size_y_before))))
+	}
+	return size_x, size_y, true
+}
+
+/*
+ * Calculates the dimensions an undersized image is scaled up to.
+ *
+ *      - Up to MinSize for the larger dimension, or to fit the maximum size if MinSize is not set.
+ *      - Never beyond the maximum size. Maintains aspect ratio!
+ *      - Returns false unless AllowUpscale is set and the image is smaller than that.
+ */
+func upscaleSize(options *CompressionOptions, size_x, size_y int) (int, int, bool) {
+	if !options.AllowUpscale || size_x <= 0 || size_y <= 0 {
+		return size_x, size_y, false
 	}
+	max_x, max_y := options.maxWidth(), options.maxHeight()
+	scale := math.Inf(1)
+	if options.MinSize > 0 {
+		scale = float64(options.MinSize) / math.Max(float64(size_x), float64(size_y))
+	}
+	if max_x > 0 {
+		scale = math.Min(scale, float64(max_x)/float64(size_x))
+	}
+	if max_y > 0 {
+		scale = math.Min(scale, float64(max_y)/float64(size_y))
+	}
+	if math.IsInf(scale, 1) || scale <= 1 {
+		return size_x, size_y, false
+	}
+	up_x := int(math.Floor(float64(size_x)*scale + 0.5))
+	up_y := int(math.Floor(float64(size_y)*scale + 0.5))
+	if up_x <= size_x && up_y <= size_y {
+		return size_x, size_y, false
+	}
+	return up_x, up_y, true
+}
+
+/*
+ * Writes the encoded image to the storage and puts it in the result.
+ *
+ *      - Deletes the old blob (unless KeepOriginal) and substitutes the old BlobInfo with the new one.
+ *      - The old blob is deleted only once the new one has been written and verified.
+ *      - OnKeyReplaced is called before deleting, if it fails the new blob is deleted instead.
+ *      - Failing to delete the old blob is put in DeleteErr, the new blob is in use regardless.
+ *      - In dry-run mode only the size of the encoded image is measured.
+ */
+func writeBlob(options *CompressionOptions, result *BlobResult, format Format, encodeFn func(io.Writer) error) {
+	endWrite := options.startPhase(options.Context, result.Original.BlobKey, PhaseWrite)
+	newBlobInfo, size, reused, err := createBlob(options, format, encodeFn)
+	endWrite(size, err)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	result.Size = size
+	result.Format = format
+	result.Deduplicated = reused
+	// Dry-run leaves the original in place
+	if options.DryRun {
+		return
+	}
+	// Tracked until in use, in case the request dies halfway
+	track := options.Ledger && !reused
+	if track {
+		recordPending(options, result, newBlobInfo.BlobKey)
+	}
+	// The app gets to point its references to the new blob first
+	if options.OnKeyReplaced != nil {
+		if err := options.OnKeyReplaced(options.Context, result.Original.BlobKey, newBlobInfo.BlobKey); err != nil {
+			// A deduplicated blob in use elsewhere is only let go of
+			_ = deleteBlob(options, newBlobInfo.BlobKey)
+			if track {
+				removePending(options, newBlobInfo.BlobKey)
+			}
+			result.Size = result.OriginalSize
+			result.Format = result.OriginalFormat
+			result.Err = err
+			return
+		}
+	}
+	// All good!
+	// Now replace the old blob and delete it unless asked to keep it (or it is the same one)
+	result.Blob = newBlobInfo
+	if !options.KeepOriginal && newBlobInfo.BlobKey != result.Original.BlobKey {
+		result.DeleteErr = deleteBlob(options, result.Original.BlobKey)
+	} else if reused && newBlobInfo.BlobKey == result.Original.BlobKey {
+		// Counted once already
+		_, _ = releaseBlob(options, newBlobInfo.BlobKey)
+	}
+}
+
+/*
+ * Writes the encoded image to a new blob.
+ *
+ *      - Returns the BlobInfo and size of the new blob.
+ *      - In dry-run mode nothing is written and only the size is returned.
+ *      - With Deduplicate an existing blob of the same content is returned instead, reused tells.
+ */
+func createBlob(options *CompressionOptions, format Format, encodeFn func(io.Writer) error) (newBlobInfo *blobstore.BlobInfo, size int64, reused bool, err error) {
+	// Dry-run only measures the output
+	if options.DryRun {
+		counter := &byteCounter{}
+		if err = encodeFn(counter); err != nil {
+			return
+		}
+		size = counter.n
+		return
+	}
+	if options.Deduplicate {
+		return createUniqueBlob(options, format, encodeFn)
+	}
+	newBlobInfo, err = writeNewBlob(options, format, encodeFn)
+	if err != nil {
+		return
+	}
+	size = newBlobInfo.Size
+	return
+}
+
+/*
+ * Writes the encoded image to a new blob in the storage.
+ *
+ *      - The blob is verified to hold all of the encoded bytes.
+ *      - Whatever got written is deleted if any of the steps fails.
+ */
+func writeNewBlob(options *CompressionOptions, format Format, encodeFn func(io.Writer) error) (newBlobInfo *blobstore.BlobInfo, err error) {
 	// Open writer
-	writer, err := blobstore.Create(options.Context, "image/jpeg")
+	writer, err := options.storage().Create(options.Context, string(format))
 	if err != nil {
 		return
 	}
-	// Write to blobstore
-	if err := jpeg.Encode(writer, img, o); err != nil {
-		_ = writer.Close()
+	// Write to the storage
+	counter := &byteCounter{w: writer}
+	if err = encodeFn(counter); err != nil {
+		discardBlob(options, writer)
 		return
 	}
 	// Close writer
-	if err := writer.Close(); err != nil {
+	if err = writer.Close(); err != nil {
+		discardBlob(options, writer)
 		return
 	}
 	// Get key
@@ -178,24 +633,134 @@ func handleBlob(options *compressionOptions, blobOriginal *blobstore.BlobInfo) (
 		return
 	}
 	// Get new BlobInfo
-	newBlobInfo, err := blobstore.Stat(options.Context, newKey)
+	newBlobInfo, err = options.storage().Stat(options.Context, newKey)
+	if err == nil && newBlobInfo.Size != counter.n {
+		err = ErrBlobMismatch
+	}
 	if err != nil {
-		return
+		newBlobInfo = nil
+		_ = deleteBlob(options, newKey)
 	}
-	// All good!
-	// Now replace the old blob and delete it
-	deleteOldBlob(options, blob.BlobKey)
-	blob = newBlobInfo
 	return
 }
 
-// Validates blob mime-type
-func validateMimeType(blob *blobstore.BlobInfo) bool {
-	mimeType := strings.ToLower(blob.ContentType)
-	return allowedMimeTypes[mimeType]
+// Removes a partially written blob, if it got a key
+func discardBlob(options *CompressionOptions, writer BlobWriter) {
+	_ = writer.Close()
+	if key, err := writer.Key(); err == nil {
+		_ = deleteBlob(options, key)
+	}
+}
+
+// Tells by the first bytes of the blob whether it is of supported mime-type
+func sniffBlob(options *CompressionOptions, blob *blobstore.BlobInfo) (bool, error) {
+	head, err := readHead(options, blob)
+	if err != nil {
+		return false, err
+	}
+	if isPDF(head) {
+		return validatePDF(options, blob.ContentType), nil
+	}
+	return validateMimeType(options, detectContentType(head), blob.ContentType), nil
+}
+
+// Reads the first bytes of the blob, enough to tell the type
+func readHead(options *CompressionOptions, blob *blobstore.BlobInfo) ([]byte, error) {
+	reader, err := options.storage().Open(options.Context, blob.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+/*
+ * Validates the mime-type sniffed from the content.
+ * The skipped mime-types are never touched, whether sniffed or declared in the upload.
+ */
+func validateMimeType(options *CompressionOptions, sniffed, declared string) bool {
+	sniffed, declared = strings.ToLower(sniffed), strings.ToLower(declared)
+	// Not decodable without a decoder plugged in
+	if isHEIFType(sniffed) && options.HEICDecoder == nil {
+		return false
+	}
+	return listedMimeType(options, sniffed, declared, allowedMimeTypes[sniffed])
 }
 
-// Removes the old blob from blobstore
-func deleteOldBlob(options *compressionOptions, blobkey appengine.BlobKey) {
-	_ = blobstore.Delete(options.Context, blobkey)
+// Tells whether the mime-type is not in SkipMimeTypes and is in AllowedMimeTypes, or allowed by default if nil
+func listedMimeType(options *CompressionOptions, sniffed, declared string, byDefault bool) bool {
+	for _, mimeType := range options.SkipMimeTypes {
+		if mimeType = strings.ToLower(mimeType); mimeType == sniffed || mimeType == declared {
+			return false
+		}
+	}
+	if options.AllowedMimeTypes == nil {
+		return byDefault
+	}
+	for _, mimeType := range options.AllowedMimeTypes {
+		if strings.ToLower(mimeType) == sniffed {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells whether the request has been cancelled or its deadline exceeded
+func checkDeadline(options *CompressionOptions) error {
+	return options.Context.Err()
+}
+
+// Tells whether less than the time budget of a blob is left of the request deadline
+func shortOfTime(options *CompressionOptions) bool {
+	if options.TimeBudget <= 0 || options.Deterministic {
+		return false
+	}
+	deadline, ok := options.Context.Deadline()
+	return ok && time.Until(deadline) < options.TimeBudget
+}
+
+/*
+ * Removes a blob from the storage, logging if it could not be removed.
+ * With Deduplicate a blob other uploads still use is left in place.
+ */
+func deleteBlob(options *CompressionOptions, blobkey appengine.BlobKey) error {
+	if options.Deduplicate && !options.DryRun {
+		shared, err := releaseBlob(options, blobkey)
+		if err != nil {
+			options.logger().Errorf(options.Context, "optimg: releasing blob %s: %v", blobkey, err)
+			return err
+		}
+		if shared {
+			return nil
+		}
+	}
+	endDelete := options.startPhase(options.Context, blobkey, PhaseDelete)
+	err := options.storage().Delete(options.Context, blobkey)
+	endDelete(0, err)
+	if err != nil {
+		options.logger().Errorf(options.Context, "optimg: deleting blob %s: %v", blobkey, err)
+		return err
+	}
+	unmarkOptimized(options, blobkey)
+	unindexSimilar(options, blobkey)
+	return nil
+}
+
+// Counts the bytes written to it, passing them on to w if set
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if c.w != nil {
+		n, err = c.w.Write(p)
+	}
+	c.n += int64(n)
+	return
 }
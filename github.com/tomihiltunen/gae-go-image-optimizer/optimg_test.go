@@ -0,0 +1,113 @@
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/url"
+	"testing"
+
+	// App Engine packages
+	"google.golang.org/appengine/blobstore"
+)
+
+// Logger dropping everything, the App Engine log needs an App Engine context
+type nopLogger struct{}
+
+func (nopLogger) Debugf(c context.Context, format string, args ...interface{})   {}
+func (nopLogger) Infof(c context.Context, format string, args ...interface{})    {}
+func (nopLogger) Warningf(c context.Context, format string, args ...interface{}) {}
+func (nopLogger) Errorf(c context.Context, format string, args ...interface{})   {}
+
+// Options for the tests, the blobs are kept in memory and nothing touches the datastore
+func testOptions(c context.Context, storage *MemoryStorage, opts ...Option) *CompressionOptions {
+	options := defaultOptions()
+	options.Context = c
+	options.Storage = storage
+	options.Logger = nopLogger{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// A gradient with some texture, so the encoders have something to compress
+func testImage(size_x, size_y int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size_x, size_y))
+	for y := 0; y < size_y; y++ {
+		for x := 0; x < size_x; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / size_x), uint8(y * 255 / size_y), uint8(96 + (x*31+y*17)%64), 255})
+		}
+	}
+	return img
+}
+
+// Encodes the image as a JPEG of the quality
+func testJPEG(t testing.TB, img image.Image, quality int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleBlobsStopsOnceCancelled(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	storage := &MemoryStorage{}
+	data := testJPEG(t, testImage(64, 48), 95)
+	blobs := []*blobstore.BlobInfo{
+		storage.Put("image/jpeg", "a.jpg", data),
+		storage.Put("image/jpeg", "b.jpg", data),
+		storage.Put("image/jpeg", "c.jpg", data),
+	}
+	seen := 0
+	options := testOptions(c, storage, WithBeforeOptimize(func(blob *blobstore.BlobInfo) bool {
+		seen++
+		// The request goes away while the first blob is handled
+		cancel()
+		return false
+	}))
+	results := handleBlobs(options, map[string][]*blobstore.BlobInfo{"photo": blobs}, url.Values{})
+	if seen != 1 {
+		t.Fatalf("%d blobs handled, want 1", seen)
+	}
+	if err := results["photo"][0].Err; err != nil {
+		t.Errorf("first blob: %v, want no error", err)
+	}
+	for _, result := range results["photo"][1:] {
+		if result.Err != context.Canceled {
+			t.Errorf("blob %s: %v, want %v", result.Original.BlobKey, result.Err, context.Canceled)
+		}
+		if result.Blob != result.Original || storage.Get(result.Original.BlobKey) == nil {
+			t.Errorf("blob %s: not left as it is", result.Original.BlobKey)
+		}
+	}
+}
+
+func TestHandleBlobPDFMimeTypes(t *testing.T) {
+	storage := &MemoryStorage{}
+	pdf := storage.Put("application/pdf", "a.pdf", []byte("%PDF-1.4\n%%EOF\n"))
+	rendered := 0
+	renderer := func(r io.Reader, width, height int) (image.Image, error) {
+		rendered++
+		return testImage(64, 48), nil
+	}
+	for _, opt := range []Option{WithSkipMimeTypes("application/pdf"), WithAllowedMimeTypes("image/jpeg")} {
+		result := handleBlob(testOptions(context.Background(), storage, WithPDFRenderer(renderer), opt), pdf)
+		if result.Preview != nil || result.Err != nil {
+			t.Errorf("preview %v (%v), want the PDF left as it is", result.Preview, result.Err)
+		}
+	}
+	if rendered != 0 {
+		t.Errorf("rendered %d times, want none", rendered)
+	}
+	result := handleBlob(testOptions(context.Background(), storage, WithPDFRenderer(renderer)), pdf)
+	if rendered != 1 || result.Preview == nil || result.Preview.Err != nil {
+		t.Errorf("rendered %d times with preview %+v, want one", rendered, result.Preview)
+	}
+}
@@ -0,0 +1,94 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimgtest
+
+import (
+	// Go packages
+	"bytes"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	// Image formats the optimizer may produce
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	// The optimizer
+	optimg "github.com/tomihiltunen/gae-go-image-optimizer"
+)
+
+// Environment variable rewriting the golden files with the output, e.g. OPTIMGTEST_UPDATE=1 go test
+const UpdateEnv = "OPTIMGTEST_UPDATE"
+
+/*
+ * Compares the image data against the golden file within a perceptual tolerance.
+ *
+ *      - The tolerance is how much the similarity may fall below 1, e.g. 0.02.
+ *      - The images must be of the same size.
+ *      - Rewrites the golden file instead if UpdateEnv is set.
+ *      - A missing golden file is an error unless UpdateEnv is set, a test never passes without comparing.
+ *      - Returns an error telling how the images differ.
+ */
+func CompareGolden(data []byte, path string, tolerance float64) error {
+	if os.Getenv(UpdateEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, data, 0644)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("optimgtest: no golden file %s, run with %s=1 to write it", path, UpdateEnv)
+	}
+	golden, err := decodeFile(path)
+	if err != nil {
+		return err
+	}
+	got, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("optimgtest: decoding the output: %v", err)
+	}
+	return Compare(got, golden, tolerance)
+}
+
+/*
+ * Compares two images within a perceptual tolerance, see CompareGolden.
+ */
+func Compare(got, want image.Image, tolerance float64) error {
+	if got.Bounds().Dx() != want.Bounds().Dx() || got.Bounds().Dy() != want.Bounds().Dy() {
+		return fmt.Errorf("optimgtest: image is %dx%d, want %dx%d",
+			got.Bounds().Dx(), got.Bounds().Dy(), want.Bounds().Dx(), want.Bounds().Dy())
+	}
+	if similarity := optimg.Similarity(got, want); similarity < 1-tolerance {
+		return fmt.Errorf("optimgtest: similarity %.4f is below %.4f", similarity, 1-tolerance)
+	}
+	return nil
+}
+
+// Decodes an image file
+func decodeFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("optimgtest: decoding %s: %v", path, err)
+	}
+	return img, nil
+}
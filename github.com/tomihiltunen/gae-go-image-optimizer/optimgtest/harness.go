@@ -0,0 +1,91 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimgtest
+
+import (
+	// Go packages
+	"context"
+	"io"
+	"net/http"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	// The optimizer
+	optimg "github.com/tomihiltunen/gae-go-image-optimizer"
+)
+
+/*
+ * Harness for testing code using the optimizer, e.g. calling ParseBlobs, without a running dev_appserver.
+ * Starts an aetest instance for the datastore, memcache and task queue; the blobs are kept in memory.
+ * Start one per test package (e.g. in TestMain), starting the instance takes seconds.
+ *
+ *      Instance    The aetest instance
+ *      Storage     The blobs, seed the uploads with Storage.Put
+ */
+type Harness struct {
+	Instance aetest.Instance
+	Storage  *optimg.MemoryStorage
+}
+
+/*
+ * Starts the aetest instance, with a strongly consistent datastore so the markers and ledger are seen at once.
+ */
+func NewHarness() (*Harness, error) {
+	instance, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Harness{
+		Instance: instance,
+		Storage:  &optimg.MemoryStorage{},
+	}, nil
+}
+
+/*
+ * Makes a request to the instance, its context can be used with the App Engine APIs.
+ */
+func (h *Harness) NewRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return h.Instance.NewRequest(method, url, body)
+}
+
+/*
+ * Gives a context of a new request to the instance.
+ */
+func (h *Harness) Context() (context.Context, error) {
+	r, err := h.Instance.NewRequest("GET", "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	return appengine.NewContext(r), nil
+}
+
+/*
+ * Gives the options for the request, storing the blobs in memory.
+ * Use a request from NewRequest, e.g. carrying an upload.
+ */
+func (h *Harness) Options(r *http.Request, opts ...optimg.Option) *optimg.CompressionOptions {
+	return optimg.New(r, append([]optimg.Option{optimg.WithStorage(h.Storage)}, opts...)...)
+}
+
+/*
+ * Stops the aetest instance.
+ */
+func (h *Harness) Close() error {
+	return h.Instance.Close()
+}
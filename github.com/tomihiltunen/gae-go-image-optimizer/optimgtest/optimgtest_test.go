@@ -0,0 +1,92 @@
+package optimgtest
+
+import (
+	// Go packages
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	// App Engine packages
+	"google.golang.org/appengine/blobstore"
+
+	// The optimizer
+	optimg "github.com/tomihiltunen/gae-go-image-optimizer"
+)
+
+// A small PNG of a single color
+func testPNG(t *testing.T, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompareGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optimgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "golden", "red.png")
+	red := testPNG(t, color.RGBA{255, 0, 0, 255})
+	os.Unsetenv(UpdateEnv)
+	// Never passes without a golden file to compare against
+	if err := CompareGolden(red, path, 0.02); err == nil {
+		t.Fatal("missing golden file passed")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("golden file written without " + UpdateEnv)
+	}
+	os.Setenv(UpdateEnv, "1")
+	err = CompareGolden(red, path, 0.02)
+	os.Unsetenv(UpdateEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompareGolden(red, path, 0.02); err != nil {
+		t.Errorf("same image: %v", err)
+	}
+	if err := CompareGolden(testPNG(t, color.RGBA{0, 0, 255, 255}), path, 0.02); err == nil {
+		t.Error("another image passed")
+	}
+}
+
+func TestNewUploadRequest(t *testing.T) {
+	storage := &optimg.MemoryStorage{}
+	data := testPNG(t, color.RGBA{255, 0, 0, 255})
+	r, err := NewUploadRequest(storage, "/upload", url.Values{"title": {"red"}}, Upload{
+		Field:    "photo",
+		Filename: "red.png",
+		Data:     data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, other, err := blobstore.ParseUpload(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs["photo"]) != 1 || other.Get("title") != "red" {
+		t.Fatalf("blobs %v and other values %v, want a photo and the title", blobs, other)
+	}
+	blob := blobs["photo"][0]
+	if blob.ContentType != "image/png" || blob.Filename != "red.png" || blob.Size != int64(len(data)) {
+		t.Errorf("blob %+v, want red.png of %d bytes", blob, len(data))
+	}
+	if !bytes.Equal(storage.Get(blob.BlobKey), data) {
+		t.Error("blob not in the storage")
+	}
+}
@@ -0,0 +1,129 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimgtest
+
+import (
+	// Go packages
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+
+	// The optimizer
+	optimg "github.com/tomihiltunen/gae-go-image-optimizer"
+)
+
+/*
+ * A file in a synthesized upload.
+ *
+ *      Field           Name of the form field
+ *      Filename        Name of the uploaded file
+ *      ContentType     Mime-type of the file, sniffed from the data if empty
+ *      Data            Contents of the file
+ */
+type Upload struct {
+	Field       string
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+/*
+ * Synthesizes the request blobstore makes to the upload handler, so blobstore.ParseUpload() and ParseBlobs() read it.
+ *
+ *      - The files are stored in the storage, the parts refer to them by their blob keys.
+ *      - The other form fields are sent as they are.
+ *      - Use the Harness method to get a request with an App Engine context.
+ */
+func NewUploadRequest(storage *optimg.MemoryStorage, target string, fields url.Values, uploads ...Upload) (*http.Request, error) {
+	body, contentType, err := uploadBody(storage, fields, uploads)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", target, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", contentType)
+	return r, nil
+}
+
+/*
+ * Synthesizes an upload request to the aetest instance, see NewUploadRequest.
+ */
+func (h *Harness) NewUploadRequest(target string, fields url.Values, uploads ...Upload) (*http.Request, error) {
+	body, contentType, err := uploadBody(h.Storage, fields, uploads)
+	if err != nil {
+		return nil, err
+	}
+	r, err := h.Instance.NewRequest("POST", target, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", contentType)
+	return r, nil
+}
+
+// Builds the multipart body of the upload
+func uploadBody(storage *optimg.MemoryStorage, fields url.Values, uploads []Upload) (io.Reader, string, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for name, values := range fields {
+		for _, value := range values {
+			// blobstore.ParseUpload() wants the type of every part, as App Engine sends it
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, name))
+			header.Set("Content-Type", "text/plain; charset=utf-8")
+			part, err := w.CreatePart(header)
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := io.WriteString(part, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	for _, upload := range uploads {
+		contentType := upload.ContentType
+		if contentType == "" {
+			contentType = http.DetectContentType(upload.Data)
+		}
+		info := storage.Put(contentType, upload.Filename, upload.Data)
+		// Blobstore replaces the file with a reference to the blob
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, upload.Field, upload.Filename))
+		header.Set("Content-Type", fmt.Sprintf(`message/external-body; blob-key="%s"`, info.BlobKey))
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		sum := md5.Sum(upload.Data)
+		fmt.Fprintf(part, "Content-Type: %s\r\n", contentType)
+		fmt.Fprintf(part, "Content-Length: %s\r\n", strconv.Itoa(len(upload.Data)))
+		fmt.Fprintf(part, "Content-MD5: %s\r\n", base64.URLEncoding.EncodeToString(sum[:]))
+		fmt.Fprintf(part, "X-AppEngine-Upload-Creation: %s\r\n", info.CreationTime.UTC().Format("2006-01-02 15:04:05.000000"))
+		fmt.Fprintf(part, "Content-Disposition: form-data; name=\"%s\"; filename=\"%s\"\r\n\r\n", upload.Field, upload.Filename)
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, w.FormDataContentType(), nil
+}
@@ -0,0 +1,987 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	aeimage "google.golang.org/appengine/image"
+)
+
+/*
+ * Default values for the options.
+ */
+const (
+	DefaultQuality = 75 // Same as JPEG default quality
+	DefaultSize    = 0  // 0 = do not resize
+
+	DefaultMaxPixels = 50000000 // 50 megapixels take 200MB of memory decoded
+	DefaultMaxBytes  = 32 << 20 // 32MB
+
+	DefaultFetchTimeout = 30 * time.Second // Time limit of fetching an image in OptimizeURL
+)
+
+/*
+ * The options for image optimization.
+ * Use New() to get the defaults or fill in your own.
+ *
+ *      Quality                 The quality of the output (0-100)
+ *      AutoQuality             Pick the lowest quality (up to Quality) with SSIM of at least this to the image, e.g. 0.98, 0 = off
+ *      JPEGQuality             Quality of JPEG output, 0 = Quality
+ *      WebPQuality             Quality of WebP output, 0 = Quality
+ *      WebPLossless            Write WebP output losslessly, the quality has no effect then
+ *      PNGCompression          zlib level of PNG output, e.g. png.BestCompression, png.DefaultCompression if zero
+ *      GIFColors               Palette size of GIF output (2-256), 0 = 256
+ *      Size                    Maximum dimension (width/height) for the photo, 0 = unlimited
+ *      MaxWidth                Maximum width for the photo, overrides Size for the width
+ *      MaxHeight               Maximum height for the photo, overrides Size for the height
+ *      AllowUpscale            Scale smaller images up to MinSize, or to fit the maximum dimensions if MinSize is 0
+ *      MinSize                 Dimension (width/height) smaller images are scaled up to with AllowUpscale
+ *      MinWidth                Narrower images are refused and deleted with an *InvalidImageError, 0 = any
+ *      MinHeight               Lower images are refused and deleted with an *InvalidImageError, 0 = any
+ *      MinAspect               Images narrower than this aspect ratio (width / height) are refused, 0 = any
+ *      MaxAspect               Images wider than this aspect ratio (width / height) are refused, 0 = any
+ *      MaxPixels               Images with more pixels are refused before decoding them, 0 = unlimited
+ *      MaxBytes                Images with more bytes are refused before reading them, 0 = unlimited
+ *      MaxUploadBytes          Uploads with more bytes are deleted at once and reported with a *TooLargeError, 0 = unlimited
+ *      FetchTimeout            Time limit of fetching an image in OptimizeURL, DefaultFetchTimeout if 0
+ *      AllowedMimeTypes        Mime-types to optimize, JPEG, PNG, GIF, WebP, BMP, TIFF, HEIC (with HEICDecoder) and SVG if nil
+ *      SkipMimeTypes           Mime-types never touched, e.g. "image/svg+xml", also by the uploaded Content-Type
+ *      HEICDecoder             Decodes HEICs and HEIFs, e.g. CommandDecoder; they are left as they are if nil
+ *      OptOutField             Form field opting uploads out, "1" for all or the fields to leave untouched, e.g. DefaultOptOutField; ignored if empty
+ *      Rotate                  Degrees to rotate the upright image clockwise, multiples of 90
+ *      Flip                    Mirror the upright image before rotating, FlipHorizontal and/or FlipVertical
+ *      Crop                    Area of the upright image to keep, after Rotate and Flip, empty = the whole image
+ *      CropField               Form field with the crop rectangle "x,y,w,h" of each uploaded file, e.g. from a JS cropper
+ *      OverrideSecret          Key the options tuned by the form in OverridesField are signed with, see SignOverrides; ignored if empty
+ *      Trim                    Crop away uniform borders before resizing, e.g. white backgrounds of product photos
+ *      TrimTolerance           How much (0-255 per channel) the border pixels may differ from the border color
+ *      Fit                     How the photo is fitted in the maximum dimensions, see FitMode
+ *      FaceDetector            Finds the faces CropSmart keeps in frame, e.g. VisionFaceDetector; none by default
+ *      Background              Color of the padding in Pad mode, transparent for PNG and WebP and white for others if nil
+ *      Filter                  Interpolation used for resizing, FilterLanczos3 by default
+ *      LinearLight             Resize in linear light instead of sRGB, keeps fine detail from darkening
+ *      Sharpen                 Unsharp mask applied to the resized images, none by default
+ *      Watermark               Image drawn on every optimized image, none by default
+ *      OnKeyReplaced           Called before the original is deleted, e.g. to update the references; an error keeps the original
+ *      Deduplicate             Reuse an existing optimized blob of the same content instead of writing a new one, deleted when no longer used
+ *      ServingURL              Get the Images API serving URL of each optimized blob with these options, e.g. Secure; nil = off
+ *      Ledger                  Record each optimized blob in the datastore, see LedgerEntry
+ *      SkipOptimized           Mark the optimized blobs in the datastore and leave the marked ones alone, see IsOptimized
+ *      Version                 Version of the settings stamped on the optimized blobs, bump it to re-optimize the older ones
+ *      BeforeOptimize          Called with each blob before optimizing it, return false to leave it untouched
+ *      AfterOptimize           Called with each optimized blob, old and new are the same if the original was kept
+ *      Logger                  Where the package tells what it did with each blob and why, App Engine logging if nil
+ *      Metrics                 Gets the time taken and bytes handled by each phase of each blob, e.g. for monitoring; none by default
+ *      Moderator               Checks the images before they are stored, rejected uploads are deleted; none by default
+ *      Transform               Custom processing of the decoded upright image before resizing, not for animations
+ *      Request                 The pointer for the HTTP request carrying the upload
+ *      Context                 App Engine context, created from Request if left nil
+ *      Storage                 Where the images are read from and written to, blobstore if left nil
+ *      Retry                   How failing storage calls are retried, e.g. transient blobstore RPC errors; nil = no retries
+ *      DryRun                  Run the optimization without touching the blobstore
+ *      Strict                  Fail the whole request if any of the images could not be optimized
+ *      KeepOriginal            Keep the uploaded blob in the blobstore next to the optimized one
+ *      OutputFormat            Format of the optimized images, FormatJPEG, FormatPNG, FormatWebP or a registered one
+ *      Progressive             Write progressive JPEGs, needs JPEGEncoder to be set, baseline otherwise
+ *      Subsampling             Chroma subsampling of JPEGs, other than 4:2:0 needs JPEGEncoder to be set
+ *      MaxOutputBytes          Lower the quality, and the dimensions if need be, until the output fits, 0 = unlimited
+ *      MinSavingsPercent       Keep the original unless the optimized image is at least this much smaller, e.g. 10, unless resized, transformed or watermarked
+ *      SkipLowQuality          Keep JPEGs of the quality or lower as they are, unless resized, transformed, watermarked, turned upright or converted to sRGB
+ *      SkipLarger              Keep the original if the optimized image would not be smaller, unless resized, transformed or watermarked;
+ *                              an original with metadata to strip is stripped losslessly instead
+ *      PreserveTransparency    Store transparent images as PNG instead of JPEG
+ *      AutoFormat              Store graphics (screenshots, diagrams) as PNG instead of JPEG, and as lossless WebP, photos as they are
+ *      PaletteColors           Paletted images using at most this many colors are kept as paletted PNG instead of JPEG, 0 = never
+ *      QuantizeColors          Map PNG output onto a palette of at most this many colors (2-256) picked by median cut, 0 = off
+ *      DetectGrayscale         Encode opaque images with no color in one channel, JPEG or PNG
+ *      Dither                  Dither when reducing 16-bit images to 8 bits and when mapping resized images onto their palette or quantizing them
+ *      OptimizeAnimations      Resize animated GIFs frame by frame, otherwise they are left untouched
+ *      DocumentPreviews        Write a preview image of the first page of multi-page TIFFs and PDFs (with PDFRenderer), the documents are kept as they are
+ *      PDFRenderer             Renders the first page of PDFs for their previews, PDFs are left as they are if nil
+ *      RasterizeSVG            Rasterize SVGs to PNG at the maximum size with SVGRasterizer, e.g. for thumbnails, otherwise they are sanitized only
+ *      SVGRasterizer           Rasterizes the SVGs with RasterizeSVG, they fail to optimize if nil
+ *      AutoRotate              Turn JPEGs upright according to their EXIF orientation
+ *      ConvertToSRGB           Convert images with an embedded ICC profile (e.g. AdobeRGB) to sRGB, the profile is stripped
+ *      EmbedSRGB               Embed a compact sRGB profile in JPEG output
+ *      KeepMetadata            EXIF fields to carry over to JPEG output, everything else is stripped
+ *      Lossless                Never change the pixels: strip the metadata and recompress losslessly (PNG, JPEGs with JPEGOptimizer),
+ *                              Crop, Rotate, Trim, Transform and Watermark are not applied
+ *      LosslessResize          Resize images over the maximum size in Lossless mode anyway, re-encoding them as usual
+ *      Deterministic           Byte-identical output for identical input and options: no timestamps in metadata, no TimeBudget
+ *      Variants                Extra sizes to write by name, e.g. {"thumb": 200, "medium": 800}
+ *      PlaceholderSize         Largest dimension of the blurred preview returned as a data URI in Report.Placeholder, 0 = none
+ *      BlurHash                Compute the BlurHash of each image into Report.BlurHash, for clients drawing their own placeholders
+ *      ExtractColors           Number of the main colors of each image returned in Report.Palette, e.g. for themed backgrounds, 0 = none
+ *      PerceptualHash          Compute the perceptual hash of each image into Report.PerceptualHash and index the blob for FindSimilar
+ *      UnpackZip               Unpack uploaded ZIP archives and store each image in them as a blob of its own, not in deferred mode; see BlobResult.Unpacked
+ *      Concurrency             Number of uploaded blobs optimized at a time, 0 = one at a time
+ *      Fields                  Options by form field name, nil options leave the field untouched; Request, Context and Storage come from here
+ *      Deferred                Optimize the uploads in a task queue task, ParseBlobs returns the originals
+ *      TimeBudget              Time left for each blob, blobs are not started with less of the request deadline left, 0 = off
+ *      Overflow                Deferred the blobs are queued to when short of time, they are returned untouched and Skipped if nil
+ */
+type CompressionOptions struct {
+	Quality              int
+	AutoQuality          float64
+	JPEGQuality          int
+	WebPQuality          int
+	WebPLossless         bool
+	PNGCompression       png.CompressionLevel
+	GIFColors            int
+	Size                 int
+	MaxWidth             int
+	MaxHeight            int
+	AllowUpscale         bool
+	MinSize              int
+	MinWidth             int
+	MinHeight            int
+	MinAspect            float64
+	MaxAspect            float64
+	MaxPixels            int64
+	MaxBytes             int64
+	MaxUploadBytes       int64
+	FetchTimeout         time.Duration
+	AllowedMimeTypes     []string
+	SkipMimeTypes        []string
+	HEICDecoder          HEICDecoder
+	OptOutField          string
+	Rotate               int
+	Flip                 Flip
+	Crop                 image.Rectangle
+	CropField            string
+	OverrideSecret       []byte
+	Trim                 bool
+	TrimTolerance        int
+	Fit                  FitMode
+	FaceDetector         FaceDetector
+	Background           color.Color
+	Filter               Filter
+	LinearLight          bool
+	Sharpen              UnsharpMask
+	Watermark            *Watermark
+	OnKeyReplaced        func(c context.Context, old, new appengine.BlobKey) error
+	Deduplicate          bool
+	ServingURL           *aeimage.ServingURLOptions
+	Ledger               bool
+	SkipOptimized        bool
+	Version              int
+	BeforeOptimize       func(blob *blobstore.BlobInfo) bool
+	AfterOptimize        func(old, new *blobstore.BlobInfo, report Report)
+	Logger               Logger
+	Metrics              Metrics
+	Moderator            Moderator
+	Transform            func(image.Image) (image.Image, error)
+	Request              *http.Request
+	Context              context.Context
+	Storage              Storage
+	Retry                *RetryPolicy
+	DryRun               bool
+	Strict               bool
+	KeepOriginal         bool
+	OutputFormat         Format
+	Progressive          bool
+	Subsampling          Subsampling
+	MaxOutputBytes       int64
+	MinSavingsPercent    int
+	SkipLowQuality       bool
+	SkipLarger           bool
+	PreserveTransparency bool
+	AutoFormat           bool
+	PaletteColors        int
+	QuantizeColors       int
+	DetectGrayscale      bool
+	Dither               bool
+	OptimizeAnimations   bool
+	DocumentPreviews     bool
+	PDFRenderer          PDFRenderer
+	RasterizeSVG         bool
+	SVGRasterizer        SVGRasterizer
+	AutoRotate           bool
+	ConvertToSRGB        bool
+	EmbedSRGB            bool
+	KeepMetadata         []MetadataField
+	Lossless             bool
+	LosslessResize       bool
+	Deterministic        bool
+	Variants             map[string]int
+	PlaceholderSize      int
+	BlurHash             bool
+	ExtractColors        int
+	PerceptualHash       bool
+	UnpackZip            bool
+	Concurrency          int
+	Fields               map[string]*CompressionOptions
+	Deferred             *Deferred
+	TimeBudget           time.Duration
+	Overflow             *Deferred
+
+	faces []image.Rectangle
+}
+
+/*
+ * Create new set of options.
+ *
+ *      - Sets Quality to 75 as default. 75 is highly compressed but not visually noticable.
+ *      - Sets Size to 0 which means that no changes to images dimensions will be made.
+ *      - Applies the given options on top of the defaults.
+ *      - Creates new App Engine context unless one was given.
+ */
+func New(r *http.Request, opts ...Option) *CompressionOptions {
+	options := defaultOptions()
+	options.Request = r
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.Context == nil {
+		options.Context = appengine.NewContext(r)
+	}
+	return options
+}
+
+// The default options without request and context
+func defaultOptions() *CompressionOptions {
+	return &CompressionOptions{
+		Quality:              DefaultQuality,
+		Size:                 DefaultSize, // 0 = do not resize, otherwise this is the maximum dimension
+		MaxPixels:            DefaultMaxPixels,
+		MaxBytes:             DefaultMaxBytes,
+		DryRun:               false, // true = only report the savings, blobstore is left untouched
+		Strict:               false, // true = return an error if any of the images failed
+		KeepOriginal:         false, // true = do not delete the uploaded blob
+		OutputFormat:         FormatJPEG,
+		SkipLowQuality:       true, // Each round of JPEG compression loses more
+		SkipLarger:           true, // Re-encoding a well compressed JPEG may grow it
+		PreserveTransparency: true, // JPEG has no alpha channel, keep transparent images as PNG
+		PaletteColors:        DefaultPaletteColors,
+		DetectGrayscale:      true, // A third of the size of scanned documents
+		OptimizeAnimations:   true, // false = pass animated GIFs through untouched
+		DocumentPreviews:     true, // false = keep multi-page TIFFs and PDFs without a preview
+		AutoRotate:           true, // EXIF is not written back so the pixels must be upright
+		ConvertToSRGB:        true, // Nor is the ICC profile so the colors must be sRGB
+	}
+}
+
+/*
+ * Create new set of options with the defaults.
+ *
+ * Deprecated: Use New(r) instead.
+ */
+func NewCompressionOptions(r *http.Request) *CompressionOptions {
+	return New(r)
+}
+
+// Maximum width, 0 = unlimited
+func (o *CompressionOptions) maxWidth() int {
+	if o.MaxWidth > 0 {
+		return o.MaxWidth
+	}
+	return o.Size
+}
+
+// Maximum height, 0 = unlimited
+func (o *CompressionOptions) maxHeight() int {
+	if o.MaxHeight > 0 {
+		return o.MaxHeight
+	}
+	return o.Size
+}
+
+// Number of blobs optimized at a time
+func (o *CompressionOptions) concurrency() int {
+	if o.Concurrency > 1 {
+		return o.Concurrency
+	}
+	return 1
+}
+
+// Time limit of fetching an image
+func (o *CompressionOptions) fetchTimeout() time.Duration {
+	if o.FetchTimeout > 0 {
+		return o.FetchTimeout
+	}
+	return DefaultFetchTimeout
+}
+
+/*
+ * Options for the blobs of the form field, nil to leave them untouched.
+ * Field options get the request, context and storage (unless their own) from these.
+ */
+func (o *CompressionOptions) forField(name string) *CompressionOptions {
+	fieldOptions, ok := o.Fields[name]
+	if !ok {
+		return o
+	}
+	if fieldOptions == nil {
+		return nil
+	}
+	copied := *fieldOptions
+	copied.Request = o.Request
+	copied.Context = o.Context
+	if copied.Storage == nil {
+		copied.Storage = o.Storage
+	}
+	copied.Fields = nil
+	return &copied
+}
+
+/*
+ * A single option to be given to New().
+ */
+type Option func(*CompressionOptions)
+
+// Sets the quality of the output (0-100)
+func WithQuality(quality int) Option {
+	return func(o *CompressionOptions) {
+		o.Quality = quality
+	}
+}
+
+// Picks the lowest quality (up to Quality) with SSIM of at least minSSIM to the image, e.g. 0.98
+func WithAutoQuality(minSSIM float64) Option {
+	return func(o *CompressionOptions) {
+		o.AutoQuality = minSSIM
+	}
+}
+
+// Sets the quality of JPEG output, in place of Quality
+func WithJPEGQuality(quality int) Option {
+	return func(o *CompressionOptions) {
+		o.JPEGQuality = quality
+	}
+}
+
+// Sets the quality of WebP output, in place of Quality
+func WithWebPQuality(quality int) Option {
+	return func(o *CompressionOptions) {
+		o.WebPQuality = quality
+	}
+}
+
+// Writes WebP output losslessly, e.g. for screenshots and drawings
+func WithWebPLossless(lossless bool) Option {
+	return func(o *CompressionOptions) {
+		o.WebPLossless = lossless
+	}
+}
+
+// Maps PNG output onto a palette of at most the given number of colors (2-256), screenshots and UI images shrink the most
+func WithQuantizePNG(colors int) Option {
+	return func(o *CompressionOptions) {
+		o.QuantizeColors = colors
+	}
+}
+
+// Sets the zlib level of PNG output, e.g. png.BestCompression
+func WithPNGCompression(level png.CompressionLevel) Option {
+	return func(o *CompressionOptions) {
+		o.PNGCompression = level
+	}
+}
+
+// Sets the palette size of GIF output (2-256)
+func WithGIFColors(colors int) Option {
+	return func(o *CompressionOptions) {
+		o.GIFColors = colors
+	}
+}
+
+// Sets the maximum dimension (width/height), 0 = unlimited
+func WithMaxSize(size int) Option {
+	return func(o *CompressionOptions) {
+		o.Size = size
+	}
+}
+
+// Sets the maximum width and height separately, 0 = use the maximum size
+func WithMaxDimensions(width, height int) Option {
+	return func(o *CompressionOptions) {
+		o.MaxWidth = width
+		o.MaxHeight = height
+	}
+}
+
+// Scales smaller images up to the dimension, 0 = up to the maximum dimensions
+func WithUpscale(minSize int) Option {
+	return func(o *CompressionOptions) {
+		o.AllowUpscale = true
+		o.MinSize = minSize
+	}
+}
+
+// Refuses images of more pixels or bytes before decoding them, 0 = unlimited
+func WithMaxInput(pixels, bytes int64) Option {
+	return func(o *CompressionOptions) {
+		o.MaxPixels = pixels
+		o.MaxBytes = bytes
+	}
+}
+
+// Refuses images narrower or lower than this, e.g. for cover photos, 0 = any
+func WithMinResolution(width, height int) Option {
+	return func(o *CompressionOptions) {
+		o.MinWidth = width
+		o.MinHeight = height
+	}
+}
+
+// Refuses images outside the aspect ratio (width / height) range, e.g. 2.5-4 for banners, 0 = no limit
+func WithAspectRange(min, max float64) Option {
+	return func(o *CompressionOptions) {
+		o.MinAspect = min
+		o.MaxAspect = max
+	}
+}
+
+// Deletes uploads of more bytes at once and reports them with a *TooLargeError, 0 = unlimited
+func WithMaxUploadBytes(bytes int64) Option {
+	return func(o *CompressionOptions) {
+		o.MaxUploadBytes = bytes
+	}
+}
+
+// Gives up fetching an image in OptimizeURL after the timeout
+func WithFetchTimeout(timeout time.Duration) Option {
+	return func(o *CompressionOptions) {
+		o.FetchTimeout = timeout
+	}
+}
+
+// Optimizes only the images of the given mime-types, e.g. "image/jpeg"
+func WithAllowedMimeTypes(mimeTypes ...string) Option {
+	return func(o *CompressionOptions) {
+		o.AllowedMimeTypes = mimeTypes
+	}
+}
+
+// Never touches the files of the given mime-types
+func WithSkipMimeTypes(mimeTypes ...string) Option {
+	return func(o *CompressionOptions) {
+		o.SkipMimeTypes = mimeTypes
+	}
+}
+
+// Decodes HEICs and HEIFs with the decoder, e.g. CommandDecoder
+func WithHEICDecoder(decoder HEICDecoder) Option {
+	return func(o *CompressionOptions) {
+		o.HEICDecoder = decoder
+	}
+}
+
+// Rotates the upright image clockwise by the degrees, multiples of 90
+func WithRotate(degrees int) Option {
+	return func(o *CompressionOptions) {
+		o.Rotate = degrees
+	}
+}
+
+// Mirrors the upright image before rotating
+func WithFlip(flip Flip) Option {
+	return func(o *CompressionOptions) {
+		o.Flip = flip
+	}
+}
+
+// Keeps only the area of the upright image
+func WithCrop(crop image.Rectangle) Option {
+	return func(o *CompressionOptions) {
+		o.Crop = crop
+	}
+}
+
+// Lets the form opt uploads out in the form field, e.g. optimg_skip=1 for print-quality originals
+func WithOptOutField(name string) Option {
+	return func(o *CompressionOptions) {
+		o.OptOutField = name
+	}
+}
+
+// Reads the crop rectangle "x,y,w,h" of each uploaded file from the form field
+func WithCropField(name string) Option {
+	return func(o *CompressionOptions) {
+		o.CropField = name
+	}
+}
+
+// Lets the upload form tune the options with the overrides signed by SignOverrides using the secret
+func WithSignedOverrides(secret []byte) Option {
+	return func(o *CompressionOptions) {
+		o.OverrideSecret = secret
+	}
+}
+
+// Crops away uniform borders, pixels within the tolerance (0-255 per channel) of the border color
+func WithTrim(tolerance int) Option {
+	return func(o *CompressionOptions) {
+		o.Trim = true
+		o.TrimTolerance = tolerance
+	}
+}
+
+// Sets how the images are fitted in the maximum dimensions
+func WithFit(fit FitMode) Option {
+	return func(o *CompressionOptions) {
+		o.Fit = fit
+	}
+}
+
+// Keeps the faces found by the detector in frame with CropSmart
+func WithFaceDetector(detector FaceDetector) Option {
+	return func(o *CompressionOptions) {
+		o.FaceDetector = detector
+	}
+}
+
+// Sets the color of the padding in Pad mode
+func WithBackground(background color.Color) Option {
+	return func(o *CompressionOptions) {
+		o.Background = background
+	}
+}
+
+// Sets the interpolation used for resizing
+func WithFilter(filter Filter) Option {
+	return func(o *CompressionOptions) {
+		o.Filter = filter
+	}
+}
+
+// Resizes in linear light instead of sRGB
+func WithLinearLight(linear bool) Option {
+	return func(o *CompressionOptions) {
+		o.LinearLight = linear
+	}
+}
+
+// Sharpens the resized images with an unsharp mask
+func WithSharpen(amount, radius float64, threshold int) Option {
+	return func(o *CompressionOptions) {
+		o.Sharpen = UnsharpMask{
+			Amount:    amount,
+			Radius:    radius,
+			Threshold: threshold,
+		}
+	}
+}
+
+// Draws the watermark on every optimized image
+func WithWatermark(watermark *Watermark) Option {
+	return func(o *CompressionOptions) {
+		o.Watermark = watermark
+	}
+}
+
+// Runs the function on the decoded upright image before resizing, e.g. for filters or redaction
+func WithTransform(transform func(image.Image) (image.Image, error)) Option {
+	return func(o *CompressionOptions) {
+		o.Transform = transform
+	}
+}
+
+// Calls the function before the original is deleted, an error keeps the original
+func WithOnKeyReplaced(onKeyReplaced func(c context.Context, old, new appengine.BlobKey) error) Option {
+	return func(o *CompressionOptions) {
+		o.OnKeyReplaced = onKeyReplaced
+	}
+}
+
+// Reuses an existing optimized blob of the same content instead of writing a new one
+func WithDeduplicate(deduplicate bool) Option {
+	return func(o *CompressionOptions) {
+		o.Deduplicate = deduplicate
+	}
+}
+
+// Gets the Images API serving URL of each optimized blob
+func WithServingURL(secure bool, size int, crop bool) Option {
+	return func(o *CompressionOptions) {
+		o.ServingURL = &aeimage.ServingURLOptions{
+			Secure: secure,
+			Size:   size,
+			Crop:   crop,
+		}
+	}
+}
+
+// Records each optimized blob in the datastore
+func WithLedger(ledger bool) Option {
+	return func(o *CompressionOptions) {
+		o.Ledger = ledger
+	}
+}
+
+// Marks the optimized blobs and leaves the marked ones alone, e.g. for re-running bulk jobs
+func WithSkipOptimized(skip bool) Option {
+	return func(o *CompressionOptions) {
+		o.SkipOptimized = skip
+	}
+}
+
+// Stamps the optimized blobs with the version, blobs of older versions are optimized again
+func WithVersion(version int) Option {
+	return func(o *CompressionOptions) {
+		o.Version = version
+	}
+}
+
+// Checks the images with the moderator before they are stored
+func WithModerator(moderator Moderator) Option {
+	return func(o *CompressionOptions) {
+		o.Moderator = moderator
+	}
+}
+
+// Calls the function with each blob before optimizing it, false leaves the blob untouched
+func WithBeforeOptimize(before func(blob *blobstore.BlobInfo) bool) Option {
+	return func(o *CompressionOptions) {
+		o.BeforeOptimize = before
+	}
+}
+
+// Calls the function with each optimized blob
+func WithAfterOptimize(after func(old, new *blobstore.BlobInfo, report Report)) Option {
+	return func(o *CompressionOptions) {
+		o.AfterOptimize = after
+	}
+}
+
+// Tells what was done with each blob and why to the logger instead of the App Engine log
+func WithLogger(logger Logger) Option {
+	return func(o *CompressionOptions) {
+		o.Logger = logger
+	}
+}
+
+// Reports the time taken and bytes handled by each phase of each blob to the metrics
+func WithMetrics(metrics Metrics) Option {
+	return func(o *CompressionOptions) {
+		o.Metrics = metrics
+	}
+}
+
+// Uses the given App Engine context instead of creating a new one
+func WithContext(c context.Context) Option {
+	return func(o *CompressionOptions) {
+		o.Context = c
+	}
+}
+
+// Reads and writes the images through the given storage instead of blobstore
+func WithStorage(storage Storage) Option {
+	return func(o *CompressionOptions) {
+		o.Storage = storage
+	}
+}
+
+// Retries the failing storage calls up to the attempts, waiting backoff before the first retry and doubling it for each one after
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(o *CompressionOptions) {
+		o.Retry = &RetryPolicy{
+			Attempts: attempts,
+			Backoff:  backoff,
+		}
+	}
+}
+
+// Only reports the savings, blobstore is left untouched
+func WithDryRun(dryRun bool) Option {
+	return func(o *CompressionOptions) {
+		o.DryRun = dryRun
+	}
+}
+
+// Fails the whole request if any of the images could not be optimized
+func WithStrict(strict bool) Option {
+	return func(o *CompressionOptions) {
+		o.Strict = strict
+	}
+}
+
+// Keeps the uploaded blob in the blobstore next to the optimized one
+func WithKeepOriginal(keep bool) Option {
+	return func(o *CompressionOptions) {
+		o.KeepOriginal = keep
+	}
+}
+
+// Sets the format of the optimized images
+func WithOutputFormat(format Format) Option {
+	return func(o *CompressionOptions) {
+		o.OutputFormat = format
+	}
+}
+
+// Lowers the quality, and the dimensions if need be, until the output fits in the given bytes
+func WithMaxOutputBytes(bytes int64) Option {
+	return func(o *CompressionOptions) {
+		o.MaxOutputBytes = bytes
+	}
+}
+
+// Writes progressive JPEGs, needs JPEGEncoder to be set
+func WithProgressive(progressive bool) Option {
+	return func(o *CompressionOptions) {
+		o.Progressive = progressive
+	}
+}
+
+// Sets the chroma subsampling of JPEGs, needs JPEGEncoder to be set for other than 4:2:0
+func WithSubsampling(subsampling Subsampling) Option {
+	return func(o *CompressionOptions) {
+		o.Subsampling = subsampling
+	}
+}
+
+// Keeps the original unless the optimized image is at least the given percent smaller, avoiding new keys for marginal gains
+func WithMinSavingsPercent(percent int) Option {
+	return func(o *CompressionOptions) {
+		o.MinSavingsPercent = percent
+	}
+}
+
+// Keeps JPEGs of the quality or lower as they are, unless resized, transformed or watermarked
+func WithSkipLowQuality(skip bool) Option {
+	return func(o *CompressionOptions) {
+		o.SkipLowQuality = skip
+	}
+}
+
+// Keeps the original if the optimized image would not be smaller, unless resized, transformed or watermarked
+func WithSkipLarger(skip bool) Option {
+	return func(o *CompressionOptions) {
+		o.SkipLarger = skip
+	}
+}
+
+// Stores transparent images as PNG instead of JPEG
+func WithPreserveTransparency(preserve bool) Option {
+	return func(o *CompressionOptions) {
+		o.PreserveTransparency = preserve
+	}
+}
+
+// Tells photos from graphics (screenshots, diagrams), storing graphics as PNG instead of JPEG and as lossless WebP
+func WithAutoFormat(auto bool) Option {
+	return func(o *CompressionOptions) {
+		o.AutoFormat = auto
+	}
+}
+
+// Keeps paletted images using at most this many colors as paletted PNG instead of JPEG, 0 = never
+func WithPaletteColors(colors int) Option {
+	return func(o *CompressionOptions) {
+		o.PaletteColors = colors
+	}
+}
+
+// Encodes opaque images with no color in one channel, JPEG or PNG
+func WithDetectGrayscale(detect bool) Option {
+	return func(o *CompressionOptions) {
+		o.DetectGrayscale = detect
+	}
+}
+
+// Dithers when reducing 16-bit images to 8 bits and when mapping resized images onto their palette
+func WithDither(dither bool) Option {
+	return func(o *CompressionOptions) {
+		o.Dither = dither
+	}
+}
+
+// Resizes animated GIFs frame by frame, otherwise they are left untouched
+func WithOptimizeAnimations(optimize bool) Option {
+	return func(o *CompressionOptions) {
+		o.OptimizeAnimations = optimize
+	}
+}
+
+// Writes a preview image of the first page of multi-page TIFFs and PDFs, the documents are kept as they are
+func WithDocumentPreviews(previews bool) Option {
+	return func(o *CompressionOptions) {
+		o.DocumentPreviews = previews
+	}
+}
+
+// Renders the first page of PDFs for their previews
+func WithPDFRenderer(renderer PDFRenderer) Option {
+	return func(o *CompressionOptions) {
+		o.PDFRenderer = renderer
+	}
+}
+
+// Rasterizes SVGs to PNG at the maximum size with SVGRasterizer instead of only sanitizing them
+func WithRasterizeSVG(rasterize bool) Option {
+	return func(o *CompressionOptions) {
+		o.RasterizeSVG = rasterize
+	}
+}
+
+// Rasterizes the SVGs with the rasterizer, see RasterizeSVG
+func WithSVGRasterizer(rasterizer SVGRasterizer) Option {
+	return func(o *CompressionOptions) {
+		o.SVGRasterizer = rasterizer
+	}
+}
+
+// Turns JPEGs upright according to their EXIF orientation
+func WithAutoRotate(autoRotate bool) Option {
+	return func(o *CompressionOptions) {
+		o.AutoRotate = autoRotate
+	}
+}
+
+// Converts images with an embedded ICC profile to sRGB, wide gamut photos look desaturated otherwise
+func WithConvertToSRGB(convert bool) Option {
+	return func(o *CompressionOptions) {
+		o.ConvertToSRGB = convert
+	}
+}
+
+// Embeds a compact sRGB profile in JPEG output
+func WithEmbedSRGB(embed bool) Option {
+	return func(o *CompressionOptions) {
+		o.EmbedSRGB = embed
+	}
+}
+
+// Carries the given EXIF fields over to JPEG output, everything else is stripped
+func WithKeepMetadata(fields ...MetadataField) Option {
+	return func(o *CompressionOptions) {
+		o.KeepMetadata = fields
+	}
+}
+
+/*
+ * Never changes the pixels, for apps where any visual change is unacceptable.
+ * The metadata is stripped and the images recompressed losslessly, PNGs at png.BestCompression
+ * and JPEGs by JPEGOptimizer if plugged in. Images over the maximum size are resized only with allowResize.
+ */
+func WithLossless(allowResize bool) Option {
+	return func(o *CompressionOptions) {
+		o.Lossless = true
+		o.LosslessResize = allowResize
+	}
+}
+
+/*
+ * Makes the output byte-identical for identical input and options, e.g. for content-hash deduplication and golden tests.
+ *
+ *      - The time stamps and software fields are left out of the kept metadata.
+ *      - The TimeBudget is not applied, the blobs are optimized however much time is left.
+ *      - Encoders plugged in (JPEGEncoder, RegisterEncoder) are to fix their parameters when set, e.g. no threads.
+ */
+func WithDeterministic(deterministic bool) Option {
+	return func(o *CompressionOptions) {
+		o.Deterministic = deterministic
+	}
+}
+
+// Writes an extra blob of the given maximum dimension for each variant
+func WithVariants(variants map[string]int) Option {
+	return func(o *CompressionOptions) {
+		o.Variants = variants
+	}
+}
+
+// Returns a tiny blurred preview of each image as a data URI, e.g. DefaultPlaceholderSize
+func WithPlaceholder(size int) Option {
+	return func(o *CompressionOptions) {
+		o.PlaceholderSize = size
+	}
+}
+
+// Computes the BlurHash of each image, see Report.BlurHash
+func WithBlurHash(compute bool) Option {
+	return func(o *CompressionOptions) {
+		o.BlurHash = compute
+	}
+}
+
+// Returns the main colors of each image, see Report.Palette
+func WithColors(colors int) Option {
+	return func(o *CompressionOptions) {
+		o.ExtractColors = colors
+	}
+}
+
+// Computes the perceptual hash of each image and indexes the blobs, see FindSimilar
+func WithPerceptualHash(compute bool) Option {
+	return func(o *CompressionOptions) {
+		o.PerceptualHash = compute
+	}
+}
+
+// Unpacks uploaded ZIP archives and optimizes each image in them
+func WithUnpackZip(unpack bool) Option {
+	return func(o *CompressionOptions) {
+		o.UnpackZip = unpack
+	}
+}
+
+// Optimizes up to n uploaded blobs at a time, each of them takes memory for the decoded image
+func WithConcurrency(n int) Option {
+	return func(o *CompressionOptions) {
+		o.Concurrency = n
+	}
+}
+
+// Uses own options for the form field, starting from the defaults
+func WithField(name string, opts ...Option) Option {
+	return func(o *CompressionOptions) {
+		fieldOptions := defaultOptions()
+		for _, opt := range opts {
+			opt(fieldOptions)
+		}
+		o.setField(name, fieldOptions)
+	}
+}
+
+// Leaves the blobs of the form field untouched
+func WithSkipField(name string) Option {
+	return func(o *CompressionOptions) {
+		o.setField(name, nil)
+	}
+}
+
+func (o *CompressionOptions) setField(name string, fieldOptions *CompressionOptions) {
+	if o.Fields == nil {
+		o.Fields = make(map[string]*CompressionOptions)
+	}
+	o.Fields[name] = fieldOptions
+}
+
+// Optimizes the uploads in a task queue task instead of the request
+func WithDeferred(deferred *Deferred) Option {
+	return func(o *CompressionOptions) {
+		o.Deferred = deferred
+	}
+}
+
+// Leaves each blob the time, the rest are queued to overflow (if not nil) once the request is short of time
+func WithTimeBudget(budget time.Duration, overflow *Deferred) Option {
+	return func(o *CompressionOptions) {
+		o.TimeBudget = budget
+		o.Overflow = overflow
+	}
+}
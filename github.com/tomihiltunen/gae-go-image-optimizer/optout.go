@@ -0,0 +1,48 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"net/url"
+	"strings"
+)
+
+// Form field suggested for opting uploads out, e.g. optimg_skip=1
+const DefaultOptOutField = "optimg_skip"
+
+/*
+ * Tells whether the uploads of the form field are opted out by the form, in OptOutField.
+ *
+ *      - "1", "true" or "all" opts out all the uploads of the request.
+ *      - Otherwise the values list the fields whose uploads are left untouched, comma separated.
+ */
+func (o *CompressionOptions) optedOut(other url.Values, field string) bool {
+	if o.OptOutField == "" {
+		return false
+	}
+	for _, value := range other[o.OptOutField] {
+		for _, name := range strings.Split(value, ",") {
+			switch name = strings.TrimSpace(name); strings.ToLower(name) {
+			case "1", "true", "all":
+				return true
+			}
+			if name == field {
+				return true
+			}
+		}
+	}
+	return false
+}
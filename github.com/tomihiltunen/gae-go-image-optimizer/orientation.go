@@ -0,0 +1,127 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"image"
+	"image/draw"
+)
+
+// Dimensions of the image turned upright by its EXIF orientation, read from the header only
+func uprightSize(data []byte) (size_x, size_y int, err error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	size_x, size_y = config.Width, config.Height
+	if exif, err := readExif(bytes.NewReader(data)); err == nil && exif != nil && exif.orientation() >= 5 {
+		size_x, size_y = size_y, size_x
+	}
+	return
+}
+
+/*
+ * Turns the image upright according to the EXIF orientation.
+ *
+ *      1   Normal
+ *      2   Flipped horizontally
+ *      3   Rotated 180
+ *      4   Flipped vertically
+ *      5   Flipped horizontally and rotated 90 counter-clockwise
+ *      6   Rotated 90 clockwise
+ *      7   Flipped horizontally and rotated 90 clockwise
+ *      8   Rotated 90 counter-clockwise
+ */
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return transformImage(img, false, func(x, y, w, h int) (int, int) { return w - 1 - x, y })
+	case 3:
+		return transformImage(img, false, func(x, y, w, h int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 4:
+		return transformImage(img, false, func(x, y, w, h int) (int, int) { return x, h - 1 - y })
+	case 5:
+		return transformImage(img, true, func(x, y, w, h int) (int, int) { return y, x })
+	case 6:
+		return transformImage(img, true, func(x, y, w, h int) (int, int) { return h - 1 - y, x })
+	case 7:
+		return transformImage(img, true, func(x, y, w, h int) (int, int) { return h - 1 - y, w - 1 - x })
+	case 8:
+		return transformImage(img, true, func(x, y, w, h int) (int, int) { return y, w - 1 - x })
+	}
+	return img
+}
+
+/*
+ * Mirroring of the image, the values can be combined.
+ *
+ *      FlipHorizontal  Left and right are swapped
+ *      FlipVertical    Top and bottom are swapped
+ */
+type Flip int
+
+const (
+	FlipHorizontal Flip = 1 << iota
+	FlipVertical
+)
+
+/*
+ * Flips and then rotates the image as asked in the options.
+ * Rotation is clockwise in degrees, only multiples of 90 are supported.
+ */
+func rotateImage(options *CompressionOptions, img image.Image) image.Image {
+	if options.Flip&FlipHorizontal != 0 {
+		img = orient(img, 2)
+	}
+	if options.Flip&FlipVertical != 0 {
+		img = orient(img, 4)
+	}
+	switch (options.Rotate%360 + 360) % 360 {
+	case 90:
+		img = orient(img, 6)
+	case 180:
+		img = orient(img, 3)
+	case 270:
+		img = orient(img, 8)
+	}
+	return img
+}
+
+/*
+ * Moves every pixel of the image to a new place.
+ *
+ *      swap    Width and height are swapped, i.e. the image is rotated by 90 degrees
+ *      move    Gives the new place of the pixel x, y of a w * h image
+ */
+func transformImage(img image.Image, swap bool, move func(x, y, w, h int) (int, int)) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	// Work on plain RGBA pixels
+	src := getRGBA(image.Rect(0, 0, w, h))
+	defer putRGBA(src)
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if swap {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := move(x, y, w, h)
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,186 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+)
+
+// Form field carrying the signed overrides, see SignOverrides
+const OverridesField = "optimg_overrides"
+
+// Signed in place of a blob key with the path of the upload handler, so links and overrides are not interchangeable
+const overridesKey = "optimg:overrides:"
+
+/*
+ * Gives the value of the hidden OverridesField letting a single upload form tune the options.
+ * Make it when creating the upload URL, the client cannot change it without the secret.
+ * It is only valid in the upload handler at path, another form cannot reuse it for its handler.
+ *
+ *      secret      Secret given to WithSignedOverrides in the upload handler
+ *      path        Path of the upload handler, the success path of the upload URL, e.g. "/upload"
+ *      overrides   The options to override, see below
+ *      expires     Time after which the overrides are ignored, e.g. when the upload URL expires
+ *
+ *      preset      Preset applied before the rest, e.g. "thumbnail", see LookupPreset
+ *      q           Quality, 1-100
+ *      size        Maximum width and height
+ *      w, h        Maximum width and height, each
+ *      fit         How the image is fitted, "inside", "crop", "smart", "stretch" or "pad"
+ *      fm          Output format, "jpeg", "png", "webp" or "avif"
+ *      crop        Area of the upright image to keep, "x,y,w,h"
+ */
+func SignOverrides(secret []byte, path string, overrides url.Values, expires time.Time) string {
+	query := url.Values{}
+	for name, values := range overrides {
+		query[name] = values
+	}
+	query.Del("sig")
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", signature(secret, overridesKey+appengine.BlobKey(path), query))
+	return query.Encode()
+}
+
+/*
+ * Checks the signature and the expiry of the overrides made by SignOverrides and turns them into an option.
+ * Path is that of the upload handler, the overrides signed for another path are invalid.
+ * ParseBlobs does this for the options with OverrideSecret set, use it e.g. to build the options by hand.
+ */
+func VerifyOverrides(secret []byte, path string, value string) (Option, error) {
+	query, err := url.ParseQuery(value)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	if err := verifySignature(secret, overridesKey+appengine.BlobKey(path), query, time.Now()); err != nil {
+		return nil, err
+	}
+	return parseOverrides(query)
+}
+
+/*
+ * Applies the signed overrides to a copy of the options and the options of its fields.
+ *
+ *      - Only with OverrideSecret set, the overrides are left for the app otherwise.
+ *      - Read from the form field, then from the success URL made by CreateUploadURL, which wins.
+ *      - Both are verified against the path of the request, signed for another handler they are ignored.
+ *      - The form field is taken out of the other values.
+ *      - Overrides with a bad signature, expired or invalid are ignored, the options are used as they are.
+ */
+func (o *CompressionOptions) withOverrides(other url.Values) *CompressionOptions {
+	if len(o.OverrideSecret) == 0 {
+		return o
+	}
+	var values []string
+	if value := other.Get(OverridesField); value != "" {
+		values = append(values, value)
+		other.Del(OverridesField)
+	}
+	path := ""
+	if o.Request != nil && o.Request.URL != nil {
+		path = o.Request.URL.Path
+		// Applied last, the form cannot undo what the upload URL asked for
+		if value := o.Request.URL.Query().Get(OverridesField); value != "" {
+			values = append(values, value)
+		}
+	}
+	var opts []Option
+	for _, value := range values {
+		apply, err := VerifyOverrides(o.OverrideSecret, path, value)
+		if err != nil {
+			o.logger().Warningf(o.Context, "optimg: ignoring overrides (%v)", err)
+			continue
+		}
+		opts = append(opts, apply)
+	}
+	if len(opts) == 0 {
+		return o
+	}
+	apply := preset(opts...)
+	copied := *o
+	apply(&copied)
+	if o.Fields != nil {
+		copied.Fields = make(map[string]*CompressionOptions, len(o.Fields))
+		for name, fieldOptions := range o.Fields {
+			if fieldOptions != nil {
+				fieldCopy := *fieldOptions
+				apply(&fieldCopy)
+				fieldOptions = &fieldCopy
+			}
+			copied.Fields[name] = fieldOptions
+		}
+	}
+	return &copied
+}
+
+// Turns the overrides into an option
+func parseOverrides(query url.Values) (Option, error) {
+	var opts []Option
+	for name := range query {
+		value := query.Get(name)
+		switch name {
+		case "sig", "expires":
+		case "preset":
+			option, ok := LookupPreset(value)
+			if !ok {
+				return nil, fmt.Errorf("optimg: unknown preset %q", value)
+			}
+			// The rest are set over the preset
+			opts = append([]Option{option}, opts...)
+		case "q", "size", "w", "h":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 || (name == "q" && n > 100) {
+				return nil, fmt.Errorf("optimg: invalid %s %q", name, value)
+			}
+			switch name {
+			case "q":
+				opts = append(opts, func(o *CompressionOptions) { o.Quality, o.JPEGQuality, o.WebPQuality = n, 0, 0 })
+			case "size":
+				opts = append(opts, WithMaxSize(n))
+			case "w":
+				opts = append(opts, func(o *CompressionOptions) { o.MaxWidth = n })
+			case "h":
+				opts = append(opts, func(o *CompressionOptions) { o.MaxHeight = n })
+			}
+		case "fit":
+			fit, ok := fitNames[value]
+			if !ok {
+				return nil, fmt.Errorf("optimg: invalid fit %q", value)
+			}
+			opts = append(opts, WithFit(fit))
+		case "fm":
+			format, ok := formatNames[value]
+			if !ok {
+				return nil, fmt.Errorf("optimg: invalid format %q", value)
+			}
+			opts = append(opts, WithOutputFormat(format))
+		case "crop":
+			crop, err := ParseCrop(value)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, func(o *CompressionOptions) { o.Crop = crop })
+		default:
+			return nil, fmt.Errorf("optimg: unknown override %q", name)
+		}
+	}
+	return preset(opts...), nil
+}
@@ -0,0 +1,69 @@
+package optimg_test
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	// The optimizer
+	optimg "github.com/tomihiltunen/gae-go-image-optimizer"
+	"github.com/tomihiltunen/gae-go-image-optimizer/optimgtest"
+)
+
+func TestParseBlobsStrict(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+	// Looks like a JPEG but does not decode
+	bad := append([]byte(nil), good[:len(good)/3]...)
+	storage := &optimg.MemoryStorage{}
+	r, err := optimgtest.NewUploadRequest(storage, "/upload", nil,
+		optimgtest.Upload{Field: "bad", Filename: "bad.jpg", ContentType: "image/jpeg", Data: bad},
+		optimgtest.Upload{Field: "good", Filename: "good.jpg", ContentType: "image/jpeg", Data: good},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originals := storage.Keys()
+	options := optimg.New(r,
+		optimg.WithContext(context.Background()),
+		optimg.WithStorage(storage),
+		optimg.WithLogger(nopLogger{}),
+		optimg.WithQuality(60),
+		optimg.WithStrict(true),
+	)
+	blobs, _, err := optimg.ParseBlobs(options)
+	if _, ok := err.(*optimg.BlobError); !ok {
+		t.Fatalf("error %v, want a *BlobError", err)
+	}
+	// Both are still there, the optimized one in place of its original
+	if len(blobs["bad"]) != 1 || blobs["bad"][0].BlobKey != originals[0] {
+		t.Errorf("bad upload %v, want its original", blobs["bad"])
+	}
+	if len(blobs["good"]) != 1 || blobs["good"][0].BlobKey == originals[1] {
+		t.Fatalf("good upload %v, want the optimized blob", blobs["good"])
+	}
+	if storage.Get(blobs["good"][0].BlobKey) == nil {
+		t.Error("optimized blob not in the storage")
+	}
+	if storage.Get(originals[1]) != nil {
+		t.Error("original of the optimized blob not deleted")
+	}
+}
+
+// Logger dropping everything, the App Engine log needs an App Engine context
+type nopLogger struct{}
+
+func (nopLogger) Debugf(c context.Context, format string, args ...interface{})   {}
+func (nopLogger) Infof(c context.Context, format string, args ...interface{})    {}
+func (nopLogger) Warningf(c context.Context, format string, args ...interface{}) {}
+func (nopLogger) Errorf(c context.Context, format string, args ...interface{})   {}
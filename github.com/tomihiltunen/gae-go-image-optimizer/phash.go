@@ -0,0 +1,171 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"sort"
+	"time"
+
+	// 3rd-party
+	"github.com/tomihiltunen/resize"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const SimilarKind = "OptimgSimilar" // Datastore kind of the perceptual hashes, named by the blob key
+
+/*
+ * Perceptual hash (dHash) of an image.
+ * Images that look alike have hashes differing in few bits, regardless of their size and format.
+ */
+type ImageHash uint64
+
+// Number of bits differing between the hashes, 0 for the same image, a handful for near-duplicates
+func (h ImageHash) Distance(other ImageHash) int {
+	return bits.OnesCount64(uint64(h ^ other))
+}
+
+func (h ImageHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+/*
+ * Computes the difference hash of the image.
+ * The image is scaled down to 9x8 pixels of luminance, each bit tells whether a pixel is brighter than the one on its right.
+ */
+func perceptualHash(img image.Image) (hash ImageHash) {
+	small := resize.Resize(img, img.Bounds(), 9, 8)
+	bounds := small.Bounds()
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.Gray16Model.Convert(small.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray16)
+			right := color.Gray16Model.Convert(small.At(bounds.Min.X+x+1, bounds.Min.Y+y)).(color.Gray16)
+			hash <<= 1
+			if left.Y > right.Y {
+				hash |= 1
+			}
+		}
+	}
+	return
+}
+
+/*
+ * Perceptual hash of a blob in the datastore, named by the blob key.
+ *
+ *      Hash        The hash, stored signed as the datastore has no unsigned integers
+ *      Bands       Each byte of the hash tagged with its position, for finding the hashes sharing any of them
+ *      Created     When the blob was indexed
+ */
+type similarEntry struct {
+	Hash    int64 `datastore:",noindex"`
+	Bands   []int64
+	Created time.Time `datastore:",noindex"`
+}
+
+// The bytes of the hash tagged with their positions, hashes within 7 bits share at least one
+func hashBands(hash ImageHash) []int64 {
+	bands := make([]int64, 8)
+	for i := range bands {
+		bands[i] = int64(i)<<8 | int64(hash>>(8*uint(i))&0xff)
+	}
+	return bands
+}
+
+/*
+ * An indexed blob that looks like the one searched for.
+ *
+ *      BlobKey     The blob, it may have been deleted since
+ *      Hash        Perceptual hash of the blob
+ *      Distance    Bits differing from the hash searched for
+ */
+type SimilarImage struct {
+	BlobKey  appengine.BlobKey
+	Hash     ImageHash
+	Distance int
+}
+
+/*
+ * Finds the blobs indexed with PerceptualHash whose hashes are at most maxDistance bits off, closest first.
+ * E.g. a result's PerceptualHash with maxDistance 5 finds near-duplicate uploads, whose blobs the app may use instead.
+ *
+ *      - The blobs are found for sure within 7 bits, farther ones only if they share a byte of the hash.
+ *      - The blob searched for is among the results if it was indexed itself.
+ */
+func FindSimilar(c context.Context, hash ImageHash, maxDistance int) (similar []SimilarImage, err error) {
+	seen := make(map[string]bool)
+	for _, band := range hashBands(hash) {
+		var entries []similarEntry
+		keys, err := datastore.NewQuery(SimilarKind).Filter("Bands =", band).GetAll(c, &entries)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			if seen[key.StringID()] {
+				continue
+			}
+			seen[key.StringID()] = true
+			other := ImageHash(entries[i].Hash)
+			if distance := hash.Distance(other); distance <= maxDistance {
+				similar = append(similar, SimilarImage{
+					BlobKey:  appengine.BlobKey(key.StringID()),
+					Hash:     other,
+					Distance: distance,
+				})
+			}
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].Distance < similar[j].Distance })
+	return
+}
+
+/*
+ * Indexes the perceptual hash of the blob in use for FindSimilar.
+ * A failing write is logged, the blob is just not found.
+ */
+func indexSimilar(options *CompressionOptions, result *BlobResult) {
+	if !options.PerceptualHash || options.DryRun {
+		return
+	}
+	key := result.Blob.BlobKey
+	entry := &similarEntry{
+		Hash:    int64(result.PerceptualHash),
+		Bands:   hashBands(result.PerceptualHash),
+		Created: time.Now(),
+	}
+	if _, err := datastore.Put(options.Context, similarKey(options.Context, key), entry); err != nil {
+		options.logger().Errorf(options.Context, "optimg: perceptual hash of blob %s: %v", key, err)
+	}
+}
+
+// Key of the perceptual hash of a blob
+func similarKey(c context.Context, key appengine.BlobKey) *datastore.Key {
+	return datastore.NewKey(c, SimilarKind, string(key), 0, nil)
+}
+
+// Removes the perceptual hash of a deleted blob
+func unindexSimilar(options *CompressionOptions, key appengine.BlobKey) {
+	if !options.PerceptualHash || options.DryRun {
+		return
+	}
+	_ = datastore.Delete(options.Context, similarKey(options.Context, key))
+}
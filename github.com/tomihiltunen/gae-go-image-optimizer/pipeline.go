@@ -0,0 +1,527 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	ErrTooManyBytes  = errors.New("optimg: image exceeds the maximum number of bytes")
+	ErrTooManyPixels = errors.New("optimg: image exceeds the maximum number of pixels")
+)
+
+/*
+ * Runs the image read from r through the optimization and writes the result to w.
+ *
+ *      - Works on any reader, e.g. images fetched with urlfetch, no blobstore needed.
+ *      - Images left as they are (e.g. animations when not optimizing them) are copied to w as-is.
+ *      - So is anything not of the allowed mime-types, and multi-page TIFFs.
+ *      - In Lossless mode the pixels are left alone, only the metadata and the compression are optimized.
+ *      - So are images that did not get any smaller, unless resized, transformed or watermarked (SkipLarger).
+ *      - The output is made to fit in MaxOutputBytes.
+ *      - Images over MaxBytes or MaxPixels are refused before decoding them.
+ *      - Images rejected by the Moderator are not written, the error is a *RejectedError.
+ *      - Nil options use the defaults.
+ */
+func Optimize(ctx context.Context, r io.Reader, w io.Writer, options *CompressionOptions) (report Report, err error) {
+	if options == nil {
+		options = defaultOptions()
+	}
+	start := time.Now()
+	ctx, span := startSpan(ctx, "optimg.Optimize")
+	defer func() {
+		report.Elapsed = time.Since(start)
+		endReportSpan(span, report, err)
+	}()
+	endDecode := options.startPhase(ctx, "", PhaseDecode)
+	data, err := readImage(r, options)
+	if err != nil {
+		endDecode(int64(len(data)), err)
+		return
+	}
+	report = Report{
+		OriginalSize:   int64(len(data)),
+		Size:           int64(len(data)),
+		OriginalFormat: Format(detectContentType(data)),
+		Format:         Format(detectContentType(data)),
+	}
+	// Kept as it is
+	if !validateMimeType(options, string(report.Format), "") {
+		endDecode(report.OriginalSize, nil)
+		_, err = w.Write(data)
+		return
+	}
+	// The pages after the first would be lost
+	if isMultiPageTIFF(data) {
+		endDecode(report.OriginalSize, nil)
+		_, err = w.Write(data)
+		return
+	}
+	// The pixels are left alone unless to be resized
+	if options.Lossless {
+		if size_x, size_y, resize, sizeErr := losslessSize(data, options); sizeErr == nil && !resize {
+			report.OriginalWidth, report.OriginalHeight = size_x, size_y
+			report.Width, report.Height = size_x, size_y
+			var out []byte
+			out, err = optimizeLossless(data, options)
+			endDecode(report.OriginalSize, err)
+			if err != nil {
+				return
+			}
+			// The metadata goes anyway
+			if !savesEnough(options, int64(len(data)), int64(len(out))) {
+				if out = stripMetadata(data, options); out == nil {
+					report.NoSavings = true
+					out = data
+				}
+			}
+			report.Size = int64(len(out))
+			_, err = w.Write(out)
+			return
+		}
+	}
+	// Sanitized only
+	if report.Format == FormatSVG && !options.RasterizeSVG {
+		var clean []byte
+		clean, err = sanitizeSVG(data)
+		endDecode(report.OriginalSize, err)
+		if err != nil {
+			return
+		}
+		report.Size = int64(len(clean))
+		_, err = w.Write(clean)
+		return
+	}
+	dec, err := decodeImage(data, options)
+	endDecode(report.OriginalSize, err)
+	if err != nil {
+		return
+	}
+	report.decoded(report.Format, dec)
+	if err = moderate(ctx, options, dec.img); err != nil {
+		return
+	}
+	options = options.detectFaces(ctx, dec.img)
+	endResize := options.startPhase(ctx, "", PhaseResize)
+	out, err := processImage(dec, options)
+	endResize(0, err)
+	if err != nil {
+		return
+	}
+	// Do not start encoding for a request that is already gone
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	// Kept as it is
+	if out == nil {
+		report.summarize(options, dec.img)
+		_, err = w.Write(data)
+		return
+	}
+	report.summarize(options, out.img)
+	endEncode := options.startPhase(ctx, "", PhaseEncode)
+	encodeFn, size, err := out.encoder(options, report.OriginalSize)
+	endEncode(size, err)
+	if err != nil {
+		return
+	}
+	// Not worth it
+	if encodeFn == nil {
+		report.NoSavings = true
+		_, err = w.Write(data)
+		return
+	}
+	counter := &byteCounter{w: w}
+	if err = encodeFn(counter); err != nil {
+		return
+	}
+	report.Size = counter.n
+	report.encoded(out)
+	return
+}
+
+/*
+ * Reads the whole image, refusing images over the maximum number of bytes.
+ */
+func readImage(r io.Reader, options *CompressionOptions) ([]byte, error) {
+	if options.MaxBytes <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	// One byte over the limit is enough to tell
+	data, err := ioutil.ReadAll(io.LimitReader(r, options.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > options.MaxBytes {
+		return nil, ErrTooManyBytes
+	}
+	return data, nil
+}
+
+/*
+ * An image read from the upload.
+ *
+ *      img         The image turned upright, the first frame for animations
+ *      anim        All the frames of an animated GIF, nil for other images
+ *      webpAnim    The image is an animated WebP, only its first frame is decoded and it is kept as it is
+ *      vector      The image is a rasterized SVG, written as PNG rather than JPEG
+ *      quality     Estimated quality of a JPEG, 0 for other formats
+ *      metadata    APP1 segment with the EXIF fields to keep
+ *      original    The encoded image as uploaded
+ *      changed     The image has been transformed, or converted to sRGB or turned upright
+ *      width       Width of the upright image as stored, 0 unless decoded at a reduced scale
+ *      height      Height of the upright image as stored, 0 unless decoded at a reduced scale
+ */
+type decodedImage struct {
+	img      image.Image
+	anim     *gif.GIF
+	webpAnim bool
+	vector   bool
+	quality  int
+	metadata []byte
+	original []byte
+	changed  bool
+	width    int
+	height   int
+}
+
+// Tells whether the image is animated
+func (d *decodedImage) animated() bool {
+	return d.anim != nil || d.webpAnim
+}
+
+// Dimensions of the image as stored, the logical screen for animations
+func (d *decodedImage) size() (int, int) {
+	if d.width > 0 {
+		return d.width, d.height
+	}
+	return imageSize(d.img, d.anim)
+}
+
+/*
+ * Decodes the image.
+ *
+ *      - Images over the maximum number of pixels are refused by their header, before decoding them.
+ *      - So are images not meeting the minimum dimensions or the aspect ratio range, with an *InvalidImageError.
+ *      - Animated GIFs are decoded with all the frames, animated WebPs with the first one only.
+ *      - Huge JPEGs are decoded at a reduced DCT scale close to their final size, with JPEGDecoder plugged in.
+ *      - HEICs are decoded with the HEICDecoder of the options, upright already.
+ *      - SVGs are sanitized and rasterized with SVGRasterizer to fit in the maximum size.
+ *      - CMYK and YCCK JPEGs are converted to sRGB, also the ones without the Adobe marker.
+ *      - Images with an ICC profile other than sRGB are converted to sRGB, the profile is stripped with the rest.
+ *      - Turns JPEGs upright according to their EXIF orientation.
+ *      - Rotates and flips the upright image as asked, then crops it to the Crop rectangle, not animations.
+ *      - Strips all metadata but the EXIF fields asked to be kept.
+ *      - Crops away uniform borders if asked to, not for animations.
+ *      - Runs the Transform of the options on the upright image, not on animations.
+ */
+func decodeImage(data []byte, options *CompressionOptions) (dec *decodedImage, err error) {
+	// A small file may claim to be a huge image
+	// HEICs and SVGs are decoded by the decoders plugged in at once, there is no way to tell the size only
+	var whole image.Image
+	var config image.Config
+	dec = &decodedImage{}
+	if heifContentType(data) != "" {
+		whole, err = decodeHEIC(data, options)
+	} else if isSVG(data) {
+		whole, err = rasterizeSVG(data, options)
+		dec.vector = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	if whole != nil {
+		config.Width, config.Height = whole.Bounds().Dx(), whole.Bounds().Dy()
+	} else if config, _, err = image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if options.MaxPixels > 0 && int64(config.Width)*int64(config.Height) > options.MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+	// Phones store the orientation in EXIF instead of turning the pixels
+	// Other metadata is lost in re-encoding unless asked to keep some
+	orientation := 1
+	dec.original = data
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		dec.quality = estimateJPEGQuality(data)
+		if exif, err := readExif(bytes.NewReader(data)); err == nil && exif != nil {
+			if options.AutoRotate {
+				orientation = exif.orientation()
+			}
+			if keep := options.keepMetadata(); len(keep) > 0 {
+				dec.metadata = exif.filter(keep, options.AutoRotate)
+			}
+		}
+	}
+	// Upright dimensions, the turns by 90 degrees swap the sides
+	size_x, size_y := config.Width, config.Height
+	if (orientation >= 5) != ((options.Rotate%180+180)%180 == 90) {
+		size_x, size_y = size_y, size_x
+	}
+	if err := validateSize(options, size_x, size_y); err != nil {
+		return nil, err
+	}
+	// Instantiate the image object
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		dec.img = anim.Image[0]
+		if len(anim.Image) > 1 {
+			dec.anim = anim
+			return dec, nil
+		}
+	} else {
+		inverted := false
+		if whole != nil {
+			dec.img = whole
+		} else if scale := jpegScale(options, size_x, size_y); scale > 1 && bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+			dec.img, err = JPEGDecoder(bytes.NewReader(data), scale)
+			dec.width, dec.height = size_x, size_y
+			dec.changed = true
+		} else {
+			// image/jpeg refuses CMYK without the Adobe marker
+			cmyk, adobe := jpegCMYK(data)
+			inverted = cmyk && !adobe
+			if inverted {
+				data = withAdobeMarker(data)
+			}
+			dec.img, _, err = image.Decode(bytes.NewReader(data))
+			dec.webpAnim = isAnimatedWebP(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Print workflows send CMYK and YCCK photos
+		if img, ok := dec.img.(*image.CMYK); ok {
+			dec.img = cmykToRGBA(img, inverted)
+			dec.changed = true
+		} else if options.ConvertToSRGB {
+			if converted := convertToSRGB(data, dec.img); converted != dec.img {
+				dec.img = converted
+				dec.changed = true
+			}
+		}
+		if options.EmbedSRGB {
+			dec.metadata = append(dec.metadata, srgbICCSegment()...)
+		}
+		// Turn upright
+		if orientation > 1 {
+			dec.img = orient(dec.img, orientation)
+			dec.changed = true
+		}
+	}
+	// Rotated or flipped by the user
+	if rotated := rotateImage(options, dec.img); rotated != dec.img {
+		dec.img = rotated
+		dec.changed = true
+	}
+	// Cropped by the user
+	cropped, err := cropToOptions(options, dec.img)
+	if err != nil {
+		return nil, err
+	}
+	if cropped != dec.img {
+		dec.img = cropped
+		dec.changed = true
+	}
+	// Uniform borders
+	if options.Trim {
+		if trimmed := trimImage(dec.img, options.TrimTolerance); trimmed != dec.img {
+			dec.img = trimmed
+			dec.changed = true
+		}
+	}
+	// Custom processing
+	if options.Transform != nil {
+		if dec.img, err = options.Transform(dec.img); err != nil {
+			return nil, err
+		}
+		dec.changed = true
+	}
+	return
+}
+
+/*
+ * The image run through the pipeline, ready to be encoded.
+ *
+ *      img         The optimized image
+ *      anim        The optimized animation, nil for other images
+ *      format      Format to encode in
+ *      metadata    APP1 segment with the EXIF fields to keep
+ *      original    The encoded image as uploaded, kept if re-encoding does not pay off
+ *      changed     The image is more than re-encoded (e.g. resized), written even if larger
+ *      upscaled    The image was scaled up from a smaller one
+ *      quality     Estimated quality of the JPEG it was decoded from, 0 for other formats
+ */
+type processedImage struct {
+	img      image.Image
+	anim     *gif.GIF
+	format   Format
+	metadata []byte
+	original []byte
+	changed  bool
+	upscaled bool
+	quality  int
+}
+
+/*
+ * Resizes and watermarks the image and picks the format for it.
+ * Returns nil if the image is to be kept as it is.
+ */
+func processImage(dec *decodedImage, options *CompressionOptions) (*processedImage, error) {
+	// The frames of animated WebPs cannot be written back
+	if dec.webpAnim {
+		return nil, nil
+	}
+	// Animations are resized frame by frame
+	if dec.anim != nil {
+		if !options.OptimizeAnimations {
+			return nil, nil
+		}
+		// Nothing to gain if the animation fits already
+		size_x, size_y, ok := fitSize(options, dec.anim.Config.Width, dec.anim.Config.Height)
+		if !ok {
+			return nil, nil
+		}
+		return &processedImage{
+			anim:     resizeAnimation(options, dec.anim, size_x, size_y),
+			format:   FormatGIF,
+			changed:  true,
+			upscaled: size_x > dec.anim.Config.Width || size_y > dec.anim.Config.Height,
+		}, nil
+	}
+	// Resize if necessary
+	img := resizeImage(options, dec.img)
+	if options.Watermark != nil {
+		var err error
+		if img, err = options.Watermark.apply(options, img); err != nil {
+			return nil, err
+		}
+	}
+	// Reducing the depth alone is no reason to write a larger image
+	changed := img != dec.img || dec.changed
+	img, format := prepareOutput(dec.img, img, options)
+	// Drawings stay sharp and transparent
+	if dec.vector && format == FormatJPEG {
+		format = FormatPNG
+	}
+	return &processedImage{
+		img:      img,
+		format:   format,
+		metadata: dec.metadata,
+		original: dec.original,
+		changed:  changed,
+		upscaled: upscaled(options, dec.img.Bounds().Dx(), dec.img.Bounds().Dy()),
+		quality:  dec.quality,
+	}, nil
+}
+
+// Dimensions of the processed image
+func (p *processedImage) size() (int, int) {
+	return imageSize(p.img, p.anim)
+}
+
+// Dimensions of the image, the logical screen for animations
+func imageSize(img image.Image, anim *gif.GIF) (int, int) {
+	if anim != nil {
+		return anim.Config.Width, anim.Config.Height
+	}
+	return img.Bounds().Dx(), img.Bounds().Dy()
+}
+
+// Encodes the processed image
+func (p *processedImage) encode(w io.Writer, options *CompressionOptions) error {
+	if p.anim != nil {
+		return gif.EncodeAll(w, p.anim)
+	}
+	return imageEncoder(options, p.img, p.format, p.metadata)(w)
+}
+
+/*
+ * Gives the function writing the encoded image, and its size if encoded in memory (0 if encoded while written).
+ *
+ *      - The quality of the format is used if set, e.g. JPEGQuality, Quality otherwise.
+ *      - Graphics are written as lossless WebP with AutoFormat.
+ *      - The quality is picked by AutoQuality if set, up to the quality above.
+ *      - Images over MaxOutputBytes are encoded at lower quality, and smaller if need be, until they fit.
+ *      - Returns nil if the image was only re-encoded and did not get any smaller than the original (SkipLarger),
+ *        or not by MinSavingsPercent.
+ *      - So it does for a JPEG of the quality or lower already, without encoding it (SkipLowQuality).
+ *      - An original with metadata to strip is not kept as it is but stripped losslessly, see keepOriginal.
+ */
+func (p *processedImage) encoder(options *CompressionOptions, originalSize int64) (func(io.Writer) error, int64, error) {
+	options = options.forFormat(p.format)
+	// Graphics are written losslessly, sharp edges blur in lossy WebP
+	if options.AutoFormat && p.format == FormatWebP && !options.WebPLossless && p.anim == nil && isGraphic(p.img) {
+		lossless := *options
+		lossless.WebPLossless = true
+		options = &lossless
+	}
+	// Compressing a JPEG again at a higher quality only loses more of it
+	if options.SkipLowQuality && !p.changed && p.format == FormatJPEG && p.quality > 0 && p.quality <= options.Quality &&
+		(options.MaxOutputBytes <= 0 || originalSize <= options.MaxOutputBytes) {
+		return p.keepOriginal(options, 0)
+	}
+	skipLarger := (options.SkipLarger || options.MinSavingsPercent > 0) && !p.changed
+	if options.MaxOutputBytes <= 0 && options.AutoQuality <= 0 && !skipLarger {
+		return func(w io.Writer) error { return p.encode(w, options) }, 0, nil
+	}
+	// The size must be known before writing
+	data, err := p.encodeWithin(options)
+	if err != nil {
+		return nil, 0, err
+	}
+	if skipLarger && !savesEnough(options, originalSize, int64(len(data))) {
+		return p.keepOriginal(options, int64(len(data)))
+	}
+	return writeData(data), int64(len(data)), nil
+}
+
+/*
+ * Keeps the original instead of the re-encoded image, size is that of the re-encoded one if known.
+ * The original is stripped of its metadata losslessly if it has any to strip, the format becomes that of the original.
+ */
+func (p *processedImage) keepOriginal(options *CompressionOptions, size int64) (func(io.Writer) error, int64, error) {
+	stripped := stripMetadata(p.original, options)
+	if stripped == nil {
+		return nil, size, nil
+	}
+	p.format = Format(detectContentType(stripped))
+	return writeData(stripped), int64(len(stripped)), nil
+}
+
+// Tells whether the output is smaller than the original, by at least MinSavingsPercent of it if set
+func savesEnough(options *CompressionOptions, originalSize, size int64) bool {
+	return size < originalSize && size*100 <= originalSize*int64(100-options.MinSavingsPercent)
+}
+
+// Writes the already encoded data
+func writeData(data []byte) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+}
@@ -0,0 +1,197 @@
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Secret written in the EXIF of the test photos, it must not make it to the output
+const testSecret = "SECRET GPS 60.1699N 24.9384E"
+
+// Adds EXIF with the orientation and the description to the JPEG
+func withExif(data []byte, orientation uint16) []byte {
+	description := append([]byte(testSecret), 0)
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(tiff, binary.BigEndian, uint32(8))
+	binary.Write(tiff, binary.BigEndian, uint16(2))
+	// ImageDescription, ASCII, after the IFD
+	binary.Write(tiff, binary.BigEndian, []uint16{0x010e, 2})
+	binary.Write(tiff, binary.BigEndian, []uint32{uint32(len(description)), 8 + 2 + 2*12 + 4})
+	// Orientation, SHORT, in place
+	binary.Write(tiff, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(tiff, binary.BigEndian, []uint32{1, uint32(orientation) << 16})
+	binary.Write(tiff, binary.BigEndian, uint32(0))
+	tiff.Write(description)
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xff, 0xe1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	patched := append([]byte(nil), data[:2]...)
+	patched = append(patched, segment...)
+	patched = append(patched, payload...)
+	return append(patched, data[2:]...)
+}
+
+// Optimizes the data with the options, failing the test on errors
+func optimize(t *testing.T, data []byte, opts ...Option) ([]byte, Report) {
+	var out bytes.Buffer
+	report, err := Optimize(context.Background(), bytes.NewReader(data), &out, testOptions(context.Background(), nil, opts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes(), report
+}
+
+// Decodes the output, failing the test if it is not an image
+func decode(t *testing.T, data []byte) image.Image {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding the output: %v", err)
+	}
+	return img
+}
+
+func TestOptimizeStripsMetadata(t *testing.T) {
+	data := withExif(testJPEG(t, testImage(64, 48), 95), 1)
+	out, report := optimize(t, data)
+	if bytes.Contains(out, []byte(testSecret)) {
+		t.Error("output has the EXIF of the original")
+	}
+	if report.NoSavings {
+		t.Error("original kept, want it re-encoded")
+	}
+	decode(t, out)
+}
+
+func TestOptimizeSkipLarger(t *testing.T) {
+	data := testJPEG(t, testImage(64, 48), 50)
+	out, report := optimize(t, data, WithQuality(100), WithSkipLowQuality(false))
+	if !report.NoSavings || !bytes.Equal(out, data) {
+		t.Errorf("NoSavings %v with %d bytes out of %d, want the original", report.NoSavings, len(out), len(data))
+	}
+	// The original is kept, less its metadata
+	out, _ = optimize(t, withExif(data, 1), WithQuality(100), WithSkipLowQuality(false))
+	if bytes.Contains(out, []byte(testSecret)) {
+		t.Error("original kept with its EXIF")
+	}
+	if !bytes.HasSuffix(out, data[2:]) {
+		t.Errorf("%d bytes out of %d, want the original stripped", len(out), len(data))
+	}
+}
+
+func TestOptimizeSkipLowQuality(t *testing.T) {
+	data := testJPEG(t, testImage(64, 48), 40)
+	out, report := optimize(t, data)
+	if !report.NoSavings || !bytes.Equal(out, data) {
+		t.Errorf("NoSavings %v with %d bytes out of %d, want the original", report.NoSavings, len(out), len(data))
+	}
+	// Stripped losslessly
+	out, _ = optimize(t, withExif(data, 1))
+	if bytes.Contains(out, []byte(testSecret)) {
+		t.Error("original kept with its EXIF")
+	}
+	if !bytes.HasSuffix(out, data[2:]) {
+		t.Errorf("%d bytes out of %d, want the original stripped", len(out), len(data))
+	}
+	// Rotated upright, re-encoding is not the only change
+	out, report = optimize(t, withExif(data, 6))
+	if bytes.Contains(out, []byte(testSecret)) {
+		t.Error("output has the EXIF of the original")
+	}
+	if bounds := decode(t, out).Bounds(); bounds.Dx() != 48 || bounds.Dy() != 64 {
+		t.Errorf("output is %dx%d, want 48x64 upright", bounds.Dx(), bounds.Dy())
+	}
+	if report.NoSavings {
+		t.Error("original kept, want it rotated")
+	}
+}
+
+func TestOptimizeCMYK(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(runtime.GOROOT(), "src", "image", "testdata", "video-001.cmyk.jpeg"))
+	if err != nil {
+		t.Skipf("no CMYK JPEG to test with: %v", err)
+	}
+	out, report := optimize(t, data, WithQuality(95))
+	if cmyk, _ := jpegCMYK(out); cmyk {
+		t.Error("output is CMYK, want sRGB")
+	}
+	if report.NoSavings || bytes.Equal(out, data) {
+		t.Error("original kept, want it converted")
+	}
+	bounds := decode(t, out).Bounds()
+	if bounds.Dx() != report.OriginalWidth || bounds.Dy() != report.OriginalHeight {
+		t.Errorf("output is %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), report.OriginalWidth, report.OriginalHeight)
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	secret := []byte("secret")
+	s := &Server{Secret: secret}
+	link := SignURL(secret, "/images/", "blob", url.Values{"w": {"200"}, "fm": {"webp"}}, time.Now().Add(time.Hour))
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/images/blob" {
+		t.Errorf("path %q, want /images/blob", u.Path)
+	}
+	if err := verifySignature(secret, "blob", u.Query(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	params, err := s.parseParams(u.Query())
+	if err != nil || params == nil || params.width != 200 || params.format != FormatWebP {
+		t.Errorf("parameters %+v (%v), want w=200 fm=webp", params, err)
+	}
+	// Neither the parameters nor the blob can be changed
+	tampered := u.Query()
+	tampered.Set("w", "4000")
+	if err := verifySignature(secret, "blob", tampered, time.Now()); err != ErrInvalidSignature {
+		t.Errorf("changed parameters: %v, want %v", err, ErrInvalidSignature)
+	}
+	if err := verifySignature(secret, "other", u.Query(), time.Now()); err != ErrInvalidSignature {
+		t.Errorf("another blob: %v, want %v", err, ErrInvalidSignature)
+	}
+	if err := verifySignature(secret, "blob", u.Query(), time.Now().Add(2*time.Hour)); err != ErrInvalidSignature {
+		t.Errorf("expired: %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestSignOverrides(t *testing.T) {
+	secret := []byte("secret")
+	expires := time.Now().Add(time.Hour)
+	value := SignOverrides(secret, "/upload", url.Values{"size": {"32"}, "fm": {"png"}}, expires)
+	apply, err := VerifyOverrides(secret, "/upload", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, report := optimize(t, testJPEG(t, testImage(64, 48), 95), apply)
+	if report.Width != 32 || report.Height != 24 || report.Format != FormatPNG {
+		t.Errorf("output is %dx%d %s, want 32x24 %s", report.Width, report.Height, report.Format, FormatPNG)
+	}
+	decode(t, out)
+	// Not for another handler
+	if _, err := VerifyOverrides(secret, "/avatar", value); err != ErrInvalidSignature {
+		t.Errorf("another path: %v, want %v", err, ErrInvalidSignature)
+	}
+	// The upload URL wins over the form field
+	form := SignOverrides(secret, "/upload", url.Values{"size": {"100"}}, expires)
+	query := url.Values{OverridesField: {SignOverrides(secret, "/upload", url.Values{"size": {"200"}}, expires)}}
+	options := testOptions(context.Background(), nil, WithSignedOverrides(secret))
+	options.Request = httptest.NewRequest("POST", "/upload?"+query.Encode(), nil)
+	other := url.Values{OverridesField: {form}}
+	if size := options.withOverrides(other).Size; size != 200 {
+		t.Errorf("size %d, want 200 of the upload URL", size)
+	}
+	if _, ok := other[OverridesField]; ok {
+		t.Error("form field left in the other values")
+	}
+}
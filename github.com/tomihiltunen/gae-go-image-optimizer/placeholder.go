@@ -0,0 +1,86 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	// 3rd-party
+	"github.com/tomihiltunen/resize"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Largest dimension of the placeholders suggested for WithPlaceholder
+const DefaultPlaceholderSize = 20
+
+// Quality of the placeholder JPEGs, they are blurred anyway
+const placeholderQuality = 40
+
+/*
+ * Makes a tiny blurred preview of the image as a data URI, for pages to show while the blob loads.
+ * The image is fitted in size x size by averaging, blurred by a pixel and written as a JPEG,
+ * or as a PNG if it has transparency.
+ */
+func placeholder(img image.Image, size int) (uri string, err error) {
+	bounds := img.Bounds()
+	size_x, size_y := bounds.Dx(), bounds.Dy()
+	if size_x == 0 || size_y == 0 {
+		return "", nil
+	}
+	scale := math.Min(1, float64(size)/math.Max(float64(size_x), float64(size_y)))
+	size_x = int(math.Max(1, math.Round(float64(size_x)*scale)))
+	size_y = int(math.Max(1, math.Round(float64(size_y)*scale)))
+	scaled := resize.Resize(img, bounds, size_x, size_y)
+	small := image.NewRGBA(image.Rect(0, 0, size_x, size_y))
+	xdraw.Draw(small, small.Bounds(), scaled, scaled.Bounds().Min, xdraw.Src)
+	blurred := blur(small, gaussianKernel(1))
+	for i := 0; i < len(small.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			// Premultiplied colors must not exceed alpha
+			small.Pix[i+c] = uint8(math.Min(float64(small.Pix[i+3]), math.Floor(blurred[i+c]+0.5)))
+		}
+	}
+	var buf bytes.Buffer
+	mime := "image/jpeg"
+	if hasTransparency(small) {
+		mime = "image/png"
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, small)
+	} else {
+		err = jpeg.Encode(&buf, small, &jpeg.Options{Quality: placeholderQuality})
+	}
+	if err != nil {
+		return "", err
+	}
+	return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Fills in the placeholder of the report if asked for, a failure only leaves it out
+func setPlaceholder(options *CompressionOptions, report *Report, img image.Image) {
+	if options.PlaceholderSize <= 0 {
+		return
+	}
+	uri, err := placeholder(img, options.PlaceholderSize)
+	if err != nil {
+		options.logger().Warningf(options.Context, "optimg: placeholder: %v", err)
+		return
+	}
+	report.Placeholder = uri
+}
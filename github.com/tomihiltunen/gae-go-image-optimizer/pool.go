@@ -0,0 +1,77 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"image"
+	"sync"
+)
+
+const maxPooledBytes = 64 << 20 // Larger buffers are left for the GC instead of pinning the memory
+
+/*
+ * Scratch buffers and pixels reused across blobs and requests.
+ * Encoding and transforming a photo takes several MB of scratch memory each time,
+ * pooling it saves the allocations of multi-file uploads and keeps the GC calmer.
+ * Only memory that does not outlive the function taking it is pooled.
+ */
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+	pixelPool sync.Pool
+)
+
+// An empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Returns the buffer to the pool, it must not be used after
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBytes {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+/*
+ * An RGBA image of the rectangle with pixels from the pool.
+ * The pixels are not cleared, the caller must draw over the whole image.
+ */
+func getRGBA(r image.Rectangle) *image.RGBA {
+	n := 4 * r.Dx() * r.Dy()
+	if pix, ok := pixelPool.Get().(*[]uint8); ok && cap(*pix) >= n {
+		return &image.RGBA{
+			Pix:    (*pix)[:n],
+			Stride: 4 * r.Dx(),
+			Rect:   r,
+		}
+	}
+	return image.NewRGBA(r)
+}
+
+// Returns the pixels of the image to the pool, the image must not be used after
+func putRGBA(img *image.RGBA) {
+	if cap(img.Pix) > maxPooledBytes {
+		return
+	}
+	pix := img.Pix[:0]
+	pixelPool.Put(&pix)
+}
@@ -0,0 +1,63 @@
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+// A photo sized image, the pooled scratch memory is a few MB for it
+var benchImage = testImage(1600, 1200)
+
+func BenchmarkTransformImage(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		orient(benchImage, 6)
+	}
+}
+
+func BenchmarkSharpenImage(b *testing.B) {
+	mask := UnsharpMask{Radius: 1, Amount: 0.5}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sharpenImage(mask, benchImage)
+	}
+}
+
+func BenchmarkAutoQuality(b *testing.B) {
+	options := defaultOptions()
+	options.AutoQuality = 0.98
+	p := &processedImage{img: benchImage, format: FormatJPEG}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.autoQuality(options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOptimize(b *testing.B) {
+	data := testJPEG(b, benchImage, 95)
+	options := testOptions(context.Background(), &MemoryStorage{}, WithMaxSize(800))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := Optimize(context.Background(), bytes.NewReader(data), ioutil.Discard, options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPooledPixelsAreReused(t *testing.T) {
+	r := image.Rect(0, 0, 16, 16)
+	img := getRGBA(r)
+	putRGBA(img)
+	// sync.Pool may drop it, e.g. on a GC in between, then a new image is fine
+	again := getRGBA(image.Rect(0, 0, 8, 8))
+	if again.Bounds() != image.Rect(0, 0, 8, 8) || len(again.Pix) != 4*8*8 || again.Stride != 4*8 {
+		t.Fatalf("pooled image is %v with %d bytes, stride %d", again.Bounds(), len(again.Pix), again.Stride)
+	}
+}
@@ -0,0 +1,110 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+ * Presets bundling the settings for common uses, so the numbers need not be worked out again in every app.
+ * Apply one before the options set in code, the later ones win: optimg.New(r, optimg.PresetWebDisplay, optimg.WithQuality(85)).
+ *
+ *      PresetThumbnail     Small square WebP thumbnails cropped around the subject, sharpened after the heavy downscale
+ *      PresetWebDisplay    Photos for the web page, 1600px at the lowest quality looking like the original
+ *      PresetArchive       Full size high quality JPEGs keeping the author and copyright, for keeping the originals
+ */
+var (
+	PresetThumbnail = preset(
+		WithMaxDimensions(256, 256),
+		WithFit(CropSmart),
+		WithOutputFormat(FormatWebP),
+		WithQuality(70),
+		WithLinearLight(true),
+		WithSharpen(0.5, 0.5, 2),
+	)
+	PresetWebDisplay = preset(
+		WithMaxSize(1600),
+		WithFit(FitInside),
+		WithOutputFormat(FormatJPEG),
+		WithQuality(82),
+		WithAutoQuality(0.98),
+		WithProgressive(true),
+		WithLinearLight(true),
+		WithSharpen(0.3, 0.8, 3),
+	)
+	PresetArchive = preset(
+		WithMaxSize(0),
+		WithOutputFormat(FormatJPEG),
+		WithQuality(92),
+		WithSubsampling(Subsampling444),
+		WithKeepMetadata(MetadataArtist, MetadataCopyright, MetadataDateTimeOriginal),
+	)
+)
+
+// The presets by their names
+var (
+	presetsMu sync.RWMutex
+	presets   = map[string]Option{
+		"thumbnail":   PresetThumbnail,
+		"web-display": PresetWebDisplay,
+		"archive":     PresetArchive,
+	}
+)
+
+// Bundles the options into one
+func preset(opts ...Option) Option {
+	return func(o *CompressionOptions) {
+		for _, opt := range opts {
+			opt(o)
+		}
+	}
+}
+
+/*
+ * Registers a preset by name, replacing the one there was, e.g. for the presets of a team.
+ * Usually called from init().
+ */
+func RegisterPreset(name string, opts ...Option) {
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	presets[strings.ToLower(name)] = preset(opts...)
+}
+
+/*
+ * Gives the preset by name, e.g. "thumbnail", "web-display" or "archive" from a configuration file.
+ * The name is case-insensitive, ok = false if there is no such preset.
+ */
+func LookupPreset(name string) (option Option, ok bool) {
+	presetsMu.RLock()
+	defer presetsMu.RUnlock()
+	option, ok = presets[strings.ToLower(name)]
+	return
+}
+
+// Names of the presets, sorted
+func PresetNames() []string {
+	presetsMu.RLock()
+	defer presetsMu.RUnlock()
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
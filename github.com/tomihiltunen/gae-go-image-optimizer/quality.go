@@ -0,0 +1,173 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"errors"
+	"image"
+)
+
+const (
+	minQuality    = 1  // Lowest quality tried when fitting the output
+	minOutputSize = 16 // Images are not made smaller than this to fit the output
+)
+
+var (
+	ErrTooManyOutputBytes = errors.New("optimg: image does not fit in the maximum output bytes")
+)
+
+/*
+ * Encodes the image in memory, in MaxOutputBytes if set.
+ *
+ *      - The quality is picked by AutoQuality if set, otherwise the quality of the options is used.
+ *      - The highest quality that fits is searched for, up to the quality above.
+ *      - If even the lowest quality does not fit the image is made smaller, 3/4 at a time.
+ */
+func (p *processedImage) encodeWithin(options *CompressionOptions) ([]byte, error) {
+	qualityOptions := *options
+	if options.AutoQuality > 0 && p.lossy(options) {
+		quality, err := p.autoQuality(options)
+		if err != nil {
+			return nil, err
+		}
+		qualityOptions.Quality = quality
+	}
+	for {
+		data, err := p.searchQuality(&qualityOptions)
+		if err != nil || data != nil {
+			return data, err
+		}
+		if !p.shrink(options) {
+			return nil, ErrTooManyOutputBytes
+		}
+	}
+}
+
+/*
+ * Binary search for the highest quality with the output in MaxOutputBytes.
+ * Returns nil if even the lowest quality does not fit.
+ */
+func (p *processedImage) searchQuality(options *CompressionOptions) (best []byte, err error) {
+	data, err := p.encodeQuality(options, options.Quality)
+	if err != nil {
+		return nil, err
+	}
+	if p.fits(options, data) {
+		return data, nil
+	}
+	// Lossless formats have only one go
+	if !p.lossy(options) {
+		return nil, nil
+	}
+	low, high := minQuality, options.Quality-1
+	for low <= high {
+		quality := (low + high) / 2
+		data, err = p.encodeQuality(options, quality)
+		if err != nil {
+			return nil, err
+		}
+		if p.fits(options, data) {
+			best = data
+			low = quality + 1
+		} else {
+			high = quality - 1
+		}
+	}
+	return
+}
+
+/*
+ * Binary search for the lowest quality with the output looking like the image.
+ *
+ *      - Looking alike is measured by SSIM of the decoded output, AutoQuality is the least accepted.
+ *      - The quality of the options is the highest picked.
+ */
+func (p *processedImage) autoQuality(options *CompressionOptions) (best int, err error) {
+	source := newLuma(p.img)
+	best = options.Quality
+	// The tries are thrown away once measured
+	buf := getBuffer()
+	defer putBuffer(buf)
+	qualityOptions := *options
+	low, high := minQuality, options.Quality-1
+	for low <= high {
+		quality := (low + high) / 2
+		buf.Reset()
+		qualityOptions.Quality = quality
+		if err := p.encode(buf, &qualityOptions); err != nil {
+			return 0, err
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return 0, err
+		}
+		if ssim(source, newLuma(decoded)) >= options.AutoQuality {
+			best = quality
+			high = quality - 1
+		} else {
+			low = quality + 1
+		}
+	}
+	return
+}
+
+// Tells whether the quality of the options has any effect on the format
+func (p *processedImage) lossy(options *CompressionOptions) bool {
+	return p.anim == nil && (p.format == FormatJPEG || p.format == FormatWebP && !options.WebPLossless)
+}
+
+// Encodes the image in memory at the given quality
+func (p *processedImage) encodeQuality(options *CompressionOptions, quality int) ([]byte, error) {
+	qualityOptions := *options
+	qualityOptions.Quality = quality
+	var buf bytes.Buffer
+	if err := p.encode(&buf, &qualityOptions); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Tells whether the encoded image is within MaxOutputBytes
+func (p *processedImage) fits(options *CompressionOptions, data []byte) bool {
+	return options.MaxOutputBytes <= 0 || int64(len(data)) <= options.MaxOutputBytes
+}
+
+// Makes the image 3/4 of its size, returns false if it is already as small as it gets
+func (p *processedImage) shrink(options *CompressionOptions) bool {
+	var size_x, size_y int
+	if p.anim != nil {
+		size_x, size_y = p.anim.Config.Width, p.anim.Config.Height
+	} else {
+		size_x, size_y = p.img.Bounds().Dx(), p.img.Bounds().Dy()
+	}
+	size_x, size_y = size_x*3/4, size_y*3/4
+	if size_x < minOutputSize || size_y < minOutputSize {
+		return false
+	}
+	options.logger().Debugf(options.Context, "optimg: made %dx%d to fit in %d bytes", size_x, size_y, options.MaxOutputBytes)
+	if p.anim != nil {
+		p.anim = resizeAnimation(options, p.anim, size_x, size_y)
+	} else {
+		palette := imagePalette(p.img)
+		p.img = scaleImage(options, p.img, p.img.Bounds(), size_x, size_y)
+		if palette != nil {
+			p.img = toPalette(p.img, palette, options.Dither)
+		}
+	}
+	p.changed = true
+	return true
+}
@@ -0,0 +1,140 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"image/color"
+	"sort"
+)
+
+// A color of the image with the number of its pixels
+type colorCount struct {
+	c [4]uint8 // Premultiplied RGBA
+	n int
+}
+
+/*
+ * Maps the image onto a palette of at most the given number of colors, picked by median cut.
+ *
+ *      - Images with no more colors than that keep them exactly, e.g. screenshots and UI images.
+ *      - Others get the colors of the most pixels, Floyd-Steinberg dithered if dither is set.
+ *      - Transparency is kept, the palette has alpha.
+ */
+func quantize(img image.Image, colors int, dither bool) image.Image {
+	// PNG palettes have no more room
+	if colors > 256 {
+		colors = 256
+	}
+	return toPalette(img, medianCut(img, colors), dither)
+}
+
+/*
+ * Picks the palette by median cut.
+ * The box of colors with the widest range of a channel is split at the median pixel of the channel,
+ * until there are as many boxes as colors asked for. Each box gives the average of its pixels.
+ */
+func medianCut(img image.Image, colors int) color.Palette {
+	counts := make(map[[4]uint8]int)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			counts[[4]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}]++
+		}
+	}
+	boxes := splitBoxes(counts, colors)
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		palette[i] = averageColor(box)
+	}
+	return palette
+}
+
+// Splits the counted colors into at most the given number of boxes by median cut
+func splitBoxes(counts map[[4]uint8]int, colors int) [][]colorCount {
+	all := make([]colorCount, 0, len(counts))
+	for c, n := range counts {
+		all = append(all, colorCount{c: c, n: n})
+	}
+	boxes := [][]colorCount{all}
+	for len(boxes) < colors {
+		best, channel, width := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if c, w := widestChannel(box); w > width {
+				best, channel, width = i, c, w
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return box[i].c[channel] < box[j].c[channel] })
+		total := 0
+		for _, c := range box {
+			total += c.n
+		}
+		// Both halves keep at least one color
+		split, seen := 1, box[0].n
+		for split < len(box)-1 && seen+box[split].n <= total/2 {
+			seen += box[split].n
+			split++
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+	return boxes
+}
+
+// The channel with the widest range of values in the box, and the range
+func widestChannel(box []colorCount) (channel, width int) {
+	for ch := 0; ch < 4; ch++ {
+		low, high := 255, 0
+		for _, c := range box {
+			if v := int(c.c[ch]); v < low {
+				low = v
+			}
+			if v := int(c.c[ch]); v > high {
+				high = v
+			}
+		}
+		if high-low > width {
+			channel, width = ch, high-low
+		}
+	}
+	return
+}
+
+// Average of the pixels of the box
+func averageColor(box []colorCount) color.RGBA {
+	var sum [4]int
+	total := 0
+	for _, c := range box {
+		for ch := range sum {
+			sum[ch] += int(c.c[ch]) * c.n
+		}
+		total += c.n
+	}
+	return color.RGBA{
+		R: uint8((sum[0] + total/2) / total),
+		G: uint8((sum[1] + total/2) / total),
+		B: uint8((sum[2] + total/2) / total),
+		A: uint8((sum[3] + total/2) / total),
+	}
+}
@@ -0,0 +1,263 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine/blobstore"
+)
+
+/*
+ * Report of optimizing a single image.
+ *
+ *      OriginalSize    Size of the original image in bytes
+ *      Size            Size of the resulting image in bytes (projected in dry-run mode)
+ *      OriginalFormat  Format of the original image, told by the content
+ *      Format          Format of the resulting image, its mime-type for the Content-Type
+ *      OriginalWidth   Width of the original image, upright
+ *      OriginalHeight  Height of the original image, upright
+ *      Width           Width of the resulting image, e.g. for the width attribute of <img>
+ *      Height          Height of the resulting image
+ *      Resized         The dimensions of the image changed
+ *      Upscaled        The image was scaled up from a smaller one (AllowUpscale), it may look soft
+ *      Animated        The image is an animated GIF or WebP
+ *      InputQuality    Estimated quality of a JPEG original (1-100), 0 for other formats
+ *      Placeholder     Data URI of a tiny blurred preview to show while the image loads, with PlaceholderSize
+ *      BlurHash        BlurHash of the image (https://blurha.sh) with 4x3 components, with BlurHash
+ *      DominantColor   Color of the most pixels of the image as "#rrggbb", with ExtractColors
+ *      Palette         Main colors of the image as "#rrggbb", the dominant one first, at most ExtractColors
+ *      PerceptualHash  Perceptual hash of the image for finding near-duplicates with FindSimilar, with PerceptualHash
+ *      NoSavings       The optimized image was not any smaller (by MinSavingsPercent), or the JPEG of lower quality already, so the original was kept
+ *      Elapsed         Time taken by the optimization, not set for variants
+ */
+type Report struct {
+	OriginalSize   int64
+	Size           int64
+	OriginalFormat Format
+	Format         Format
+	OriginalWidth  int
+	OriginalHeight int
+	Width          int
+	Height         int
+	Resized        bool
+	Upscaled       bool
+	Animated       bool
+	InputQuality   int
+	Placeholder    string
+	BlurHash       string
+	DominantColor  string
+	Palette        []string
+	PerceptualHash ImageHash
+	NoSavings      bool
+	Elapsed        time.Duration
+}
+
+// Bytes saved by the optimization
+func (r Report) Saved() int64 {
+	return r.OriginalSize - r.Size
+}
+
+// Tells whether the image was converted to another format
+func (r Report) Converted() bool {
+	return r.OriginalFormat != r.Format
+}
+
+// Records the decoded image, the result is the same until encoded
+func (r *Report) decoded(format Format, dec *decodedImage) {
+	r.OriginalFormat = format
+	r.Format = format
+	r.OriginalWidth, r.OriginalHeight = dec.size()
+	r.Width, r.Height = r.OriginalWidth, r.OriginalHeight
+	r.Animated = dec.animated()
+	r.InputQuality = dec.quality
+}
+
+// Fills in what the report tells of the pixels, while they are still in memory
+func (r *Report) summarize(options *CompressionOptions, img image.Image) {
+	if img == nil {
+		return
+	}
+	setPlaceholder(options, r, img)
+	if options.BlurHash {
+		r.BlurHash = blurHash(img)
+	}
+	if options.ExtractColors > 0 {
+		r.Palette = extractColors(img, options.ExtractColors)
+		if len(r.Palette) > 0 {
+			r.DominantColor = r.Palette[0]
+		}
+	}
+	if options.PerceptualHash {
+		r.PerceptualHash = perceptualHash(img)
+	}
+}
+
+// Records the encoded image
+func (r *Report) encoded(out *processedImage) {
+	r.Format = out.format
+	r.Width, r.Height = out.size()
+	r.Resized = r.Width != r.OriginalWidth || r.Height != r.OriginalHeight
+	r.Upscaled = out.upscaled
+}
+
+/*
+ * The result of optimizing a single blob.
+ *
+ *      Report          Sizes and format of the blob before and after optimization
+ *      Original        The blob as it was uploaded, deleted after optimization unless KeepOriginal
+ *      Blob            The blob to use; the optimized one or the original if untouched
+ *      Variants        Results of the variants by their names, Blob is nil if the variant failed
+ *      Preview         Result of the preview of the first page of a document (multi-page TIFF or PDF), which is kept as it is
+ *      Unpacked        Results of the images of an unpacked ZIP archive in archive order, Blob is nil for the archive unless KeepOriginal
+ *      Deferred        The blob is optimized in a task queue task, Blob is the original for now
+ *      Skipped         The blob was left untouched as the request was short of time (TimeBudget)
+ *      Deduplicated    Blob is an existing one of the same content, not written for this upload
+ *      ServingURL      Images API serving URL of Blob, if asked for with ServingURL in the options
+ *      Optimized       The blob had been optimized before and was left as it is (SkipOptimized)
+ *      Err             Why the blob could not be optimized, nil if all went fine
+ *      DeleteErr       Why the original could not be deleted, the optimized blob is in use anyway
+ */
+type BlobResult struct {
+	Report
+	Original     *blobstore.BlobInfo
+	Blob         *blobstore.BlobInfo
+	Variants     map[string]*BlobResult
+	Preview      *BlobResult
+	Unpacked     []*BlobResult
+	Deferred     bool
+	Skipped      bool
+	Deduplicated bool
+	ServingURL   *url.URL
+	Optimized    bool
+	Err          error
+	DeleteErr    error
+}
+
+// Bytes read of a blob left as it is to tell its dimensions, EXIF and ICC segments come before them in JPEGs
+const describeLen = 256 << 10
+
+/*
+ * Fills in the format and the upright dimensions of an image left as it is, read from its header.
+ * The image is not decoded. Blobs that are not images are left as they are.
+ */
+func describeBlob(options *CompressionOptions, result *BlobResult) {
+	reader, err := options.storage().Open(options.Context, result.Blob.BlobKey)
+	if err != nil {
+		return
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(reader, describeLen))
+	if err != nil {
+		return
+	}
+	size_x, size_y, err := uprightSize(head)
+	if err != nil {
+		return
+	}
+	format := Format(detectContentType(head))
+	result.OriginalFormat, result.Format = format, format
+	result.OriginalWidth, result.OriginalHeight = size_x, size_y
+	result.Width, result.Height = size_x, size_y
+}
+
+/*
+ * Creates a result for an untouched blob.
+ */
+func newBlobResult(blob *blobstore.BlobInfo) *BlobResult {
+	return &BlobResult{
+		Report: Report{
+			OriginalSize:   blob.Size,
+			Size:           blob.Size,
+			OriginalFormat: Format(strings.ToLower(blob.ContentType)),
+			Format:         Format(strings.ToLower(blob.ContentType)),
+		},
+		Original: blob,
+		Blob:     blob,
+	}
+}
+
+/*
+ * Error for a blob that could not be optimized.
+ *
+ *      Field   Name of the form field the blob was uploaded in
+ *      Blob    The blob as it was uploaded
+ *      Err     The underlying error
+ */
+type BlobError struct {
+	Field string
+	Blob  *blobstore.BlobInfo
+	Err   error
+}
+
+func (e *BlobError) Error() string {
+	// Images not uploaded to the blobstore have no blob before
+	if e.Blob == nil {
+		return fmt.Sprintf("optimg: field %q: %v", e.Field, e.Err)
+	}
+	return fmt.Sprintf("optimg: field %q, file %q: %v", e.Field, e.Blob.Filename, e.Err)
+}
+
+func (e *BlobError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the first failed blob of the results as a *BlobError
+func firstBlobError(results map[string][]*BlobResult) error {
+	for keyName, resultSlice := range results {
+		for _, result := range resultSlice {
+			if result.Err != nil {
+				return &BlobError{
+					Field: keyName,
+					Blob:  result.Original,
+					Err:   result.Err,
+				}
+			}
+			for _, variant := range result.Variants {
+				if variant.Err != nil {
+					return &BlobError{
+						Field: keyName,
+						Blob:  result.Original,
+						Err:   variant.Err,
+					}
+				}
+			}
+			if result.Preview != nil && result.Preview.Err != nil {
+				return &BlobError{
+					Field: keyName,
+					Blob:  result.Original,
+					Err:   result.Preview.Err,
+				}
+			}
+			for _, unpacked := range result.Unpacked {
+				if unpacked.Err != nil {
+					return &BlobError{
+						Field: keyName,
+						Blob:  result.Original,
+						Err:   unpacked.Err,
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+)
+
+/*
+ * Defaults of the RetryPolicy.
+ */
+const (
+	DefaultRetryAttempts = 3                      // Calls made at most
+	DefaultRetryBackoff  = 100 * time.Millisecond // Wait before the first retry
+)
+
+/*
+ * How failing storage calls are retried, e.g. transient RPC errors of blobstore under load.
+ * Open, Create, Delete and Stat are retried; reading and writing the blobs are not.
+ *
+ *      Attempts    Calls made at most, DefaultRetryAttempts if 0
+ *      Backoff     Wait before the first retry, doubled for each one after; DefaultRetryBackoff if 0
+ *      MaxBackoff  Longest wait between the calls, 0 = unlimited
+ *      Retryable   Tells whether the error is worth retrying, see RetryableError; not passed to deferred tasks
+ */
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Retryable  func(err error) bool
+}
+
+/*
+ * Tells whether the error of a storage call is worth retrying, the default of RetryPolicy.
+ * Missing blobs, exceeded quotas and cancelled requests are not, anything else is.
+ */
+func RetryableError(err error) bool {
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		return false
+	case err == context.Canceled || err == context.DeadlineExceeded:
+		return false
+	case appengine.IsOverQuota(err):
+		return false
+	}
+	return true
+}
+
+/*
+ * Wraps the storage so that the failing calls are retried as the policy says.
+ * The retries are logged with AppEngineLogger, the options with Retry set log them with their Logger.
+ */
+func WithRetries(storage Storage, policy *RetryPolicy) Storage {
+	return &retryStorage{
+		storage: storage,
+		policy:  policy,
+		logger:  AppEngineLogger,
+	}
+}
+
+type retryStorage struct {
+	storage Storage
+	policy  *RetryPolicy
+	logger  Logger
+}
+
+func (s *retryStorage) Open(c context.Context, key appengine.BlobKey) (reader BlobReader, err error) {
+	err = s.policy.do(c, s.logger, "opening blob "+string(key), func() (err error) {
+		reader, err = s.storage.Open(c, key)
+		return
+	})
+	return
+}
+
+func (s *retryStorage) Create(c context.Context, contentType string) (writer BlobWriter, err error) {
+	err = s.policy.do(c, s.logger, "creating blob", func() (err error) {
+		writer, err = s.storage.Create(c, contentType)
+		return
+	})
+	return
+}
+
+func (s *retryStorage) Delete(c context.Context, key appengine.BlobKey) error {
+	return s.policy.do(c, s.logger, "deleting blob "+string(key), func() error {
+		return s.storage.Delete(c, key)
+	})
+}
+
+func (s *retryStorage) Stat(c context.Context, key appengine.BlobKey) (blob *blobstore.BlobInfo, err error) {
+	err = s.policy.do(c, s.logger, "stat of blob "+string(key), func() (err error) {
+		blob, err = s.storage.Stat(c, key)
+		return
+	})
+	return
+}
+
+/*
+ * Calls fn until it succeeds, fails with an error not worth retrying or runs out of attempts.
+ * Waits between the calls with exponential backoff, not past the end of the request.
+ */
+func (p *RetryPolicy) do(c context.Context, logger Logger, what string, fn func() error) (err error) {
+	backoff := p.backoff()
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= p.attempts() || !p.retryable(err) {
+			return
+		}
+		logger.Warningf(c, "optimg: %s, attempt %d: %v", what, attempt, err)
+		select {
+		case <-time.After(backoff):
+		case <-c.Done():
+			return
+		}
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// Calls made at most
+func (p *RetryPolicy) attempts() int {
+	if p.Attempts > 0 {
+		return p.Attempts
+	}
+	return DefaultRetryAttempts
+}
+
+// Wait before the first retry
+func (p *RetryPolicy) backoff() time.Duration {
+	if p.Backoff > 0 {
+		return p.Backoff
+	}
+	return DefaultRetryBackoff
+}
+
+// Tells whether the error is worth retrying
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return RetryableError(err)
+}
@@ -0,0 +1,75 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+// A segment of a JPEG before the image data
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+/*
+ * Walks the segments of a JPEG in memory up to the image data, calling fn with each marker and its payload.
+ * Stops when fn returns false. Broken files end the walk quietly, the decoder tells what is wrong with them.
+ */
+func walkJPEG(data []byte, fn func(marker byte, payload []byte) bool) {
+	segments, _ := splitJPEG(data)
+	for _, segment := range segments {
+		if !fn(segment.marker, segment.payload) {
+			return
+		}
+	}
+}
+
+/*
+ * Splits a JPEG in memory into the segments before the image data and the rest, from the start of scan on.
+ * The rest is nil for data that is not a JPEG or is broken before the image data.
+ */
+func splitJPEG(data []byte) (segments []jpegSegment, rest []byte) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return
+	}
+	for pos := 2; pos+1 < len(data); {
+		if data[pos] != 0xff {
+			return
+		}
+		start := pos
+		// Skip any fill bytes
+		marker := data[pos+1]
+		pos += 2
+		for marker == 0xff && pos < len(data) {
+			marker = data[pos]
+			pos++
+		}
+		// Markers without a segment
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			continue
+		}
+		// Image data starts
+		if marker == 0xda || marker == 0xd9 {
+			return segments, data[start:]
+		}
+		if pos+2 > len(data) {
+			return
+		}
+		length := int(data[pos])<<8 | int(data[pos+1])
+		if length < 2 || pos+length > len(data) {
+			return
+		}
+		segments = append(segments, jpegSegment{marker: marker, payload: data[pos+2 : pos+length]})
+		pos += length
+	}
+	return
+}
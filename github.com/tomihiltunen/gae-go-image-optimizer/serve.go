@@ -0,0 +1,557 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+/*
+ * Defaults of the Server.
+ */
+const (
+	RenditionKind          = "OptimgRendition"                     // Datastore kind of the rendered images
+	DefaultServeMaxSize    = 4096                                  // Largest width or height rendered
+	DefaultCacheExpiration = 24 * time.Hour                        // How long renditions are kept in memcache
+	DefaultCacheControl    = "public, max-age=31536000, immutable" // Blobs never change once written
+
+	memcacheMaxBytes = 1000 << 10 // Memcache values are limited to 1MB
+)
+
+var ErrInvalidParams = errors.New("optimg: invalid image parameters")
+
+/*
+ * Serves blobs resized on the fly, e.g. /images/<blob key>?w=400&h=400&fit=crop&fm=webp.
+ *
+ *      - Each size is rendered once, written to the storage and recorded in the datastore (kind OptimgRendition).
+ *      - Renditions small enough are cached in memcache as well.
+ *      - Without parameters the blob is served as it is.
+ *      - With Negotiate the format is picked by the Accept header unless given in fm, each format is rendered once.
+ *      - Blobs never change, so each blob and rendition has a strong ETag and browsers revalidating get a 304.
+ *      - Range requests and If-Modified-Since are answered as by http.ServeContent.
+ *      - With a Secret only links made by SignURL are served, until they expire; raw blob keys get a 403.
+ *      - Without one only the widths and heights of Sizes and the qualities of Qualities are rendered,
+ *        anyone could fill the storage with renditions otherwise.
+ *
+ *      Options             Options the renditions start from, defaults if nil; Request and Context are not used
+ *      Key                 Gets the blob key from the request, the last segment of the path by default
+ *      MaxSize             Largest width or height rendered, DefaultServeMaxSize if 0
+ *      CacheExpiration     How long renditions are kept in memcache, DefaultCacheExpiration if 0
+ *      Negotiate           Pick the format by the Accept header of the browser
+ *      Formats             Formats picked if accepted, in order of preference; AVIF and WebP by default, if encoders for them are registered
+ *      CacheControl        Cache-Control header of the images, DefaultCacheControl if empty
+ *      Secret              Key the links are signed with, any link is served if empty
+ *      Sizes               Widths and heights rendered for links not signed, e.g. {200, 400, 800}; none if nil
+ *      Qualities           Qualities rendered for links not signed, e.g. {60, 80}; the one of the options only if nil
+ *
+ * The parameters:
+ *
+ *      w       Maximum width
+ *      h       Maximum height
+ *      fit     inside (default), crop, smart, stretch or pad
+ *      fm      jpeg, png, webp, avif or gif
+ *      q       Quality (1-100)
+ */
+type Server struct {
+	Options         *CompressionOptions
+	Key             func(r *http.Request) appengine.BlobKey
+	MaxSize         int
+	CacheExpiration time.Duration
+	Negotiate       bool
+	Formats         []Format
+	CacheControl    string
+	Secret          []byte
+	Sizes           []int
+	Qualities       []int
+}
+
+/*
+ * A rendered size of a blob, named by the hash of the blob key and the parameters.
+ *
+ *      Original        The blob rendered
+ *      BlobKey         The rendered image
+ *      ContentType     Format of the rendered image
+ *      Params          The parameters it was rendered with
+ *      Created         When it was rendered
+ */
+type rendition struct {
+	Original    appengine.BlobKey
+	BlobKey     appengine.BlobKey `datastore:",noindex"`
+	ContentType string            `datastore:",noindex"`
+	Params      string            `datastore:",noindex"`
+	Created     time.Time         `datastore:",noindex"`
+}
+
+// A rendition cached in memcache
+type cachedRendition struct {
+	ContentType string
+	Data        []byte
+	Created     time.Time
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	key := s.key(r)
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	// Private images only through signed links
+	if len(s.Secret) > 0 {
+		if err := verifySignature(s.Secret, key, r.URL.Query(), time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	params, err := s.parseParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Modern browsers get smaller files
+	if s.Negotiate {
+		w.Header().Add("Vary", "Accept")
+		if params == nil || params.format == "" {
+			if format := s.negotiate(r.Header.Get("Accept")); format != "" {
+				if params == nil {
+					params = &imageParams{}
+				}
+				params.format = format
+			}
+		}
+	}
+	name := renditionName(key, params)
+	options := s.options(c)
+	// As it is
+	if params == nil {
+		s.serveBlob(c, w, r, options, key, name)
+		return
+	}
+	// Small ones are in memcache
+	var cached cachedRendition
+	if _, err := memcache.Gob.Get(c, "optimg:"+name, &cached); err == nil {
+		if !s.cacheHeaders(w, r, name) {
+			serveData(w, r, cached.ContentType, cached.Created, cached.Data)
+		}
+		return
+	}
+	// Rendered before
+	var rend rendition
+	err = datastore.Get(c, renditionKey(c, name), &rend)
+	if err == nil {
+		if reader, err := options.storage().Open(c, rend.BlobKey); err == nil {
+			if !s.cacheHeaders(w, r, name) {
+				serveReader(w, r, rend.ContentType, rend.Created, reader)
+			}
+			return
+		}
+		// Gone missing, rendered again
+		_ = datastore.Delete(c, renditionKey(c, name))
+	} else if err != datastore.ErrNoSuchEntity {
+		options.logger().Errorf(c, "optimg: rendition of blob %s: %v", key, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data, rendered, err := s.render(c, options, key, params, name)
+	if err != nil {
+		options.logger().Errorf(c, "optimg: rendering blob %s: %v", key, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(data) <= memcacheMaxBytes {
+		item := &memcache.Item{
+			Key: "optimg:" + name,
+			Object: &cachedRendition{
+				ContentType: rendered.ContentType,
+				Data:        data,
+				Created:     rendered.Created,
+			},
+			Expiration: s.cacheExpiration(),
+		}
+		if err := memcache.Gob.Set(c, item); err != nil {
+			options.logger().Warningf(c, "optimg: caching rendition of blob %s: %v", key, err)
+		}
+	}
+	if !s.cacheHeaders(w, r, name) {
+		serveData(w, r, rendered.ContentType, rendered.Created, data)
+	}
+}
+
+/*
+ * Sets the ETag and Cache-Control headers of an image known to exist, never for errors.
+ * Answers with a 304 and returns true if the browser has it already.
+ */
+func (s *Server) cacheHeaders(w http.ResponseWriter, r *http.Request, name string) (notModified bool) {
+	etag := `"` + name + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", s.cacheControl(r))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+/*
+ * Renders the blob with the parameters, writes it to the storage and records it in the datastore.
+ * If another request got to render it first, theirs is kept.
+ */
+func (s *Server) render(c context.Context, options *CompressionOptions, key appengine.BlobKey, params *imageParams, name string) (data []byte, rend *rendition, err error) {
+	renderOptions := *options
+	params.apply(&renderOptions)
+	reader, err := renderOptions.storage().Open(c, key)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	report, err := Optimize(c, reader, &buf, &renderOptions)
+	if err != nil {
+		return
+	}
+	data = buf.Bytes()
+	blob, err := writeNewBlob(&renderOptions, report.Format, writeData(data))
+	if err != nil {
+		return
+	}
+	rend = &rendition{
+		Original:    key,
+		BlobKey:     blob.BlobKey,
+		ContentType: string(report.Format),
+		Params:      params.String(),
+		Created:     time.Now(),
+	}
+	datastoreKey := renditionKey(c, name)
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		var existing rendition
+		err := datastore.Get(tc, datastoreKey, &existing)
+		if err == nil {
+			rend = &existing
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(tc, datastoreKey, rend)
+		return err
+	}, nil)
+	if err != nil || rend.BlobKey != blob.BlobKey {
+		_ = deleteBlob(&renderOptions, blob.BlobKey)
+	}
+	return
+}
+
+// Serves the blob as it is
+func (s *Server) serveBlob(c context.Context, w http.ResponseWriter, r *http.Request, options *CompressionOptions, key appengine.BlobKey, name string) {
+	blob, err := options.storage().Stat(c, key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	reader, err := options.storage().Open(c, key)
+	if err != nil {
+		options.logger().Errorf(c, "optimg: opening blob %s: %v", key, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if s.cacheHeaders(w, r, name) {
+		return
+	}
+	serveReader(w, r, blob.ContentType, blob.CreationTime, reader)
+}
+
+/*
+ * Tells whether the If-None-Match header matches the ETag.
+ * Compared weakly as the header asks for.
+ */
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Serves an image from memory
+func serveData(w http.ResponseWriter, r *http.Request, contentType string, modified time.Time, data []byte) {
+	serveReader(w, r, contentType, modified, bytes.NewReader(data))
+}
+
+// Serves an image from a reader
+func serveReader(w http.ResponseWriter, r *http.Request, contentType string, modified time.Time, content io.ReadSeeker) {
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", modified, content)
+}
+
+// Blob key of the request
+func (s *Server) key(r *http.Request) appengine.BlobKey {
+	if s.Key != nil {
+		return s.Key(r)
+	}
+	name := path.Base(r.URL.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return appengine.BlobKey(name)
+}
+
+// Copy of the options of the server with the context
+func (s *Server) options(c context.Context) *CompressionOptions {
+	options := defaultOptions()
+	if s.Options != nil {
+		*options = *s.Options
+	}
+	options.Request = nil
+	options.Context = c
+	return options
+}
+
+/*
+ * Cache-Control header of the images.
+ * Signed links are cached privately and no longer than they are valid.
+ */
+func (s *Server) cacheControl(r *http.Request) string {
+	if len(s.Secret) > 0 && s.CacheControl == "" {
+		expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+		return "private, max-age=" + strconv.FormatInt(expires-time.Now().Unix(), 10)
+	}
+	if s.CacheControl != "" {
+		return s.CacheControl
+	}
+	return DefaultCacheControl
+}
+
+// Largest width or height rendered
+func (s *Server) maxSize() int {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return DefaultServeMaxSize
+}
+
+// How long renditions are kept in memcache
+func (s *Server) cacheExpiration() time.Duration {
+	if s.CacheExpiration > 0 {
+		return s.CacheExpiration
+	}
+	return DefaultCacheExpiration
+}
+
+/*
+ * The parameters of a rendition.
+ *
+ *      width       Maximum width, 0 = any
+ *      height      Maximum height, 0 = any
+ *      fit         How the image is fitted in the dimensions
+ *      format      Format to render in, the one of the options if empty
+ *      quality     Quality to render at, the one of the options if 0
+ */
+type imageParams struct {
+	width   int
+	height  int
+	fit     FitMode
+	format  Format
+	quality int
+}
+
+// Names of the fit modes in the parameters
+var fitNames = map[string]FitMode{
+	"inside":  FitInside,
+	"crop":    CropCenter,
+	"smart":   CropSmart,
+	"stretch": Stretch,
+	"pad":     Pad,
+}
+
+// Names of the formats in the parameters
+var formatNames = map[string]Format{
+	"jpeg": FormatJPEG,
+	"jpg":  FormatJPEG,
+	"png":  FormatPNG,
+	"webp": FormatWebP,
+	"avif": FormatAVIF,
+	"gif":  FormatGIF,
+}
+
+/*
+ * Picks the most preferred of the formats the browser accepts.
+ * Only formats with an encoder registered are picked, empty if none.
+ */
+func (s *Server) negotiate(accept string) Format {
+	formats := s.Formats
+	if formats == nil {
+		formats = []Format{FormatAVIF, FormatWebP}
+	}
+	accepted := make(map[Format]bool)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		parts := strings.Split(mediaRange, ";")
+		refused := false
+		for _, param := range parts[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if value, err := strconv.ParseFloat(q[2:], 64); err == nil && value <= 0 {
+					refused = true
+				}
+			}
+		}
+		if !refused {
+			accepted[Format(strings.ToLower(strings.TrimSpace(parts[0])))] = true
+		}
+	}
+	for _, format := range formats {
+		if accepted[format] && lookupEncoder(format) != nil {
+			return format
+		}
+	}
+	return ""
+}
+
+/*
+ * Parses the parameters of the query.
+ * Returns nil if there are none, the blob is served as it is.
+ */
+func (s *Server) parseParams(query url.Values) (params *imageParams, err error) {
+	params = &imageParams{}
+	found := false
+	number := func(name string, max int) int {
+		value := query.Get(name)
+		if value == "" || err != nil {
+			return 0
+		}
+		found = true
+		n, parseErr := strconv.Atoi(value)
+		if parseErr != nil || n <= 0 || n > max {
+			err = ErrInvalidParams
+		}
+		return n
+	}
+	params.width = number("w", s.maxSize())
+	params.height = number("h", s.maxSize())
+	params.quality = number("q", 100)
+	if err != nil {
+		return nil, err
+	}
+	// Signed links cannot be made up, the others are limited to the renditions allowed
+	if len(s.Secret) == 0 {
+		if !allowed(s.Sizes, params.width) || !allowed(s.Sizes, params.height) || !allowed(s.Qualities, params.quality) {
+			return nil, ErrInvalidParams
+		}
+	}
+	if value := query.Get("fit"); value != "" {
+		fit, ok := fitNames[value]
+		if !ok {
+			return nil, ErrInvalidParams
+		}
+		params.fit, found = fit, true
+	}
+	if value := query.Get("fm"); value != "" {
+		format, ok := formatNames[value]
+		if !ok {
+			return nil, ErrInvalidParams
+		}
+		params.format, found = format, true
+	}
+	if !found {
+		return nil, nil
+	}
+	return
+}
+
+// Tells whether the value of a parameter is among the allowed ones, 0 = not given
+func allowed(values []int, value int) bool {
+	if value == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// The parameters in the same order every time
+func (p *imageParams) String() string {
+	values := url.Values{}
+	if p.width > 0 {
+		values.Set("w", strconv.Itoa(p.width))
+	}
+	if p.height > 0 {
+		values.Set("h", strconv.Itoa(p.height))
+	}
+	for name, fit := range fitNames {
+		if fit == p.fit && fit != FitInside {
+			values.Set("fit", name)
+		}
+	}
+	if p.format != "" {
+		values.Set("fm", string(p.format))
+	}
+	if p.quality > 0 {
+		values.Set("q", strconv.Itoa(p.quality))
+	}
+	return values.Encode()
+}
+
+/*
+ * Sets the parameters in the options.
+ * The rendition is made as asked for, the savings and output size limits of the options do not fall back to the original.
+ */
+func (p *imageParams) apply(options *CompressionOptions) {
+	options.SkipLarger, options.SkipLowQuality, options.MinSavingsPercent, options.MaxOutputBytes = false, false, 0, 0
+	options.Size = 0
+	options.MaxWidth = p.width
+	options.MaxHeight = p.height
+	options.Fit = p.fit
+	if p.format != "" {
+		options.OutputFormat = p.format
+	}
+	// The quality asked for goes for whatever the format
+	if p.quality > 0 {
+		options.Quality, options.JPEGQuality, options.WebPQuality = p.quality, 0, 0
+	}
+}
+
+// Name of the rendition of the blob with the parameters, nil parameters for the blob itself
+func renditionName(key appengine.BlobKey, params *imageParams) string {
+	query := ""
+	if params != nil {
+		query = params.String()
+	}
+	sum := sha256.Sum256([]byte(string(key) + "?" + query))
+	return hex.EncodeToString(sum[:])
+}
+
+// Key of the rendition entity
+func renditionKey(c context.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, RenditionKind, name, 0, nil)
+}
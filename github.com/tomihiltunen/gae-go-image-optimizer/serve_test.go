@@ -0,0 +1,33 @@
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+)
+
+func TestRenderFormatConversion(t *testing.T) {
+	data := testJPEG(t, testImage(64, 48), 60)
+	// A PNG is larger than the JPEG, none of these may keep the original
+	options := testOptions(context.Background(), nil,
+		WithMinSavingsPercent(10), WithMaxOutputBytes(int64(len(data))), WithSkipLowQuality(true))
+	params := &imageParams{width: 32, format: FormatPNG}
+	params.apply(options)
+	var out bytes.Buffer
+	report, err := Optimize(context.Background(), bytes.NewReader(data), &out, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NoSavings {
+		t.Error("original kept, want the rendition asked for")
+	}
+	img, err := png.Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("output is not a PNG: %v", err)
+	}
+	if width := img.Bounds().Dx(); width != 32 {
+		t.Errorf("width %d, want 32", width)
+	}
+}
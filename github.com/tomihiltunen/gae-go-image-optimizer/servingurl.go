@@ -0,0 +1,36 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// App Engine packages
+	aeimage "google.golang.org/appengine/image"
+)
+
+/*
+ * Gets the Images API serving URL of the blob of the result, if asked to in the options.
+ * A failing call is logged, the blob is optimized anyway.
+ */
+func setServingURL(options *CompressionOptions, result *BlobResult) {
+	if options.ServingURL == nil || options.DryRun || result.Blob == nil {
+		return
+	}
+	servingURL, err := aeimage.ServingURL(options.Context, result.Blob.BlobKey, options.ServingURL)
+	if err != nil {
+		options.logger().Errorf(options.Context, "optimg: serving URL of blob %s: %v", result.Blob.BlobKey, err)
+		return
+	}
+	result.ServingURL = servingURL
+}
@@ -0,0 +1,123 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"image/draw"
+	"math"
+)
+
+/*
+ * Unsharp mask applied to the images after resizing.
+ *
+ *      Amount      Strength of the sharpening, e.g. 0.5 = 50%, 0 = no sharpening
+ *      Radius      Radius of the blur in pixels, e.g. 0.5-1 for thumbnails
+ *      Threshold   Differences (0-255) below this are left alone, keeps noise from being sharpened
+ */
+type UnsharpMask struct {
+	Amount    float64
+	Radius    float64
+	Threshold int
+}
+
+/*
+ * Sharpens the image with the unsharp mask.
+ *
+ *      - The image is blurred with a gaussian blur of the radius.
+ *      - The difference of the image and the blurred image is added back to the image, times Amount.
+ *      - Alpha is left as it is.
+ */
+func sharpenImage(mask UnsharpMask, img image.Image) image.Image {
+	if mask.Amount <= 0 || mask.Radius <= 0 {
+		return img
+	}
+	bounds := img.Bounds()
+	src := getRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	defer putRGBA(src)
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	blurred := blur(src, gaussianKernel(mask.Radius))
+	sharpened := image.NewRGBA(src.Bounds())
+	for i := 0; i < len(src.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			value := float64(src.Pix[i+c])
+			diff := value - blurred[i+c]
+			if math.Abs(diff) >= float64(mask.Threshold) {
+				value += mask.Amount * diff
+			}
+			// Premultiplied colors must not exceed alpha
+			sharpened.Pix[i+c] = uint8(math.Max(0, math.Min(float64(src.Pix[i+3]), math.Floor(value+0.5))))
+		}
+		sharpened.Pix[i+3] = src.Pix[i+3]
+	}
+	return sharpened
+}
+
+// Normalized gaussian weights reaching 3 sigmas out, sigma = radius
+func gaussianKernel(radius float64) []float64 {
+	size := int(math.Ceil(radius * 3))
+	kernel := make([]float64, 2*size+1)
+	sum := 0.0
+	for i := range kernel {
+		x := float64(i - size)
+		kernel[i] = math.Exp(-x * x / (2 * radius * radius))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// Blurs the image horizontally and vertically with the kernel, clamping at the edges
+func blur(img *image.RGBA, kernel []float64) []float64 {
+	size_x, size_y := img.Bounds().Dx(), img.Bounds().Dy()
+	half := len(kernel) / 2
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+	horizontal := make([]float64, len(img.Pix))
+	for y := 0; y < size_y; y++ {
+		for x := 0; x < size_x; x++ {
+			for k, weight := range kernel {
+				from := img.PixOffset(clamp(x+k-half, size_x), y)
+				to := img.PixOffset(x, y)
+				for c := 0; c < 3; c++ {
+					horizontal[to+c] += weight * float64(img.Pix[from+c])
+				}
+			}
+		}
+	}
+	blurred := make([]float64, len(img.Pix))
+	for y := 0; y < size_y; y++ {
+		for x := 0; x < size_x; x++ {
+			for k, weight := range kernel {
+				from := img.PixOffset(x, clamp(y+k-half, size_y))
+				to := img.PixOffset(x, y)
+				for c := 0; c < 3; c++ {
+					blurred[to+c] += weight * horizontal[from+c]
+				}
+			}
+		}
+	}
+	return blurred
+}
@@ -0,0 +1,82 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+)
+
+var ErrInvalidSignature = errors.New("optimg: invalid or expired signature")
+
+/*
+ * Gives a link to the blob valid until the expiry, for a Server with the same Secret.
+ *
+ *      secret      Secret of the Server
+ *      prefix      Path the Server is at, e.g. "/images/"
+ *      key         The blob
+ *      params      The parameters (w, h, fit, fm and q), nil for the blob as it is
+ *      expires     Time after which the link no longer works
+ *
+ * The link is signed with HMAC-SHA256 over the blob key, the parameters and the expiry,
+ * none of them can be changed without the secret.
+ */
+func SignURL(secret []byte, prefix string, key appengine.BlobKey, params url.Values, expires time.Time) string {
+	query := url.Values{}
+	for name, values := range params {
+		query[name] = values
+	}
+	query.Del("sig")
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", signature(secret, key, query))
+	return strings.TrimSuffix(prefix, "/") + "/" + url.PathEscape(string(key)) + "?" + query.Encode()
+}
+
+/*
+ * Checks the signature and the expiry of the query of a link to the blob.
+ */
+func verifySignature(secret []byte, key appengine.BlobKey, query url.Values, now time.Time) error {
+	sig := query.Get("sig")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if sig == "" || err != nil || now.Unix() > expires {
+		return ErrInvalidSignature
+	}
+	signed := url.Values{}
+	for name, values := range query {
+		signed[name] = values
+	}
+	signed.Del("sig")
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, key, signed))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// HMAC of the blob key and the query, the query is encoded in sorted order
+func signature(secret []byte, key appengine.BlobKey, query url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(string(key) + "?" + query.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,138 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"math"
+)
+
+const smartCropSize = 256 // Larger dimension of the thumbnail the crop window is looked for in
+
+/*
+ * Finds the corner of the crop_x * crop_y window with the most detail in it.
+ *
+ *      - Detail is the edge energy (luma gradient) of a thumbnail of the image.
+ *      - The window spans the whole image in one dimension, it only slides in the other.
+ *      - The window with the most of the faces in it wins, detail only settles between those.
+ *      - Ties are settled in favour of the window closest to the center.
+ */
+func smartCorner(img image.Image, crop_x, crop_y int, faces []image.Rectangle) image.Point {
+	bounds := img.Bounds()
+	center := image.Pt(bounds.Min.X+(bounds.Dx()-crop_x)/2, bounds.Min.Y+(bounds.Dy()-crop_y)/2)
+	if crop_x >= bounds.Dx() && crop_y >= bounds.Dy() {
+		return center
+	}
+	// Detail is looked for in a thumbnail, the exact pixels do not matter
+	scale := math.Min(1, float64(smartCropSize)/math.Max(float64(bounds.Dx()), float64(bounds.Dy())))
+	thumb_x := int(math.Max(1, math.Floor(float64(bounds.Dx())*scale+0.5)))
+	thumb_y := int(math.Max(1, math.Floor(float64(bounds.Dy())*scale+0.5)))
+	thumb := img
+	if thumb_x != bounds.Dx() || thumb_y != bounds.Dy() {
+		thumb = scaleImage(&CompressionOptions{Filter: FilterBilinear}, img, bounds, thumb_x, thumb_y)
+	}
+	energy := edgeEnergy(newLuma(thumb))
+	// Sum the energy along the axis the window spans
+	horizontal := crop_x < bounds.Dx()
+	length := thumb_y
+	if horizontal {
+		length = thumb_x
+	}
+	sums := make([]float64, length)
+	for y := 0; y < thumb_y; y++ {
+		for x := 0; x < thumb_x; x++ {
+			if horizontal {
+				sums[x] += energy[y*thumb_x+x]
+			} else {
+				sums[y] += energy[y*thumb_x+x]
+			}
+		}
+	}
+	// Along the axis the window slides
+	window, full := crop_y, bounds.Dy()
+	if horizontal {
+		window, full = crop_x, bounds.Dx()
+	}
+	// Each bit of a face weighs more than all the detail together
+	var total float64
+	for _, sum := range sums {
+		total += sum
+	}
+	for _, face := range faces {
+		face = face.Sub(bounds.Min)
+		from, to := face.Min.Y, face.Max.Y
+		if horizontal {
+			from, to = face.Min.X, face.Max.X
+		}
+		for i := from * length / full; i < to*length/full && i < length; i++ {
+			if i >= 0 {
+				sums[i] += total + 1
+			}
+		}
+	}
+	// Slide the window over the sums
+	size := int(math.Max(1, math.Min(float64(length), math.Floor(float64(window)*float64(length)/float64(full)+0.5))))
+	var current float64
+	for i := 0; i < size; i++ {
+		current += sums[i]
+	}
+	middle := (length - size) / 2
+	best, bestScore := 0, current
+	for start := 1; start+size <= length; start++ {
+		current += sums[start+size-1] - sums[start-1]
+		if current > bestScore || current == bestScore && abs(start-middle) < abs(best-middle) {
+			best, bestScore = start, current
+		}
+	}
+	if best == middle {
+		return center
+	}
+	// Back to the pixels of the image
+	offset := int(math.Floor(float64(best)*float64(full)/float64(length) + 0.5))
+	if offset > full-window {
+		offset = full - window
+	}
+	if horizontal {
+		return image.Pt(bounds.Min.X+offset, center.Y)
+	}
+	return image.Pt(center.X, bounds.Min.Y+offset)
+}
+
+// Magnitude of the luma gradient of each pixel
+func edgeEnergy(l *luma) []float64 {
+	w, h := l.rect.Dx(), l.rect.Dy()
+	energy := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*l.stride + x
+			if x+1 < w {
+				energy[y*w+x] += math.Abs(l.pix[i+1] - l.pix[i])
+			}
+			if y+1 < h {
+				energy[y*w+x] += math.Abs(l.pix[i+l.stride] - l.pix[i])
+			}
+		}
+	}
+	return energy
+}
+
+// Absolute value of an integer
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+)
+
+const ssimWindow = 8 // Size of the windows compared
+
+/*
+ * Luma of an image, 0-255.
+ */
+type luma struct {
+	pix    []float64
+	stride int
+	rect   image.Rectangle
+}
+
+// Takes the luma of the image
+func newLuma(img image.Image) *luma {
+	bounds := img.Bounds()
+	l := &luma{
+		pix:    make([]float64, bounds.Dx()*bounds.Dy()),
+		stride: bounds.Dx(),
+		rect:   image.Rect(0, 0, bounds.Dx(), bounds.Dy()),
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			l.pix[(y-bounds.Min.Y)*l.stride+(x-bounds.Min.X)] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+		}
+	}
+	return l
+}
+
+/*
+ * Structural similarity (SSIM) of two images of the same size.
+ *
+ *      - 1 = identical, the lower the more they differ.
+ *      - Mean of the SSIM of 8x8 windows.
+ */
+func ssim(a, b *luma) float64 {
+	if a.rect != b.rect {
+		return 0
+	}
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	total, windows := 0.0, 0
+	for y0 := 0; y0+ssimWindow <= a.rect.Dy(); y0 += ssimWindow {
+		for x0 := 0; x0+ssimWindow <= a.rect.Dx(); x0 += ssimWindow {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := y0; y < y0+ssimWindow; y++ {
+				for x := x0; x < x0+ssimWindow; x++ {
+					pa, pb := a.pix[y*a.stride+x], b.pix[y*b.stride+x]
+					sumA += pa
+					sumB += pb
+					sumAA += pa * pa
+					sumBB += pb * pb
+					sumAB += pa * pb
+				}
+			}
+			n := float64(ssimWindow * ssimWindow)
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			covar := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*covar + c2)) / ((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	// Too small to tell
+	if windows == 0 {
+		return 1
+	}
+	return total / float64(windows)
+}
+
+/*
+ * Perceptual similarity of two images, the SSIM of their luma.
+ *
+ *      - 1 = identical, the lower the more they differ.
+ *      - 0 for images of different sizes.
+ *      - E.g. for comparing the output against golden images in tests.
+ */
+func Similarity(a, b image.Image) float64 {
+	return ssim(newLuma(a), newLuma(b))
+}
@@ -0,0 +1,99 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"io"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+)
+
+/*
+ * Where the images are read from and written to.
+ * Blobstore is used unless told otherwise.
+ *
+ *      Open        Opens a blob for reading
+ *      Create      Creates a new blob, the key is available once the writer is closed
+ *      Delete      Removes a blob
+ *      Stat        Gets the BlobInfo of a blob
+ */
+type Storage interface {
+	Open(c context.Context, key appengine.BlobKey) (BlobReader, error)
+	Create(c context.Context, contentType string) (BlobWriter, error)
+	Delete(c context.Context, key appengine.BlobKey) error
+	Stat(c context.Context, key appengine.BlobKey) (*blobstore.BlobInfo, error)
+}
+
+/*
+ * Reader for the contents of a blob.
+ */
+type BlobReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+/*
+ * Writer for a new blob.
+ */
+type BlobWriter interface {
+	io.WriteCloser
+	Key() (appengine.BlobKey, error)
+}
+
+/*
+ * Storage backed by App Engine blobstore.
+ * Blobstore cannot write blobs of its own, new ones go to the app's default Cloud Storage bucket
+ * and are served through blobstore by their blob keys, see GCSStorage.
+ */
+var Blobstore Storage = blobstoreStorage{}
+
+type blobstoreStorage struct{}
+
+func (blobstoreStorage) Open(c context.Context, key appengine.BlobKey) (BlobReader, error) {
+	return blobstore.NewReader(c, key), nil
+}
+
+func (blobstoreStorage) Create(c context.Context, contentType string) (BlobWriter, error) {
+	return (&GCSStorage{}).Create(c, contentType)
+}
+
+func (blobstoreStorage) Delete(c context.Context, key appengine.BlobKey) error {
+	return (&GCSStorage{}).Delete(c, key)
+}
+
+func (blobstoreStorage) Stat(c context.Context, key appengine.BlobKey) (*blobstore.BlobInfo, error) {
+	return (&GCSStorage{}).Stat(c, key)
+}
+
+// Storage of the options, blobstore unless told otherwise, retrying the failing calls if asked to
+func (o *CompressionOptions) storage() Storage {
+	storage := o.Storage
+	if storage == nil {
+		storage = Blobstore
+	}
+	if o.Retry != nil {
+		return &retryStorage{
+			storage: storage,
+			policy:  o.Retry,
+			logger:  o.logger(),
+		}
+	}
+	return storage
+}
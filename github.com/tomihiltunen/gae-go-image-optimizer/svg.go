@@ -0,0 +1,278 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"image"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// SVGs are sanitized, not encoded, unless rasterized with RasterizeSVG
+const FormatSVG Format = "image/svg+xml"
+
+var ErrNoSVGRasterizer = errors.New("optimg: no SVGRasterizer plugged in")
+
+/*
+ * Rasterizer for SVGs, used with RasterizeSVG, e.g. for thumbnails. Go has none of its own.
+ * Plug in one with WithSVGRasterizer, e.g. wrapping oksvg or librsvg. It gets the sanitized SVG and the box to fit the image in,
+ * keeping the aspect ratio; 0 for either side leaves that side to the size of the SVG.
+ */
+type SVGRasterizer func(r io.Reader, width, height int) (image.Image, error)
+
+// Elements dropped with all their content, scripts and anything embedding HTML or other documents
+var svgUnsafeElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// Elements animating the attributes of others, which could animate a link to a script
+var svgAnimations = map[string]bool{
+	"animate":          true,
+	"set":              true,
+	"animatemotion":    true,
+	"animatetransform": true,
+}
+
+var (
+	cssImport = regexp.MustCompile(`(?i)@import[^;]*;?`)
+	cssURL    = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")]*?)\s*['"]?\s*\)`)
+	safeImage = regexp.MustCompile(`(?i)^data:image/(png|jpeg|gif|webp)[;,]`)
+)
+
+var (
+	svgTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	svgAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;")
+)
+
+// Tells whether the data is an SVG document, by its root element after the prolog
+func isSVG(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	for {
+		data = bytes.TrimLeft(data, " \t\r\n")
+		var end []byte
+		switch {
+		case bytes.HasPrefix(data, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(data, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(data, []byte("<!")):
+			// The DOCTYPE may declare entities within brackets
+			end = []byte(">")
+			if i := bytes.IndexByte(data, '['); i >= 0 && i < bytes.IndexByte(data, '>') {
+				end = []byte("]>")
+			}
+		default:
+			return bytes.HasPrefix(data, []byte("<svg")) && len(data) > 4 && strings.ContainsRune(" \t\r\n>/", rune(data[4]))
+		}
+		i := bytes.Index(data, end)
+		if i < 0 {
+			return false
+		}
+		data = data[i+len(end):]
+	}
+}
+
+// Tells whether the link stays within the document, or is an embedded raster image
+func safeLink(link string) bool {
+	link = strings.TrimSpace(link)
+	return link == "" || strings.HasPrefix(link, "#") || safeImage.MatchString(link)
+}
+
+// Strips the imports and the external urls of the style sheet
+func sanitizeCSS(css string) string {
+	css = cssImport.ReplaceAllString(css, "")
+	return cssURL.ReplaceAllStringFunc(css, func(url string) string {
+		if safeLink(cssURL.FindStringSubmatch(url)[1]) {
+			return url
+		}
+		return "none"
+	})
+}
+
+// Qualified name of the element or attribute as written, RawToken leaves the prefixes as they are
+func svgName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// The attribute with its value sanitized, false if it is to be dropped
+func sanitizeSVGAttr(attr xml.Attr) (xml.Attr, bool) {
+	name := strings.ToLower(attr.Name.Local)
+	value := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return attr, false
+	case strings.Contains(value, "javascript:") || strings.Contains(value, "vbscript:"):
+		return attr, false
+	case name == "href" || name == "src":
+		return attr, safeLink(attr.Value)
+	case name == "style" || strings.Contains(value, "url("):
+		attr.Value = sanitizeCSS(attr.Value)
+	}
+	return attr, true
+}
+
+// Tells whether the animation targets a link, which the attribute checks do not see
+func animatesLink(elem xml.StartElement) bool {
+	if !svgAnimations[strings.ToLower(elem.Name.Local)] {
+		return false
+	}
+	for _, attr := range elem.Attr {
+		if strings.EqualFold(attr.Name.Local, "attributeName") {
+			target := strings.ToLower(attr.Value)
+			return target == "href" || strings.HasSuffix(target, ":href")
+		}
+	}
+	return false
+}
+
+/*
+ * Sanitizes the SVG for storing and serving to browsers.
+ *
+ *      - Drops scripts, foreignObject and other embedded documents, and event handler attributes.
+ *      - Drops links to anything but the document itself and embedded raster images, also in styles.
+ *      - Drops comments, processing instructions and the DOCTYPE, with its entities.
+ *      - Malformed XML is an error, browsers do not render it either.
+ */
+func sanitizeSVG(data []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	var stack []string
+	// Depth within a dropped element
+	skip := 0
+	// The start tag is left open until it is known whether it has any content
+	open := false
+	closeTag := func() {
+		if open {
+			out.WriteByte('>')
+			open = false
+		}
+	}
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 || svgUnsafeElements[strings.ToLower(t.Name.Local)] || animatesLink(t) {
+				skip++
+				continue
+			}
+			closeTag()
+			out.WriteString("<" + svgName(t.Name))
+			for _, attr := range t.Attr {
+				if attr, ok := sanitizeSVGAttr(attr); ok {
+					out.WriteString(" " + svgName(attr.Name) + `="` + svgAttrEscaper.Replace(attr.Value) + `"`)
+				}
+			}
+			stack = append(stack, strings.ToLower(t.Name.Local))
+			open = true
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if open {
+				out.WriteString("/>")
+				open = false
+			} else {
+				out.WriteString("</" + svgName(t.Name) + ">")
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			closeTag()
+			text := string(t)
+			if len(stack) > 0 && stack[len(stack)-1] == "style" {
+				text = sanitizeCSS(text)
+			}
+			out.WriteString(svgTextEscaper.Replace(text))
+		case xml.ProcInst:
+			if t.Target == "xml" && out.Len() == 0 {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+	}
+	if len(stack) > 0 || skip > 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return out.Bytes(), nil
+}
+
+// Rasterizes the sanitized SVG to fit in the maximum size
+func rasterizeSVG(data []byte, options *CompressionOptions) (image.Image, error) {
+	if options.SVGRasterizer == nil {
+		return nil, ErrNoSVGRasterizer
+	}
+	clean, err := sanitizeSVG(data)
+	if err != nil {
+		return nil, err
+	}
+	return options.SVGRasterizer(bytes.NewReader(clean), options.maxWidth(), options.maxHeight())
+}
+
+/*
+ * Sanitizes the SVG blob, replacing it unless there was nothing to strip.
+ * Not rasterized, see RasterizeSVG.
+ */
+func handleSVG(options *CompressionOptions, result *BlobResult) {
+	blob := result.Original
+	result.OriginalFormat, result.Format = FormatSVG, FormatSVG
+	data, err := readBlob(options, blob)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	clean, err := sanitizeSVG(data)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	if bytes.Equal(clean, data) {
+		options.logger().Debugf(options.Context, "optimg: blob %s: SVG clean already, left as it is", blob.BlobKey)
+		markOptimized(options, blob.BlobKey)
+		return
+	}
+	writeBlob(options, result, FormatSVG, writeData(clean))
+	if result.Err == nil {
+		options.logger().Infof(options.Context, "optimg: blob %s: SVG sanitized, %d bytes to %d", blob.BlobKey, result.OriginalSize, result.Size)
+		markOptimized(options, result.Blob.BlobKey)
+		if options.Ledger && !options.DryRun {
+			recordLedger(options, result)
+		}
+		afterOptimize(options, result)
+	}
+}
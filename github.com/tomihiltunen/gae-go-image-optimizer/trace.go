@@ -0,0 +1,65 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+
+	// OpenTelemetry packages
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/tomihiltunen/gae-go-image-optimizer"
+
+/*
+ * Starts a span in the tracer provider of the app, e.g. one exporting to Cloud Trace.
+ * Nothing is recorded unless the app has set one with otel.SetTracerProvider().
+ *
+ *      optimg.Blob         Each blob optimized, with the sizes, format and dimensions
+ *      optimg.Optimize     Each image optimized by Optimize()
+ *      optimg.<phase>      The phases of each, see Phase
+ */
+func startSpan(c context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(c, name, trace.WithAttributes(attrs...))
+}
+
+// Ends the span, marking it failed if there was an error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Ends the span of a blob or image with the outcome
+func endReportSpan(span trace.Span, report Report, err error) {
+	span.SetAttributes(
+		attribute.Int64("optimg.input_size", report.OriginalSize),
+		attribute.Int64("optimg.output_size", report.Size),
+		attribute.String("optimg.input_format", string(report.OriginalFormat)),
+		attribute.String("optimg.output_format", string(report.Format)),
+		attribute.Int("optimg.input_width", report.OriginalWidth),
+		attribute.Int("optimg.input_height", report.OriginalHeight),
+		attribute.Int("optimg.output_width", report.Width),
+		attribute.Int("optimg.output_height", report.Height),
+		attribute.Bool("optimg.resized", report.Resized),
+	)
+	endSpan(span, err)
+}
@@ -0,0 +1,97 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+	"image/color"
+)
+
+/*
+ * Crops away the borders of uniform color, e.g. the white background of product photos or scanner margins.
+ *
+ *      - The border color is the one of the top-left pixel.
+ *      - Pixels within the tolerance (0-255 per channel) of it count as border.
+ *      - Images of a single color are returned as they are.
+ */
+func trimImage(img image.Image, tolerance int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return img
+	}
+	border := color.NRGBAModel.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA)
+	isBorder := func(x, y int) bool {
+		return colorDistance(border, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)) <= tolerance
+	}
+	rowIsBorder := func(y int) bool {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	colIsBorder := func(x, min_y, max_y int) bool {
+		for y := min_y; y < max_y; y++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	// Rows from the top and bottom first, the columns only need to be checked between them
+	min_y, max_y := bounds.Min.Y, bounds.Max.Y
+	for min_y < max_y && rowIsBorder(min_y) {
+		min_y++
+	}
+	if min_y == max_y {
+		return img
+	}
+	for max_y > min_y && rowIsBorder(max_y-1) {
+		max_y--
+	}
+	min_x, max_x := bounds.Min.X, bounds.Max.X
+	for min_x < max_x && colIsBorder(min_x, min_y, max_y) {
+		min_x++
+	}
+	for max_x > min_x && colIsBorder(max_x-1, min_y, max_y) {
+		max_x--
+	}
+	trimmed := image.Rect(min_x, min_y, max_x, max_y)
+	if trimmed == bounds {
+		return img
+	}
+	return cropImage(img, trimmed)
+}
+
+// Largest difference of the channels of the two colors
+func colorDistance(a, b color.NRGBA) int {
+	distance := 0
+	for _, d := range []int{
+		int(a.R) - int(b.R),
+		int(a.G) - int(b.G),
+		int(a.B) - int(b.B),
+		int(a.A) - int(b.A),
+	} {
+		if d < 0 {
+			d = -d
+		}
+		if d > distance {
+			distance = d
+		}
+	}
+	return distance
+}
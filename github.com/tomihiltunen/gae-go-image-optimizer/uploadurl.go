@@ -0,0 +1,77 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"context"
+	"net/url"
+	"time"
+
+	// App Engine packages
+	"google.golang.org/appengine/blobstore"
+)
+
+// How long the options of an upload URL are valid by default, blobstore upload URLs expire sooner
+const DefaultUploadURLExpiry = 24 * time.Hour
+
+/*
+ * Options of an upload URL.
+ *
+ *      Secret      Key the options are signed with, give the same to WithSignedOverrides in the upload handler
+ *      Options     The options of the uploads, by the names of SignOverrides, e.g. {"preset": {"thumbnail"}}
+ *      Expires     Time after which the options are ignored, DefaultUploadURLExpiry from now if zero
+ *      Blobstore   Limits and bucket of the upload, passed on to blobstore.UploadURL()
+ */
+type UploadURLOptions struct {
+	Secret    []byte
+	Options   url.Values
+	Expires   time.Time
+	Blobstore *blobstore.UploadURLOptions
+}
+
+/*
+ * Creates a blobstore upload URL carrying the options of the uploads, signed, in its success path.
+ * The upload handler with WithSignedOverrides(secret) applies them, it need not know what the form asked for.
+ *
+ *      - The options are in the OverridesField query parameter of the success path.
+ *      - Invalid options are an error here rather than ignored in the upload handler.
+ *      - Options in the form field of SignOverrides are applied before these, they cannot change these.
+ *      - The options are only valid in the handler at the path of successPath.
+ */
+func CreateUploadURL(c context.Context, successPath string, opts *UploadURLOptions) (*url.URL, error) {
+	if opts == nil {
+		opts = &UploadURLOptions{}
+	}
+	if len(opts.Secret) > 0 && len(opts.Options) > 0 {
+		// Better told now than ignored in the upload handler
+		if _, err := parseOverrides(opts.Options); err != nil {
+			return nil, err
+		}
+		expires := opts.Expires
+		if expires.IsZero() {
+			expires = time.Now().Add(DefaultUploadURLExpiry)
+		}
+		success, err := url.Parse(successPath)
+		if err != nil {
+			return nil, err
+		}
+		query := success.Query()
+		query.Set(OverridesField, SignOverrides(opts.Secret, success.Path, opts.Options, expires))
+		success.RawQuery = query.Encode()
+		successPath = success.String()
+	}
+	return blobstore.UploadURL(c, successPath, opts.Blobstore)
+}
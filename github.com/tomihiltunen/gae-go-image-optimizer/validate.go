@@ -0,0 +1,74 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"fmt"
+)
+
+/*
+ * Error of an image not meeting MinWidth, MinHeight or the aspect ratio range, the upload has been deleted.
+ *
+ *      Reason      Which requirement the image fails, e.g. "narrower than 1200px"
+ *      Width       Width of the upright image
+ *      Height      Height of the upright image
+ */
+type InvalidImageError struct {
+	Reason string
+	Width  int
+	Height int
+}
+
+func (e *InvalidImageError) Error() string {
+	return fmt.Sprintf("optimg: %dx%d image %s", e.Width, e.Height, e.Reason)
+}
+
+/*
+ * Checks the dimensions of the upright image against the requirements of the options, before decoding it.
+ *
+ *      - MinWidth and MinHeight in pixels, 0 = any.
+ *      - MinAspect and MaxAspect as width / height, e.g. 3 for a 3:1 banner, 0 = any.
+ */
+func validateSize(options *CompressionOptions, width, height int) error {
+	reason := ""
+	aspect := float64(width) / float64(height)
+	switch {
+	case options.MinWidth > 0 && width < options.MinWidth:
+		reason = fmt.Sprintf("narrower than %dpx", options.MinWidth)
+	case options.MinHeight > 0 && height < options.MinHeight:
+		reason = fmt.Sprintf("lower than %dpx", options.MinHeight)
+	case options.MinAspect > 0 && aspect < options.MinAspect:
+		reason = fmt.Sprintf("narrower than aspect ratio %g", options.MinAspect)
+	case options.MaxAspect > 0 && aspect > options.MaxAspect:
+		reason = fmt.Sprintf("wider than aspect ratio %g", options.MaxAspect)
+	default:
+		return nil
+	}
+	return &InvalidImageError{
+		Reason: reason,
+		Width:  width,
+		Height: height,
+	}
+}
+
+// Tells whether the upload was refused by its content and is to be deleted
+func isRejected(err error) bool {
+	switch err.(type) {
+	case *RejectedError, *InvalidImageError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"image"
+)
+
+/*
+ * Makes the variants of the image.
+ *
+ *      - Each variant is the image resized to the maximum dimension of the variant.
+ *      - Variants are written as new blobs next to the optimized one.
+ *      - Variants get the rest of the options from the main image, watermark included.
+ */
+func handleVariants(options *CompressionOptions, result *BlobResult, img image.Image, metadata []byte) {
+	result.Variants = make(map[string]*BlobResult, len(options.Variants))
+	for name, size := range options.Variants {
+		variant := &BlobResult{
+			Report: Report{
+				OriginalSize:   result.OriginalSize,
+				OriginalFormat: result.OriginalFormat,
+				OriginalWidth:  result.OriginalWidth,
+				OriginalHeight: result.OriginalHeight,
+			},
+			Original: result.Original,
+		}
+		result.Variants[name] = variant
+		// Do not start encoding for a request that is already gone
+		if err := checkDeadline(options); err != nil {
+			variant.Err = err
+			continue
+		}
+		variantOptions := *options
+		variantOptions.Size = size
+		variantOptions.MaxWidth = 0
+		variantOptions.MaxHeight = 0
+		variantImg := resizeImage(&variantOptions, img)
+		if options.Watermark != nil {
+			var err error
+			if variantImg, err = options.Watermark.apply(&variantOptions, variantImg); err != nil {
+				variant.Err = err
+				continue
+			}
+		}
+		variantImg, format := prepareOutput(img, variantImg, &variantOptions)
+		out := &processedImage{
+			img:      variantImg,
+			format:   format,
+			metadata: metadata,
+			changed:  true, // Variants are written even if larger than the upload
+			upscaled: upscaled(&variantOptions, img.Bounds().Dx(), img.Bounds().Dy()),
+		}
+		encodeFn, _, err := out.encoder(&variantOptions, result.OriginalSize)
+		if err != nil {
+			variant.Err = err
+			continue
+		}
+		variant.Blob, variant.Size, variant.Deduplicated, variant.Err = createBlob(&variantOptions, out.format, encodeFn)
+		variant.encoded(out)
+		if variant.Err == nil && variant.Blob != nil {
+			markOptimized(&variantOptions, variant.Blob.BlobKey)
+			setServingURL(&variantOptions, variant)
+		}
+	}
+}
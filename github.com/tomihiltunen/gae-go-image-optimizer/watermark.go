@@ -0,0 +1,135 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"sync"
+
+	// App Engine packages
+	"google.golang.org/appengine"
+)
+
+/*
+ * Where the watermark is placed.
+ */
+type Position int
+
+const (
+	PositionBottomRight Position = iota
+	PositionBottomLeft
+	PositionTopRight
+	PositionTopLeft
+	PositionCenter
+)
+
+/*
+ * Image drawn on every optimized image.
+ * The watermark image is decoded once and kept, share one between the requests.
+ *
+ *      Data        The watermark as an encoded image, e.g. an embedded PNG
+ *      BlobKey     Blob to read the watermark from if Data is not given
+ *      Position    Where the watermark is placed, bottom right by default
+ *      Opacity     Opacity of the watermark (0-1), 0 = fully opaque
+ *      Margin      Distance from the edges in pixels
+ *      Scale       Width of the watermark relative to the image, e.g. 0.2; 0 = as it is
+ */
+type Watermark struct {
+	Data     []byte
+	BlobKey  appengine.BlobKey
+	Position Position
+	Opacity  float64
+	Margin   int
+	Scale    float64
+
+	mu  sync.Mutex
+	img image.Image
+}
+
+/*
+ * Draws the watermark on a copy of the image.
+ */
+func (w *Watermark) apply(options *CompressionOptions, img image.Image) (image.Image, error) {
+	mark, err := w.load(options)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	// Scale relative to the image
+	if w.Scale > 0 {
+		size_x := int(float64(bounds.Dx()) * w.Scale)
+		size_y := mark.Bounds().Dy() * size_x / mark.Bounds().Dx()
+		if size_x > 0 && size_y > 0 {
+			mark = scaleImage(options, mark, mark.Bounds(), size_x, size_y)
+		}
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), img, bounds.Min, draw.Src)
+	opacity := w.Opacity
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(opacity*255 + 0.5)})
+	at := w.corner(canvas.Bounds().Size(), mark.Bounds().Size())
+	draw.DrawMask(canvas, image.Rectangle{at, at.Add(mark.Bounds().Size())}, mark, mark.Bounds().Min, mask, image.Point{}, draw.Over)
+	return canvas, nil
+}
+
+// Top left corner of the watermark on an image of the given size
+func (w *Watermark) corner(size, mark image.Point) image.Point {
+	left, top := w.Margin, w.Margin
+	right, bottom := size.X-mark.X-w.Margin, size.Y-mark.Y-w.Margin
+	switch w.Position {
+	case PositionBottomLeft:
+		return image.Pt(left, bottom)
+	case PositionTopRight:
+		return image.Pt(right, top)
+	case PositionTopLeft:
+		return image.Pt(left, top)
+	case PositionCenter:
+		return image.Pt((size.X-mark.X)/2, (size.Y-mark.Y)/2)
+	}
+	return image.Pt(right, bottom)
+}
+
+// Decodes the watermark image on first use
+func (w *Watermark) load(options *CompressionOptions) (image.Image, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.img != nil {
+		return w.img, nil
+	}
+	data := w.Data
+	if data == nil {
+		reader, err := options.storage().Open(options.Context, w.BlobKey)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	w.img = img
+	return img, nil
+}
@@ -0,0 +1,111 @@
+/***************************************************************
+*
+*   GAE Go automatic blob image optimizer
+*
+*   Created by Tomi Hiltunen 2013.
+*   http://www.linkedin.com/in/tomihiltunen
+*
+*   https://github.com/TomiHiltunen/GAE-Go-image-optimizer
+*
+*       - Use this script however you wish.
+*       - Do not remove any copyrights/comments on any files included.
+*       - All use is on your own risk.
+*
+***************************************************************/
+package optimg
+
+import (
+	// Go packages
+	"archive/zip"
+	"bytes"
+	"errors"
+	"path"
+	"strings"
+)
+
+var ErrTooManyFiles = errors.New("optimg: archive has too many files")
+
+const maxZipFiles = 1000 // Files unpacked of an archive at most
+
+// Tells by the first bytes whether the blob is a ZIP archive
+func isZip(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04"))
+}
+
+/*
+ * Unpacks the ZIP archive of the result, each image in it is optimized and written to a blob of its own.
+ *
+ *      - The results of the images are in result.Unpacked in archive order, Filename is the name in the archive.
+ *      - Other files, directories and hidden files (e.g. __MACOSX) are left out.
+ *      - The archive and each file in it are limited to MaxBytes, there may be up to 1000 files.
+ *      - The archive is deleted once unpacked unless KeepOriginal, Blob is nil then.
+ *      - The remaining files are left out once the request is cancelled, the error is in Err.
+ */
+func unpackZip(options *CompressionOptions, result *BlobResult) {
+	data, err := readBlob(options, result.Original)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		result.Err = err
+		return
+	}
+	if len(archive.File) > maxZipFiles {
+		result.Err = ErrTooManyFiles
+		return
+	}
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || hiddenFile(file.Name) {
+			continue
+		}
+		if err := checkDeadline(options); err != nil {
+			result.Err = err
+			return
+		}
+		unpacked, ok := unpackFile(options, file)
+		if ok {
+			result.Unpacked = append(result.Unpacked, unpacked)
+		}
+	}
+	// All good!
+	if !options.KeepOriginal && !options.DryRun {
+		result.DeleteErr = deleteBlob(options, result.Original.BlobKey)
+		result.Blob = nil
+	}
+}
+
+// Optimizes and stores a file of the archive, false if it is not an image
+func unpackFile(options *CompressionOptions, file *zip.File) (result *BlobResult, ok bool) {
+	reader, err := file.Open()
+	if err != nil {
+		return &BlobResult{Err: err}, true
+	}
+	defer reader.Close()
+	data, err := readImage(reader, options)
+	if err != nil {
+		return &BlobResult{Err: err}, true
+	}
+	if !validateMimeType(options, detectContentType(data), "") {
+		return nil, false
+	}
+	result, err = storeImage(options, data)
+	if result == nil {
+		result = &BlobResult{Err: err}
+	}
+	if result.Blob != nil {
+		result.Blob.Filename = path.Base(file.Name)
+	}
+	return result, true
+}
+
+// Tells whether the file is hidden or metadata of the archiver, e.g. __MACOSX/._photo.jpg
+func hiddenFile(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,3 @@
+module github.com/tomihiltunen/resize
+
+go 1.21